@@ -0,0 +1,333 @@
+// Local admin endpoint, lists what is going through iox and kills connections
+//
+//	GET    /            all of below
+//	GET    /tunnels     working modes
+//	GET    /limit       bandwidth limit of all tunnels, PUT {"up": N, "down": N} in byte per second changes it
+//	PUT    /tunnels/ID/limit  change bandwidth limit of the tunnel
+//	GET    /agents      connected reverse socks5 agents, the relayed ones have parent
+//	GET    /pipes       forwarding connections
+//	GET    /agents/ID   the agent with round trip of its control stream
+//	DELETE /agents/ID   close the agent session
+//	POST   /agents/ID/ping  ping targets by the agent
+//	POST   /agents/ID/scan  scan ports by the agent, JSON lines of open ports then the summary
+//	POST   /agents/ID/exec  run command on the agent, JSON lines of output then the exit code
+//	POST   /agents/ID/get   download file of the agent, JSON lines of progress then the result
+//	POST   /agents/ID/put   upload file to the agent, JSON lines of progress then the result
+//	POST   /agents/ID/route serve socks5 on server whose requests are made by the agent
+//	DELETE /pipes/ID    close the connection
+//	PUT    /pipes/ID/limit    change bandwidth limit of the connection
+//	GET    /metrics     prometheus metrics
+//
+// Requests other than GET must carry the token, see guard
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iox/logger"
+	"iox/metrics"
+	"iox/netio"
+	"iox/operate"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errNotLoopback = errors.New("Admin endpoint must listen on loopback address or unix socket")
+	errNotSocket   = errors.New("Admin unix socket path exists and isn't a socket")
+)
+
+type tunnelView struct {
+	ID        uint64    `json:"id"`
+	Mode      string    `json:"mode"`
+	A         string    `json:"a"`
+	B         string    `json:"b,omitempty"`
+	EncA      bool      `json:"enc_a"`
+	EncB      bool      `json:"enc_b"`
+	Start     time.Time `json:"start"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+	LimitUp   int64     `json:"limit_up,omitempty"`
+	LimitDown int64     `json:"limit_down,omitempty"`
+}
+
+type agentView struct {
+	ID        uint64    `json:"id"`
+	Parent    uint64    `json:"parent,omitempty"`
+	Addr      string    `json:"addr"`
+	Encrypted bool      `json:"encrypted"`
+	Start     time.Time `json:"start"`
+
+	// only for GET /agents/ID
+	RTT      float64 `json:"rtt_ms,omitempty"`
+	RTTError string  `json:"rtt_error,omitempty"`
+}
+
+type pipeView struct {
+	ID        uint64    `json:"id"`
+	Tunnel    uint64    `json:"tunnel,omitempty"`
+	Src       string    `json:"src"`
+	Dst       string    `json:"dst"`
+	Target    string    `json:"target,omitempty"`
+	EncSrc    bool      `json:"enc_src"`
+	EncDst    bool      `json:"enc_dst"`
+	Start     time.Time `json:"start"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+	LimitUp   int64     `json:"limit_up,omitempty"`
+	LimitDown int64     `json:"limit_down,omitempty"`
+}
+
+func listTunnels() []tunnelView {
+	views := []tunnelView{}
+	for _, t := range netio.Tunnels() {
+		v := tunnelView{
+			ID:        t.ID,
+			Mode:      t.Mode,
+			A:         t.A,
+			B:         t.B,
+			EncA:      t.EncA,
+			EncB:      t.EncB,
+			Start:     t.Start,
+			BytesUp:   t.BytesUp(),
+			BytesDown: t.BytesDown(),
+		}
+		v.LimitUp, v.LimitDown = t.Limit()
+		views = append(views, v)
+	}
+	return views
+}
+
+func listAgents() []agentView {
+	views := []agentView{}
+	for _, a := range netio.Agents() {
+		views = append(views, agentView{
+			ID:        a.ID,
+			Parent:    a.Parent,
+			Addr:      a.Addr,
+			Encrypted: a.Encrypted,
+			Start:     a.Start,
+		})
+	}
+	return views
+}
+
+func listPipes() []pipeView {
+	views := []pipeView{}
+	for _, p := range netio.Pipes() {
+		v := pipeView{
+			ID:        p.ID,
+			Src:       p.Src,
+			Dst:       p.Dst,
+			Target:    p.Target,
+			EncSrc:    p.EncA,
+			EncDst:    p.EncB,
+			Start:     p.Start,
+			BytesUp:   p.BytesUp(),
+			BytesDown: p.BytesDown(),
+		}
+		v.LimitUp, v.LimitDown = p.Limit()
+		if p.Tunnel != nil {
+			v.Tunnel = p.Tunnel.ID
+		}
+		views = append(views, v)
+	}
+	return views
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// Parse the ID from path like /pipes/ID
+func parseID(path string, prefix string) (uint64, bool) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(path, prefix), 10, 64)
+	return id, err == nil
+}
+
+func handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"tunnels": listTunnels(),
+		"agents":  listAgents(),
+		"pipes":   listPipes(),
+	})
+}
+
+func handleTunnels(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, listTunnels())
+}
+
+func handleAgents(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/agents" {
+		writeJSON(w, listAgents())
+		return
+	}
+
+	// /agents/ID or /agents/ID/JOB
+	path, job := r.URL.Path, ""
+	if i := strings.LastIndexByte(path, '/'); i > len("/agents/") {
+		path, job = path[:i], path[i+1:]
+	}
+
+	id, ok := parseID(path, "/agents/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	agent := netio.GetAgent(id)
+	if agent == nil {
+		http.Error(w, "No such agent", http.StatusNotFound)
+		return
+	}
+
+	if job != "" {
+		handleJob(w, r, agent, job)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		view := agentView{
+			ID:        agent.ID,
+			Parent:    agent.Parent,
+			Addr:      agent.Addr,
+			Encrypted: agent.Encrypted,
+			Start:     agent.Start,
+		}
+		if rtt, err := operate.AgentRTT(agent.ID); err != nil {
+			view.RTTError = err.Error()
+		} else {
+			view.RTT = float64(rtt) / float64(time.Millisecond)
+		}
+		writeJSON(w, view)
+		return
+	case http.MethodDelete:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger.Debug("Admin kill agent %d (%s)", agent.ID, agent.Addr)
+	agent.Kill()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handlePipes(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/pipes" {
+		writeJSON(w, listPipes())
+		return
+	}
+
+	// /pipes/ID or /pipes/ID/limit
+	path := strings.TrimSuffix(r.URL.Path, "/limit")
+	id, ok := parseID(path, "/pipes/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	pipe := netio.GetPipe(id)
+	if pipe == nil {
+		http.Error(w, "No such pipe", http.StatusNotFound)
+		return
+	}
+
+	if path != r.URL.Path {
+		serveLimit(w, r, pipe, fmt.Sprintf("pipe %d", pipe.ID))
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger.Debug("Admin kill pipe %d: %s <== FWD ==> %s", pipe.ID, pipe.Src, pipe.Dst)
+	pipe.Kill()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Listen on `unix:PATH`, `HOST:PORT` or `PORT`, only loopback HOST is allowed
+func listen(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix:") {
+		path := address[len("unix:"):]
+		// a stale socket of last run is removed, anything else is kept
+		if info, err := os.Lstat(path); err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				return nil, errNotSocket
+			}
+			if err = os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+		return net.Listen("unix", path)
+	}
+
+	if _, err := strconv.Atoi(address); err == nil {
+		address = "127.0.0.1:" + address
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return nil, errNotLoopback
+		}
+	}
+
+	return net.Listen("tcp", address)
+}
+
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleIndex)
+	mux.HandleFunc("/tunnels", handleTunnels)
+	mux.HandleFunc("/tunnels/", handleTunnelLimit)
+	mux.HandleFunc("/limit", handleLimit)
+	mux.HandleFunc("/agents", handleAgents)
+	mux.HandleFunc("/agents/", handleAgents)
+	mux.HandleFunc("/pipes", handlePipes)
+	mux.HandleFunc("/pipes/", handlePipes)
+	mux.HandleFunc("/metrics", metrics.Handler)
+	return mux
+}
+
+// Serve runs the admin endpoint, it should be called in a new goroutine
+func Serve(address string) {
+	listener, err := listen(address)
+	if err != nil {
+		logger.Error("Admin listen on %s error: %s", address, err.Error())
+		return
+	}
+	defer listener.Close()
+
+	path := tokenPath(address)
+	token, err := writeToken(path)
+	if err != nil {
+		logger.Error("Admin token write to %s error: %s", path, err.Error())
+		return
+	}
+
+	logger.Info("Admin endpoint is listening on %s, token is in %s", address, path)
+
+	isUnix := strings.HasPrefix(address, "unix:")
+	err = http.Serve(listener, guard(newMux(), token, !isUnix))
+	if err != nil {
+		logger.Warn("Admin endpoint error: %s", err.Error())
+	}
+}
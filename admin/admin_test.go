@@ -0,0 +1,49 @@
+package admin
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iox-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a regular file isn't removed
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, []byte("keep"), 0600)
+	if _, err = listen("unix:" + file); err != errNotSocket {
+		t.Fatalf("Listen on regular file got %v, want %v", err, errNotSocket)
+	}
+	if b, _ := ioutil.ReadFile(file); string(b) != "keep" {
+		t.Fatal("Regular file is removed")
+	}
+
+	// nor the target of a link
+	link := filepath.Join(dir, "link")
+	os.Symlink(file, link)
+	if _, err = listen("unix:" + link); err != errNotSocket {
+		t.Fatalf("Listen on link got %v, want %v", err, errNotSocket)
+	}
+
+	// a stale socket is replaced
+	path := filepath.Join(dir, "admin.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+}
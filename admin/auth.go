@@ -0,0 +1,120 @@
+package admin
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"iox/option"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Requests changing anything must carry the token written by server to a
+// file only its user can read, and a JSON body. So a web page can't make
+// them, as it can neither read the token nor set the header without CORS.
+// Requests whose Host isn't loopback are refused against DNS rebinding
+const TOKEN_HEADER = "X-Iox-Token"
+
+// tokenPath is the token file of the admin address, unless `--admin-token`
+func tokenPath(address string) string {
+	if option.ADMIN_TOKEN != "" {
+		return option.ADMIN_TOKEN
+	}
+	if strings.HasPrefix(address, "unix:") {
+		return address[len("unix:"):] + ".token"
+	}
+
+	port := address
+	if _, p, err := net.SplitHostPort(address); err == nil {
+		port = p
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "iox-admin-"+port+".token")
+	}
+	return filepath.Join(dir, "iox", "admin-"+port+".token")
+}
+
+// writeToken writes a new random token to path, readable by the user only.
+// The file is created anew, so a link planted there isn't followed
+func writeToken(path string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err = f.WriteString(token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func readToken(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// guard checks the requests before h. Host isn't checked on unix socket,
+// which browsers can't reach
+func guard(h http.Handler, token string, checkHost bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if checkHost && !isLoopbackHost(r.Host) {
+			http.Error(w, "Host must be loopback", http.StatusForbidden)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(TOKEN_HEADER)), []byte(token)) != 1 {
+			http.Error(w, "Admin token mismatch, send the token of server by "+TOKEN_HEADER+" header", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodPost || r.Method == http.MethodPut {
+			typ, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || typ != "application/json" {
+				http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,103 @@
+package admin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGuard(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name      string
+		method    string
+		host      string
+		token     string
+		typ       string
+		checkHost bool
+		want      int
+	}{
+		{"get", http.MethodGet, "127.0.0.1:7777", "", "", true, http.StatusNoContent},
+		{"get localhost", http.MethodGet, "localhost:7777", "", "", true, http.StatusNoContent},
+		{"get ipv6", http.MethodGet, "[::1]:7777", "", "", true, http.StatusNoContent},
+		{"rebinding", http.MethodGet, "evil.example:7777", "", "", true, http.StatusForbidden},
+		{"rebinding post", http.MethodPost, "evil.example:7777", "secret", "application/json", true, http.StatusForbidden},
+		{"unix", http.MethodPost, "unix", "secret", "application/json", false, http.StatusNoContent},
+		{"no token", http.MethodPost, "127.0.0.1:7777", "", "application/json", true, http.StatusUnauthorized},
+		{"wrong token", http.MethodPost, "127.0.0.1:7777", "secrex", "application/json", true, http.StatusUnauthorized},
+		{"text plain", http.MethodPost, "127.0.0.1:7777", "secret", "text/plain", true, http.StatusUnsupportedMediaType},
+		{"no type", http.MethodPut, "127.0.0.1:7777", "secret", "", true, http.StatusUnsupportedMediaType},
+		{"json charset", http.MethodPut, "127.0.0.1:7777", "secret", "application/json; charset=utf-8", true, http.StatusNoContent},
+		{"delete", http.MethodDelete, "127.0.0.1:7777", "secret", "", true, http.StatusNoContent},
+		{"delete no token", http.MethodDelete, "127.0.0.1:7777", "", "", true, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/agents/1/exec", strings.NewReader("{}"))
+		r.Host = tt.host
+		if tt.token != "" {
+			r.Header.Set(TOKEN_HEADER, tt.token)
+		}
+		if tt.typ != "" {
+			r.Header.Set("Content-Type", tt.typ)
+		}
+
+		w := httptest.NewRecorder()
+		guard(ok, "secret", tt.checkHost).ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestWriteToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iox-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a planted link isn't written through
+	target := filepath.Join(dir, "target")
+	path := filepath.Join(dir, "sub", "admin.token")
+	os.MkdirAll(filepath.Dir(path), 0700)
+	if err = os.Symlink(target, path); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := writeToken(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) != 64 {
+		t.Fatalf("Token %q", token)
+	}
+	if _, err = os.Stat(target); !os.IsNotExist(err) {
+		t.Fatal("Token is written through the link")
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != 0600 {
+		t.Fatalf("Token file mode %v", info.Mode())
+	}
+
+	read, err := readToken(path)
+	if err != nil || read != token {
+		t.Fatalf("Read token %q, %v", read, err)
+	}
+
+	again, err := writeToken(path)
+	if err != nil || again == token {
+		t.Fatalf("Token isn't renewed: %q, %v", again, err)
+	}
+}
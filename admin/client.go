@@ -0,0 +1,311 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"iox/operate"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errNoAgent        = errors.New("No agent is connected to the server")
+	errMultipleAgents = errors.New("Multiple agents are connected, choose one by `--agent ID`")
+)
+
+// Client of the admin endpoint, address is the same as Serve
+func newClient(address string) (*http.Client, string) {
+	if strings.HasPrefix(address, "unix:") {
+		path := address[len("unix:"):]
+		return &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		}, "http://unix"
+	}
+
+	if _, err := strconv.Atoi(address); err == nil {
+		address = "127.0.0.1:" + address
+	}
+	return &http.Client{}, "http://" + address
+}
+
+func do(address string, method string, path string, in interface{}) (*http.Response, error) {
+	client, base := newClient(address)
+
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if method != http.MethodGet {
+		token, err := readToken(tokenPath(address))
+		if err != nil {
+			return nil, fmt.Errorf("Read admin token error: %s, specify the file by `--admin-token`", err.Error())
+		}
+		req.Header.Set(TOKEN_HEADER, token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 0x1000))
+		return nil, errors.New(strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// Send in as JSON and decode the response into out, either can be nil
+func call(address string, method string, path string, in interface{}, out interface{}) error {
+	resp, err := do(address, method, path, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Like call, but the response is JSON lines passed to onLine one by one
+func callStream(address string, method string, path string, in interface{}, onLine func(json.RawMessage) error) error {
+	resp, err := do(address, method, path, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var line json.RawMessage
+		if err = dec.Decode(&line); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err = onLine(line); err != nil {
+			return err
+		}
+	}
+}
+
+// ID 0 chooses the only agent
+func chooseAgent(address string, id uint64) (uint64, error) {
+	if id != 0 {
+		return id, nil
+	}
+
+	var agents []agentView
+	if err := call(address, http.MethodGet, "/agents", nil, &agents); err != nil {
+		return 0, err
+	}
+
+	switch len(agents) {
+	case 0:
+		return 0, errNoAgent
+	case 1:
+		return agents[0].ID, nil
+	default:
+		return 0, errMultipleAgents
+	}
+}
+
+// Ping runs `iox ping` against the server's admin endpoint
+func Ping(address string, agentID uint64, req operate.PingRequest) error {
+	id, err := chooseAgent(address, agentID)
+	if err != nil {
+		return err
+	}
+
+	var results []operate.PingResult
+	err = call(address, http.MethodPost, fmt.Sprintf("/agents/%d/ping", id), req, &results)
+	if err != nil {
+		return err
+	}
+
+	alive := 0
+	for _, r := range results {
+		target := r.Target
+		if r.IP != "" && r.IP != r.Target {
+			target = fmt.Sprintf("%s (%s)", r.Target, r.IP)
+		}
+
+		switch {
+		case r.Alive:
+			alive++
+			fmt.Printf("%s is alive, rtt %.3fms\n", target, r.RTT)
+		case r.Error != "":
+			fmt.Printf("%s error: %s\n", target, r.Error)
+		default:
+			fmt.Printf("%s no reply\n", target)
+		}
+	}
+
+	fmt.Printf("%d/%d alive\n", alive, len(results))
+	return nil
+}
+
+// Scan runs `iox scan` against the server's admin endpoint, open ports are
+// printed as soon as they are found
+func Scan(address string, agentID uint64, req operate.ScanRequest) error {
+	id, err := chooseAgent(address, agentID)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	return callStream(address, http.MethodPost, fmt.Sprintf("/agents/%d/scan", id), req, func(line json.RawMessage) error {
+		var v struct {
+			operate.ScanResult
+			operate.ScanSummary
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(line, &v); err != nil {
+			return err
+		}
+
+		switch {
+		case v.Error != "":
+			return errors.New(v.Error)
+		case v.Port != 0:
+			fmt.Printf("%s open, rtt %.3fms\n", net.JoinHostPort(v.Target, strconv.Itoa(v.Port)), v.RTT)
+		default:
+			fmt.Printf("%d/%d open, %.1fs\n", v.Open, v.Probes, time.Since(start).Seconds())
+		}
+		return nil
+	})
+}
+
+// Exec runs `iox exec` against the server's admin endpoint, the output of
+// command is copied to stdout and stderr. Returns the exit code
+func Exec(address string, agentID uint64, req operate.ExecRequest) (int, error) {
+	id, err := chooseAgent(address, agentID)
+	if err != nil {
+		return 0, err
+	}
+
+	code := 0
+	err = callStream(address, http.MethodPost, fmt.Sprintf("/agents/%d/exec", id), req, func(line json.RawMessage) error {
+		var v struct {
+			operate.ExecOutput
+			operate.ExecResult
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(line, &v); err != nil {
+			return err
+		}
+
+		switch {
+		case v.Error != "":
+			return errors.New(v.Error)
+		case v.Stream == "stdout":
+			os.Stdout.Write(v.Data)
+		case v.Stream == "stderr":
+			os.Stderr.Write(v.Data)
+		default:
+			code = v.ExitCode
+		}
+		return nil
+	})
+	return code, err
+}
+
+// Transfer runs `iox get` or `iox put` against the server's admin endpoint.
+// The local path is of server, so it's made absolute here
+func Transfer(address string, agentID uint64, op string, req operate.FileRequest) error {
+	id, err := chooseAgent(address, agentID)
+	if err != nil {
+		return err
+	}
+
+	if req.Local, err = filepath.Abs(req.Local); err != nil {
+		return err
+	}
+
+	progressed := false
+	err = callStream(address, http.MethodPost, fmt.Sprintf("/agents/%d/%s", id, op), req, func(line json.RawMessage) error {
+		// the last line is the result, or {"error": MSG}
+		var v struct {
+			operate.FileResult
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(line, &v); err != nil {
+			return err
+		}
+
+		switch {
+		case v.Error != "":
+			return errors.New(v.Error)
+		case v.SHA256 != "":
+			fmt.Printf("\nsha256 %s", v.SHA256)
+			if v.Resumed > 0 {
+				fmt.Printf(", resumed from %d bytes", v.Resumed)
+			}
+			fmt.Println()
+			return nil
+		}
+
+		var p operate.FileProgress
+		if err := json.Unmarshal(line, &p); err != nil {
+			return err
+		}
+		percent := 100.0
+		if p.Size > 0 {
+			percent = float64(p.Done) * 100 / float64(p.Size)
+		}
+		fmt.Printf("\r%s  %d/%d bytes  %.1f%%", req.Remote, p.Done, p.Size, percent)
+		progressed = true
+		return nil
+	})
+	if err != nil && progressed {
+		fmt.Println()
+	}
+	return err
+}
+
+// Route runs `iox route` against the server's admin endpoint
+func Route(address string, agentID uint64, req operate.RouteRequest) error {
+	id, err := chooseAgent(address, agentID)
+	if err != nil {
+		return err
+	}
+
+	err = call(address, http.MethodPost, fmt.Sprintf("/agents/%d/route", id), req, nil)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Socks5 on %s of server is routed to agent %d (encrypted: %v)\n", req.Listen, id, req.Encrypted)
+	return nil
+}
@@ -0,0 +1,189 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"iox/logger"
+	"iox/netio"
+	"iox/operate"
+	"iox/option"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errFileDir = errors.New("Local path must be inside the file dir of server, change it by `--file-dir` of server")
+
+// Jobs run by the agent, the request blocks until the result is back.
+// Route returns once the listener is up
+func handleJob(w http.ResponseWriter, r *http.Request, agent *netio.Agent, job string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch job {
+	case "ping":
+		var req operate.PingRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger.Debug("Admin ping %d targets by agent %d (%s)", len(req.Targets), agent.ID, agent.Addr)
+		results, err := operate.Ping(r.Context(), agent.ID, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, results)
+	case "scan":
+		var req operate.ScanRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger.Debug("Admin scan ports %s of %d targets by agent %d (%s)", req.Ports, len(req.Targets), agent.ID, agent.Addr)
+		stream := newLineStream(w)
+		summary, err := operate.Scan(r.Context(), agent.ID, req, func(result operate.ScanResult) error {
+			return stream.write(result)
+		})
+		stream.end(summary, err)
+	case "exec":
+		var req operate.ExecRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger.Info("Admin exec %q by agent %d (%s)", req.Command, agent.ID, agent.Addr)
+		stream := newLineStream(w)
+		result, err := operate.Exec(r.Context(), agent.ID, req, func(output operate.ExecOutput) error {
+			return stream.write(output)
+		})
+		stream.end(result, err)
+	case "get", "put":
+		var req operate.FileRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		local, err := confine(req.Local)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		req.Local = local
+
+		transfer := operate.Get
+		if job == "put" {
+			transfer = operate.Put
+		}
+
+		logger.Info("Admin %s remote %s local %s by agent %d (%s)", job, req.Remote, req.Local, agent.ID, agent.Addr)
+		stream := newLineStream(w)
+		result, err := transfer(r.Context(), agent.ID, req, func(progress operate.FileProgress) error {
+			return stream.write(progress)
+		})
+		stream.end(result, err)
+	case "route":
+		var req operate.RouteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger.Debug("Admin route socks5 on %s to agent %d (%s)", req.Listen, agent.ID, agent.Addr)
+		if err := operate.Route(agent.ID, req); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// confine resolves the local path of get and put, which must be inside
+// FILE_DIR once links are followed. The file of get may not exist yet
+func confine(local string) (string, error) {
+	dir := option.FILE_DIR
+	if dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		dir = wd
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return "", err
+	}
+
+	path, err := filepath.Abs(local)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) {
+		var parent string
+		if parent, err = filepath.EvalSymlinks(filepath.Dir(path)); err == nil {
+			resolved = filepath.Join(parent, filepath.Base(path))
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(dir, resolved)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errFileDir
+	}
+	return resolved, nil
+}
+
+// Stream JSON lines, each line is flushed at once. The status is sent with
+// the first line, so an error before it is still an HTTP error
+type lineStream struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func newLineStream(w http.ResponseWriter) *lineStream {
+	return &lineStream{w: w}
+}
+
+func (s *lineStream) write(v interface{}) error {
+	if !s.started {
+		s.started = true
+		s.w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+
+	if err := json.NewEncoder(s.w).Encode(v); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// The last line is the summary, or {"error": MSG}
+func (s *lineStream) end(summary interface{}, err error) {
+	if err == nil {
+		s.write(summary)
+		return
+	}
+
+	if !s.started {
+		http.Error(s.w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	s.write(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,61 @@
+package admin
+
+import (
+	"io/ioutil"
+	"iox/option"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfine(t *testing.T) {
+	root, err := ioutil.TempDir("", "iox-confine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// the temp dir itself may be a link, like /tmp on macOS
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(root, "files")
+	os.MkdirAll(filepath.Join(dir, "sub"), 0700)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), nil, 0600)
+	ioutil.WriteFile(filepath.Join(root, "secret"), nil, 0600)
+	os.Symlink(filepath.Join(root, "secret"), filepath.Join(dir, "link"))
+	os.Symlink(root, filepath.Join(dir, "up"))
+
+	fileDir := option.FILE_DIR
+	option.FILE_DIR = dir
+	defer func() { option.FILE_DIR = fileDir }()
+
+	tests := []struct {
+		local string
+		want  string
+	}{
+		{filepath.Join(dir, "a.txt"), filepath.Join(dir, "a.txt")},
+		{filepath.Join(dir, "sub", "new.bin"), filepath.Join(dir, "sub", "new.bin")},
+		{filepath.Join(dir, "sub", "..", "a.txt"), filepath.Join(dir, "a.txt")},
+		{filepath.Join(dir, "..", "secret"), ""},
+		{filepath.Join(root, "secret"), ""},
+		{filepath.Join(dir, "link"), ""},
+		{filepath.Join(dir, "up", "new.bin"), ""},
+		{filepath.Join(dir, "nodir", "new.bin"), ""},
+		{dir, ""},
+		{"/etc/passwd", ""},
+	}
+
+	for _, tt := range tests {
+		got, err := confine(tt.local)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s is confined to %s, want error", tt.local, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s is confined to %q, %v, want %s", tt.local, got, err, tt.want)
+		}
+	}
+}
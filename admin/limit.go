@@ -0,0 +1,87 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"iox/logger"
+	"iox/netio"
+	"net/http"
+	"strings"
+)
+
+// Bandwidth limits in byte per second, 0 is unlimited.
+// An omitted direction keeps the current limit
+type limitView struct {
+	Up   *int64 `json:"up"`
+	Down *int64 `json:"down"`
+}
+
+type limiter interface {
+	Limit() (up int64, down int64)
+	SetLimit(up int64, down int64)
+}
+
+type globalLimiter struct{}
+
+func (globalLimiter) Limit() (int64, int64) {
+	return netio.GlobalLimit()
+}
+
+func (globalLimiter) SetLimit(up int64, down int64) {
+	netio.SetGlobalLimit(up, down)
+}
+
+// serveLimit reads or changes the limits of l, name is for logging
+func serveLimit(w http.ResponseWriter, r *http.Request, l limiter, name string) {
+	up, down := l.Limit()
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var req limitView
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if (req.Up != nil && *req.Up < 0) || (req.Down != nil && *req.Down < 0) {
+			http.Error(w, "Limit can't be negative", http.StatusBadRequest)
+			return
+		}
+
+		if req.Up != nil {
+			up = *req.Up
+		}
+		if req.Down != nil {
+			down = *req.Down
+		}
+		l.SetLimit(up, down)
+		logger.Info("Admin limit %s to up %d B/s, down %d B/s", name, up, down)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, limitView{&up, &down})
+}
+
+func handleLimit(w http.ResponseWriter, r *http.Request) {
+	serveLimit(w, r, globalLimiter{}, "all tunnels")
+}
+
+// /tunnels/ID/limit
+func handleTunnelLimit(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/limit")
+	id, ok := parseID(path, "/tunnels/")
+	if !ok || path == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	for _, t := range netio.Tunnels() {
+		if t.ID == id {
+			serveLimit(w, r, t, fmt.Sprintf("tunnel %d (%s)", t.ID, t.Mode))
+			return
+		}
+	}
+	http.Error(w, "No such tunnel", http.StatusNotFound)
+}
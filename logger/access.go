@@ -0,0 +1,112 @@
+package logger
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"iox/option"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessRecord is one line of the access log, for a socks5 request or a fwd pipe
+type AccessRecord struct {
+	Start time.Time
+	// `socks`, `socks-udp` or `fwd`
+	Kind   string
+	Client string
+	// Target as requested by client, empty for fwd
+	Target string
+	// Address actually connected
+	Resolved  string
+	Result    string
+	Duration  time.Duration
+	BytesUp   int64
+	BytesDown int64
+}
+
+var (
+	accessMu   sync.Mutex
+	accessFile *os.File
+	accessCSV  *csv.Writer
+)
+
+var accessHeader = []string{
+	"time", "kind", "client", "target", "resolved", "result", "duration_ms", "bytes_up", "bytes_down",
+}
+
+type accessLine struct {
+	Time       string `json:"time"`
+	Kind       string `json:"kind"`
+	Client     string `json:"client"`
+	Target     string `json:"target,omitempty"`
+	Resolved   string `json:"resolved,omitempty"`
+	Result     string `json:"result"`
+	DurationMs int64  `json:"duration_ms"`
+	BytesUp    int64  `json:"bytes_up"`
+	BytesDown  int64  `json:"bytes_down"`
+}
+
+// InitAccess opens the access log if required, must be called after parsing cli
+func InitAccess() error {
+	if option.ACCESS_LOG == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(option.ACCESS_LOG, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	accessFile = f
+
+	if option.ACCESS_LOG_FORMAT == "csv" {
+		accessCSV = csv.NewWriter(f)
+
+		// new file, write the header first
+		if info, err := f.Stat(); err == nil && info.Size() == 0 {
+			accessCSV.Write(accessHeader)
+			accessCSV.Flush()
+		}
+	}
+
+	return nil
+}
+
+func Access(r AccessRecord) {
+	if accessFile == nil {
+		return
+	}
+
+	accessMu.Lock()
+	defer accessMu.Unlock()
+
+	if accessCSV != nil {
+		accessCSV.Write([]string{
+			r.Start.Format(time.RFC3339Nano),
+			r.Kind,
+			r.Client,
+			r.Target,
+			r.Resolved,
+			r.Result,
+			strconv.FormatInt(int64(r.Duration/time.Millisecond), 10),
+			strconv.FormatInt(r.BytesUp, 10),
+			strconv.FormatInt(r.BytesDown, 10),
+		})
+		accessCSV.Flush()
+		return
+	}
+
+	line, _ := json.Marshal(accessLine{
+		Time:       r.Start.Format(time.RFC3339Nano),
+		Kind:       r.Kind,
+		Client:     r.Client,
+		Target:     r.Target,
+		Resolved:   r.Resolved,
+		Result:     r.Result,
+		DurationMs: int64(r.Duration / time.Millisecond),
+		BytesUp:    r.BytesUp,
+		BytesDown:  r.BytesDown,
+	})
+	accessFile.Write(append(line, '\n'))
+}
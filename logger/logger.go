@@ -1,27 +1,121 @@
 package logger
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"iox/option"
 	"os"
+	"sync"
+	"time"
 )
 
 const (
-	pWARN    = "[!] "
-	pINFO    = "[+] "
-	pSUCCESS = "[*] "
+	pDEBUG = "[+] "
+	pINFO  = "[*] "
+	pWARN  = "[!] "
+	pERROR = "[x] "
 )
 
-func Info(format string, args ...interface{}) {
-	if option.VERBOSE {
-		fmt.Fprintf(os.Stdout, pINFO+format+"\n", args...)
+var (
+	mu sync.Mutex
+
+	// log file, nil means stdout/stderr
+	file io.Writer
+
+	prefixes   = []string{pDEBUG, pINFO, pWARN, pERROR}
+	levelNames = []string{"debug", "info", "warn", "error"}
+)
+
+// Init opens the log file if required, must be called after parsing cli
+func Init() error {
+	if option.LOG_FILE == "" {
+		return nil
+	}
+
+	w, err := newRotateWriter(option.LOG_FILE, int64(option.LOG_MAX_SIZE)<<20, option.LOG_MAX_BACKUPS)
+	if err != nil {
+		return err
+	}
+	file = w
+	return nil
+}
+
+type jsonLine struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Conn  uint64 `json:"conn,omitempty"`
+	Msg   string `json:"msg"`
+}
+
+// conn is 0 if the line doesn't belong to a connection
+func output(level int, conn uint64, format string, args ...interface{}) {
+	if level < option.LOG_LEVEL {
+		return
+	}
+
+	now := time.Now()
+	msg := fmt.Sprintf(format, args...)
+
+	var line []byte
+	if option.LOG_JSON {
+		line, _ = json.Marshal(jsonLine{
+			Time:  now.Format(time.RFC3339Nano),
+			Level: levelNames[level],
+			Conn:  conn,
+			Msg:   msg,
+		})
+		line = append(line, '\n')
+	} else {
+		if conn != 0 {
+			msg = fmt.Sprintf("#%d %s", conn, msg)
+		}
+		line = []byte(prefixes[level] + msg + "\n")
+		if file != nil {
+			line = append([]byte(now.Format("2006-01-02 15:04:05.000 ")), line...)
+		}
 	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	switch {
+	case file != nil:
+		file.Write(line)
+	case level >= option.LEVEL_WARN:
+		os.Stderr.Write(line)
+	default:
+		os.Stdout.Write(line)
+	}
+}
+
+func Debug(format string, args ...interface{}) {
+	output(option.LEVEL_DEBUG, 0, format, args...)
+}
+
+func Info(format string, args ...interface{}) {
+	output(option.LEVEL_INFO, 0, format, args...)
 }
 
 func Warn(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, pWARN+format+"\n", args...)
+	output(option.LEVEL_WARN, 0, format, args...)
+}
+
+func Error(format string, args ...interface{}) {
+	output(option.LEVEL_ERROR, 0, format, args...)
+}
+
+// Conn logs with a connection ID, so that lines of one connection can be correlated
+type Conn uint64
+
+func (c Conn) Debug(format string, args ...interface{}) {
+	output(option.LEVEL_DEBUG, uint64(c), format, args...)
+}
+
+func (c Conn) Info(format string, args ...interface{}) {
+	output(option.LEVEL_INFO, uint64(c), format, args...)
 }
 
-func Success(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stdout, pSUCCESS+format+"\n", args...)
+func (c Conn) Warn(format string, args ...interface{}) {
+	output(option.LEVEL_WARN, uint64(c), format, args...)
 }
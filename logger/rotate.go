@@ -0,0 +1,75 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+)
+
+// File writer which moves PATH to PATH.1 (PATH.1 to PATH.2 ...) once
+// the size exceeds max, keeping at most `backups` old files
+type rotateWriter struct {
+	path    string
+	max     int64
+	backups int
+
+	f    *os.File
+	size int64
+}
+
+func newRotateWriter(path string, max int64, backups int) (*rotateWriter, error) {
+	w := &rotateWriter{
+		path:    path,
+		max:     max,
+		backups: backups,
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotateWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.f = f
+	w.size = info.Size()
+	return nil
+}
+
+func (w *rotateWriter) rotate() error {
+	w.f.Close()
+
+	for i := w.backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+	if w.backups > 0 {
+		os.Rename(w.path, w.path+".1")
+	} else {
+		os.Remove(w.path)
+	}
+
+	return w.open()
+}
+
+// Callers hold the logger lock
+func (w *rotateWriter) Write(b []byte) (int, error) {
+	if w.max > 0 && w.size+int64(len(b)) > w.max && w.size > 0 {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.f.Write(b)
+	w.size += int64(n)
+	return n, err
+}
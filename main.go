@@ -2,9 +2,14 @@ package main
 
 import (
 	"fmt"
+	"iox/admin"
+	"iox/logger"
+	"iox/netio"
 	"iox/operate"
 	"iox/option"
+	"iox/policy"
 	"os"
+	"strings"
 )
 
 const VERSION = "0.4"
@@ -13,7 +18,13 @@ func Usage() {
 	fmt.Printf(
 		"iox v%v\n"+
 			"    Access intranet easily (https://github.com/eddieivan01/iox)\n\n"+
-			"Usage: iox fwd/proxy [-l [*][HOST:]PORT] [-r [*]HOST:PORT] [-k HEX] [-t TIMEOUT] [-u] [-h] [-v]\n\n"+
+			"Usage: iox fwd/proxy/dns/redir [-l [*][HOST:]PORT] [-r [*]HOST:PORT] [-k HEX] [-t TIMEOUT] [-d DRAIN] [-a ADMIN] [--admin-token FILE] [-m METRICS] [-p POLICY] [--allow ACL] [--dns*] [--hosts HOSTS] [--tproxy] [--tun NAME] [--smux-*] [--limit*] [--max-conn*] [--idle-timeout SEC] [--lifetime SEC] [--half-close-timeout SEC] [--keepalive SEC] [--bind] [--relay [*][HOST:]PORT] [--allow-exec] [--allow-file] [--file-dir DIR] [-u] [-h] [-v] [-q] [--log-*] [--access-log*]\n"+
+			"       iox ping -a ADMIN [--agent ID] [-c COUNT] [-t TIMEOUT] TARGET...\n"+
+			"       iox scan -a ADMIN [--agent ID] --ports PORTS [--concurrency N] [-t TIMEOUT] TARGET...\n"+
+			"       iox exec -a ADMIN [AGENT] -- CMD [ARGS...]\n"+
+			"       iox get -a ADMIN [--agent ID] REMOTE [LOCAL]\n"+
+			"       iox put -a ADMIN [--agent ID] LOCAL REMOTE\n"+
+			"       iox route -a ADMIN [--agent ID] -l [*][HOST:]PORT\n\n"+
 			"Options:\n"+
 			"  -l [*][HOST:]PORT\n"+
 			"      address to listen on. `*` means encrypted socket\n"+
@@ -25,13 +36,137 @@ func Usage() {
 			"      udp forward mode\n"+
 			"  -t TIMEOUT\n"+
 			"      set connection timeout(millisecond), default is 5000\n"+
+			"  -d DRAIN\n"+
+			"      on SIGINT/SIGTERM, wait for running pipes up to DRAIN(millisecond)\n"+
+			"      before exit, default is 10000. Signal again to exit immediately\n"+
+			"  -a [unix:PATH|[HOST:]PORT]\n"+
+			"      serve admin endpoint on loopback or unix socket, to list and kill connections\n"+
+			"      subcommands send requests to it\n"+
+			"  --admin-token FILE\n"+
+			"      the admin token which requests changing anything must carry, written by server\n"+
+			"      default is PATH.token of unix socket, or admin-PORT.token in the user config dir\n"+
+			"  -m [HOST:]PORT\n"+
+			"      serve prometheus metrics on http://HOST:PORT/metrics, default HOST is 127.0.0.1\n"+
+			"  -p POLICY\n"+
+			"      destination allow/deny rule file for socks5 targets and fwd remotes\n"+
+			"  --allow [LISTEN=]CIDR[,CIDR]\n"+
+			"      only accept clients from the CIDRs, on LISTEN(PORT or HOST:PORT) instead of the global list, or all listeners\n"+
+			"  --dns [udp://|tcp://|tls://]IP[:PORT][#SERVERNAME]\n"+
+			"      resolve socks5 domain targets with the DNS server, also upstream of dns agent\n"+
+			"  --dns-insecure\n"+
+			"      don't verify the certificate of DNS-over-TLS server\n"+
+			"  --dns-prefer ipv4/ipv6\n"+
+			"      connect addresses of the family first\n"+
+			"  --dns-cache TTL\n"+
+			"      cache addresses resolved by --dns for TTL(second) at most, 0 disables, default is 60\n"+
+			"  --hosts HOSTS\n"+
+			"      static name overrides in hosts file format\n"+
+			"  --tproxy\n"+
+			"      redir mode takes connections routed by iptables TPROXY instead of REDIRECT\n"+
+			"  --tun NAME\n"+
+			"      relay TCP/UDP flows routed to the TUN device through reverse socks5 agent\n"+
+			"  --smux-version 1/2, --smux-keepalive SEC, --smux-keepalive-timeout SEC\n"+
+			"      smux of the reverse session, checked against peer's in handshake, default is 2, 20 and 60\n"+
+			"  --smux-frame BYTES, --smux-buffer BYTES, --smux-stream-buffer BYTES\n"+
+			"      smux frame size, session and stream receive buffer of this side, default is 32KB, 4MB and 64KB\n"+
+			"  --limit UP[/DOWN], --limit-tunnel UP[/DOWN], --limit-conn UP[/DOWN]\n"+
+			"      bandwidth of all tunnels, each tunnel and each connection, byte per second like 512K or 1M/256K\n"+
+			"  --idle-timeout SEC, --lifetime SEC\n"+
+			"      close connections idle either way for SEC, or open for SEC, 0 disables, default is 0\n"+
+			"  --half-close-timeout SEC\n"+
+			"      close connections SEC after one side shut down its writing, 0 disables, default is 60\n"+
+			"  --keepalive SEC\n"+
+			"      TCP keepalive period, 0 disables, default is 15\n"+
+			"  --max-conn N, --max-conn-ip N, --max-conn-refuse\n"+
+			"      connections of each listener and each client IP at the same time, a full listener queues new ones unless refusing\n"+
+			"  --bind\n"+
+			"      reverse socks5 agent listens on `-l` for server, which connects it by `proxy -r AGENT -l SOCKS5`\n"+
+			"  --relay [*][HOST:]PORT\n"+
+			"      reverse socks5 agent takes downstream agents on the address and relays them to server\n"+
+			"  --agent ID\n"+
+			"      agent of the subcommand, can be omitted if only one is connected\n"+
+			"  -c COUNT\n"+
+			"      ping sends COUNT echo requests to each target at most, default is 1\n"+
+			"  --ports PORTS\n"+
+			"      ports to scan, like 22,80,8000-8100\n"+
+			"  --concurrency N\n"+
+			"      scan N ports at the same time at most, default is 256\n"+
+			"  TARGET\n"+
+			"      IP, CIDR or domain to ping or scan from the agent, timeout is `-t`\n"+
+			"  --allow-exec\n"+
+			"      reverse socks5 agent runs the commands of `iox exec`, both sides need the key `-k`\n"+
+			"  --allow-file\n"+
+			"      reverse socks5 agent serves `iox get/put`, both sides need the key `-k`\n"+
+			"  --file-dir DIR\n"+
+			"      server side files of `iox get/put` must be inside DIR, default is the working directory of server\n"+
 			"  -v\n"+
-			"      enable log output\n"+
+			"      enable debug log output\n"+
+			"  -q\n"+
+			"      quiet, only output errors\n"+
+			"  --log-level debug/info/warn/error\n"+
+			"      drop log lines below the level, default is info\n"+
+			"  --log-json\n"+
+			"      output log lines in JSON format\n"+
+			"  --log-file PATH\n"+
+			"      write log to file instead of stdout/stderr\n"+
+			"  --log-size MB\n"+
+			"      rotate log file when exceeding, keep 3 old files, default is 10\n"+
+			"  --access-log PATH\n"+
+			"      record each socks5 request and fwd pipe to file\n"+
+			"  --access-log-format json/csv\n"+
+			"      access log format, default is json\n"+
 			"  -h\n"+
 			"      print usage then exit\n", VERSION,
 	)
 }
 
+// Subcommands talk to the admin endpoint of a running server
+func subcommand(mode string, local []string, lenc []bool) error {
+	switch mode {
+	case "ping":
+		return admin.Ping(option.ADMIN, option.AGENT, operate.PingRequest{
+			Targets: option.ARGS,
+			Count:   option.PING_COUNT,
+			Timeout: option.TIMEOUT,
+		})
+	case "scan":
+		return admin.Scan(option.ADMIN, option.AGENT, operate.ScanRequest{
+			Targets:     option.ARGS,
+			Ports:       option.SCAN_PORTS,
+			Concurrency: option.SCAN_CONCURRENCY,
+			Timeout:     option.TIMEOUT,
+		})
+	case "exec":
+		code, err := admin.Exec(option.ADMIN, option.AGENT, operate.ExecRequest{
+			Command: option.EXEC_COMMAND,
+		})
+		if err == nil && code != 0 {
+			os.Exit(code)
+		}
+		return err
+	case "get":
+		req := operate.FileRequest{Remote: option.ARGS[0]}
+		if len(option.ARGS) == 2 {
+			req.Local = option.ARGS[1]
+		} else {
+			// the remote path may be of Windows
+			req.Local = req.Remote[strings.LastIndexAny(req.Remote, `/\`)+1:]
+		}
+		return admin.Transfer(option.ADMIN, option.AGENT, "get", req)
+	case "put":
+		return admin.Transfer(option.ADMIN, option.AGENT, "put", operate.FileRequest{
+			Local:  option.ARGS[0],
+			Remote: option.ARGS[1],
+		})
+	case "route":
+		return admin.Route(option.ADMIN, option.AGENT, operate.RouteRequest{
+			Listen:    local[0],
+			Encrypted: lenc[0],
+		})
+	}
+	return nil
+}
+
 func main() {
 	mode, submode, local, remote, lenc, renc, err := option.ParseCli(os.Args[1:])
 	if err != nil {
@@ -43,6 +178,48 @@ func main() {
 		return
 	}
 
+	if err = logger.Init(); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	switch mode {
+	case "ping", "scan", "exec", "get", "put", "route":
+		if err = subcommand(mode, local, lenc); err != nil {
+			fmt.Println(err.Error())
+		}
+		return
+	}
+
+	if err = logger.InitAccess(); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	if err = netio.InitResolver(); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	netio.SetGlobalLimit(option.LIMIT_UP, option.LIMIT_DOWN)
+
+	if option.POLICY_FILE != "" {
+		if err = policy.Load(option.POLICY_FILE); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+	}
+
+	operate.HandleSignals()
+
+	if option.ADMIN != "" {
+		go admin.Serve(option.ADMIN)
+	}
+
+	if option.METRICS != "" {
+		go operate.ServeMetrics(option.METRICS)
+	}
+
 	switch mode {
 	case "fwd":
 		switch submode {
@@ -61,6 +238,23 @@ func main() {
 			operate.ProxyRemote(remote[0], renc[0])
 		case option.SUBMODE_RPL2L:
 			operate.ProxyRemoteL2L(local[0], local[1], lenc[0], lenc[1])
+		case option.SUBMODE_BP:
+			operate.ProxyBind(local[0], lenc[0])
+		case option.SUBMODE_BPL2R:
+			operate.ProxyBindL2R(local[0], remote[0], lenc[0], renc[0])
+		}
+	case "dns":
+		switch submode {
+		case option.SUBMODE_LD:
+			operate.DNSLocal(local[0], remote[0])
+		case option.SUBMODE_RD:
+			operate.DNSRemote(remote[0], renc[0])
+		case option.SUBMODE_RDL2L:
+			operate.DNSRemoteL2L(local[0], local[1], lenc[0])
 		}
+	case "redir":
+		operate.Redir(local[0], remote[0], renc[0])
 	}
+
+	operate.Wait()
 }
@@ -0,0 +1,225 @@
+// Minimal prometheus text format exporter, so we don't need the client lib
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"iox/logger"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type collector interface {
+	write(w io.Writer)
+}
+
+var (
+	mu         sync.Mutex
+	collectors []collector
+)
+
+func register(c collector) {
+	mu.Lock()
+	collectors = append(collectors, c)
+	mu.Unlock()
+}
+
+func writeHeader(w io.Writer, name string, help string, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = names[i] + "=" + strconv.Quote(values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter with optional labels, the label values are given on each Add
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+
+	sync.Mutex
+	values map[string]float64
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+	if len(labels) == 0 {
+		c.values[""] = 0
+	}
+	register(c)
+	return c
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.Lock()
+	c.values[key] += v
+	c.Unlock()
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+
+	c.Lock()
+	defer c.Unlock()
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, k, formatValue(c.values[k]))
+	}
+}
+
+// Sample is one labeled value reported by a collect function
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+type funcCollector struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	fn     func() []Sample
+}
+
+func (c *funcCollector) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, c.typ)
+	for _, s := range c.fn() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.LabelValues), formatValue(s.Value))
+	}
+}
+
+// The value is read by fn at scrape time
+func NewGaugeFunc(name string, help string, fn func() float64) {
+	register(&funcCollector{
+		name: name,
+		help: help,
+		typ:  "gauge",
+		fn: func() []Sample {
+			return []Sample{{Value: fn()}}
+		},
+	})
+}
+
+// Labeled values are read by fn at scrape time, typ is `counter` or `gauge`
+func NewCollectFunc(name string, help string, typ string, labels []string, fn func() []Sample) {
+	register(&funcCollector{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		fn:     fn,
+	})
+}
+
+// Histogram without labels
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.Lock()
+	defer h.Unlock()
+
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+
+	h.Lock()
+	defer h.Unlock()
+
+	for i, le := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatValue(le), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+func WriteAll(w io.Writer) {
+	mu.Lock()
+	cs := collectors
+	mu.Unlock()
+
+	for _, c := range cs {
+		c.write(w)
+	}
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WriteAll(w)
+}
+
+// Serve exposes /metrics on the listener until it's closed
+func Serve(listener net.Listener) error {
+	defer listener.Close()
+
+	logger.Info("Metrics endpoint is listening on %s/metrics", listener.Addr().String())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", Handler)
+	return http.Serve(listener, mux)
+}
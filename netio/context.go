@@ -1,6 +1,7 @@
 package netio
 
 import (
+	"errors"
 	"iox/crypto"
 	"iox/option"
 	"net"
@@ -10,15 +11,29 @@ type Ctx interface {
 	DecryptRead(b []byte) (int, error)
 	EncryptWrite(b []byte) (int, error)
 
+	// Whether the traffic on the wire is encrypted
+	Encrypted() bool
+
 	net.Conn
 }
 
+var (
+	errNoNonce      = errors.New("Encrypted packet without nonce")
+	errNoCloseWrite = errors.New("Connection doesn't support half-close")
+)
+
+// Half-close of TCP and TLS connections, and the socks5 stream pair
+type closeWriter interface {
+	CloseWrite() error
+}
+
 var _ Ctx = &TCPCtx{}
 var _ Ctx = &UDPCtx{}
 
 type TCPCtx struct {
 	net.Conn
 	encrypted bool
+	secure    bool
 
 	// Ensure stream cipher synchronous
 	encCipher *crypto.Cipher
@@ -30,14 +45,13 @@ func NewTCPCtx(conn net.Conn, encrypted bool) (*TCPCtx, error) {
 	//     tc.SetLinger(0)
 	// }
 
-	encrypted = encrypted && !option.FORWARD_WITHOUT_DEC
-
 	ctx := &TCPCtx{
 		Conn:      conn,
-		encrypted: encrypted,
+		encrypted: encrypted && !option.FORWARD_WITHOUT_DEC,
+		secure:    encrypted,
 	}
 
-	if encrypted {
+	if ctx.encrypted {
 		encCipher, decCipher, err := crypto.NewCipherPair()
 		if err != nil {
 			return nil, err
@@ -50,6 +64,23 @@ func NewTCPCtx(conn net.Conn, encrypted bool) (*TCPCtx, error) {
 	return ctx, nil
 }
 
+// NewEndpointTCPCtx encrypts even if FORWARD_WITHOUT_DEC, for the connection
+// whose data is produced and consumed by iox itself rather than forwarded
+func NewEndpointTCPCtx(conn net.Conn, encrypted bool) (*TCPCtx, error) {
+	ctx, err := NewTCPCtx(conn, false)
+	if err != nil || !encrypted {
+		return ctx, err
+	}
+
+	ctx.encrypted = true
+	ctx.secure = true
+	ctx.encCipher, ctx.decCipher, err = crypto.NewCipherPair()
+	if err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
 func (c *TCPCtx) DecryptRead(b []byte) (int, error) {
 	n, err := c.Read(b)
 	if err != nil {
@@ -70,21 +101,36 @@ func (c *TCPCtx) EncryptWrite(b []byte) (int, error) {
 	return c.Write(b)
 }
 
+func (c *TCPCtx) Encrypted() bool {
+	return c.secure
+}
+
+// CloseWrite shuts down the writing side, peer reads EOF and can still write
+func (c *TCPCtx) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errNoCloseWrite
+}
+
 type UDPCtx struct {
 	*net.UDPConn
 	encrypted  bool
+	secure     bool
 	connected  bool
 	remoteAddr *net.UDPAddr
 
+	// sources allowed of the unconnected one, nil allows all
+	permit func(*net.UDPAddr) bool
+
 	// sync.Mutex
 }
 
 func NewUDPCtx(conn *net.UDPConn, encrypted bool, connected bool) (*UDPCtx, error) {
-	encrypted = encrypted && !option.FORWARD_WITHOUT_DEC
-
 	ctx := &UDPCtx{
 		UDPConn:   conn,
-		encrypted: encrypted,
+		encrypted: encrypted && !option.FORWARD_WITHOUT_DEC,
+		secure:    encrypted,
 		connected: connected,
 	}
 
@@ -98,9 +144,14 @@ func (c *UDPCtx) DecryptRead(b []byte) (int, error) {
 
 	if !c.connected {
 		var remoteAddr *net.UDPAddr
-		n, remoteAddr, err = c.ReadFromUDP(b)
-		if err != nil {
-			return n, err
+		for {
+			n, remoteAddr, err = c.ReadFromUDP(b)
+			if err != nil {
+				return n, err
+			}
+			if c.permit == nil || c.permit(remoteAddr) {
+				break
+			}
 		}
 		c.remoteAddr = remoteAddr
 
@@ -112,9 +163,9 @@ func (c *UDPCtx) DecryptRead(b []byte) (int, error) {
 	}
 
 	if c.encrypted {
-		if len(b) < 0x18 {
+		if n < 0x18 {
 			// no nonce, skip
-			return 0, nil
+			return 0, errNoNonce
 		}
 		nonce := b[n-0x18 : n]
 		b = b[:n-0x18]
@@ -149,6 +200,16 @@ func (c *UDPCtx) EncryptWrite(b []byte) (int, error) {
 	return c.Write(b)
 }
 
+// SetPermit drops the packets from sources not permitted, so replies never
+// go to them. Must be set before reading
+func (c *UDPCtx) SetPermit(permit func(*net.UDPAddr) bool) {
+	c.permit = permit
+}
+
+func (c *UDPCtx) Encrypted() bool {
+	return c.secure
+}
+
 /*
 func (c UDPCtx) IsRemoteAddrRegistered() bool {
 	return c.remoteAddr != nil
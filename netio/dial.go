@@ -0,0 +1,34 @@
+package netio
+
+import (
+	"iox/option"
+	"net"
+	"time"
+)
+
+// KeepAlive is the period for net.Dialer and net.ListenConfig,
+// which take negative as disabled
+func KeepAlive() time.Duration {
+	if option.TCP_KEEPALIVE <= 0 {
+		return -1
+	}
+	return time.Duration(option.TCP_KEEPALIVE) * time.Second
+}
+
+// DialTCP connects to the address within option.TIMEOUT
+func DialTCP(address string) (net.Conn, error) {
+	start := time.Now()
+
+	dialer := net.Dialer{
+		Timeout:   time.Millisecond * time.Duration(option.TIMEOUT),
+		KeepAlive: KeepAlive(),
+	}
+	conn, err := dialer.Dial("tcp", address)
+	if err != nil {
+		dialFailures.Inc()
+		return nil, err
+	}
+
+	dialDuration.Observe(time.Since(start).Seconds())
+	return conn, nil
+}
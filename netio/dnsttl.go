@@ -0,0 +1,150 @@
+package netio
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// TTLs of the records a lookup got. net.Resolver doesn't return them, so the
+// DNS messages read by its connections are parsed here. The lookup context is
+// passed to Dial of the resolver, which carries the collector of the lookup
+type ttlCollector struct {
+	mu  sync.Mutex
+	ttl uint32
+	ok  bool
+}
+
+type ttlKey struct{}
+
+func (c *ttlCollector) add(msg []byte) {
+	ttl, ok := minAnswerTTL(msg)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	if !c.ok || ttl < c.ttl {
+		c.ttl = ttl
+		c.ok = true
+	}
+	c.mu.Unlock()
+}
+
+// the least TTL of the answers, false if no answer was read
+func (c *ttlCollector) get() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Second * time.Duration(c.ttl), c.ok
+}
+
+// withTTL wraps the resolver connection to collect TTLs for the lookup of ctx.
+// The Go resolver frames messages by whether it's a PacketConn, so UDP
+// connections must stay one
+func withTTL(ctx context.Context, conn net.Conn) net.Conn {
+	collector, _ := ctx.Value(ttlKey{}).(*ttlCollector)
+	if collector == nil {
+		return conn
+	}
+
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		return &ttlPacketConn{UDPConn: udpConn, collector: collector}
+	}
+	return &ttlStreamConn{Conn: conn, collector: collector}
+}
+
+// Each read is a message
+type ttlPacketConn struct {
+	*net.UDPConn
+	collector *ttlCollector
+}
+
+func (c *ttlPacketConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if err == nil {
+		c.collector.add(b[:n])
+	}
+	return n, err
+}
+
+// Messages are prefixed by 2 bytes length, and read in pieces
+type ttlStreamConn struct {
+	net.Conn
+	collector *ttlCollector
+	buf       []byte
+}
+
+func (c *ttlStreamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.buf = append(c.buf, b[:n]...)
+
+	for len(c.buf) >= 2 {
+		size := 2 + int(binary.BigEndian.Uint16(c.buf))
+		if len(c.buf) < size {
+			break
+		}
+		c.collector.add(c.buf[2:size])
+		c.buf = c.buf[size:]
+	}
+	return n, err
+}
+
+// end of the name at off, -1 if malformed. A compression pointer ends it
+func skipName(msg []byte, off int) int {
+	for off < len(msg) {
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1
+		case l&0xC0 == 0xC0:
+			if off+2 > len(msg) {
+				return -1
+			}
+			return off + 2
+		default:
+			off += 1 + l
+		}
+	}
+	return -1
+}
+
+// minAnswerTTL returns the least TTL of the answer section, including the
+// CNAMEs leading to the addresses. False if there is no answer
+func minAnswerTTL(msg []byte) (uint32, bool) {
+	if len(msg) < 12 {
+		return 0, false
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		if off = skipName(msg, off); off < 0 {
+			return 0, false
+		}
+		// QTYPE and QCLASS
+		off += 4
+	}
+
+	var ttl uint32
+	found := false
+	for i := 0; i < ancount; i++ {
+		if off = skipName(msg, off); off < 0 || off+10 > len(msg) {
+			break
+		}
+		// TYPE, CLASS, TTL, RDLENGTH
+		t := binary.BigEndian.Uint32(msg[off+4:])
+		off += 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+		if off > len(msg) {
+			break
+		}
+
+		if !found || t < ttl {
+			ttl = t
+			found = true
+		}
+	}
+	return ttl, found
+}
@@ -2,11 +2,38 @@ package netio
 
 import (
 	"io"
-	"iox/logger"
 	"iox/option"
+	"sync/atomic"
+	"time"
 )
 
+var activePipes int64
+
+// ActivePipes returns the number of PipeForward calls still running
+func ActivePipes() int64 {
+	return atomic.LoadInt64(&activePipes)
+}
+
+// WaitPipes blocks until every running pipe has finished or the timeout expired.
+// It reports whether all pipes finished in time
+func WaitPipes(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for ActivePipes() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
 func CipherCopy(dst Ctx, src Ctx) (int64, error) {
+	return cipherCopy(dst, src, nil)
+}
+
+// transfer is called after each successful write if not nil,
+// it counts the bytes and waits for the bandwidth limits
+func cipherCopy(dst Ctx, src Ctx, transfer func(int)) (int64, error) {
 	buffer := make([]byte, option.TCP_BUFFER_SIZE)
 	var written int64
 	var err error
@@ -24,8 +51,10 @@ func CipherCopy(dst Ctx, src Ctx) (int64, error) {
 			nw, ew = dst.EncryptWrite(buffer[:nr])
 
 			if nw > 0 {
-				logger.Info("<== [%d bytes] ==> ", nw)
 				written += int64(nw)
+				if transfer != nil {
+					transfer(nw)
+				}
 			}
 			if ew != nil {
 				err = ew
@@ -48,29 +77,130 @@ func CipherCopy(dst Ctx, src Ctx) (int64, error) {
 }
 
 func PipeForward(ctxA Ctx, ctxB Ctx) {
-	signal := make(chan struct{}, 1)
+	NewPipe(nil, ctxA, ctxB).Forward()
+}
+
+// Why a pipe is closed
+const (
+	reasonClient      = "client closed"
+	reasonDestination = "destination closed"
+	reasonIdle        = "idle timeout"
+	reasonLifetime    = "lifetime reached"
+	reasonHalfClose   = "half-close timeout"
+	reasonKilled      = "killed"
+)
+
+// Result in access log of the reasons other than closed by either side
+var closeResults = map[string]string{
+	reasonIdle:      "idle_timeout",
+	reasonLifetime:  "lifetime",
+	reasonHalfClose: "half_close_timeout",
+	reasonKilled:    "killed",
+}
+
+type copyResult struct {
+	reason string
+	// the writing side of the other end is shut down, keep the opposite way
+	halfClosed bool
+}
+
+// pipeForward returns the reason why the pipe is closed. It ends once both
+// directions end, or either one can't be half-closed, or the pipe is idle,
+// half-closed or lives too long
+func pipeForward(p *Pipe) string {
+	atomic.AddInt64(&activePipes, 1)
+	defer atomic.AddInt64(&activePipes, -1)
+
+	signal := make(chan copyResult, 2)
 
 	go func() {
-		CipherCopy(ctxA, ctxB)
-		signal <- struct{}{}
+		_, err := cipherCopy(p.ctxA, p.ctxB, p.transferDown)
+		signal <- endCopy(p.ctxA, reasonDestination, err)
 	}()
 
 	go func() {
-		CipherCopy(ctxB, ctxA)
-		signal <- struct{}{}
+		_, err := cipherCopy(p.ctxB, p.ctxA, p.transferUp)
+		signal <- endCopy(p.ctxB, reasonClient, err)
 	}()
 
-	<-signal
+	// the first one closed is the reason
+	reason := ""
+
+	var idle, lifetime, halfClose <-chan time.Time
+	var idleTimer *time.Timer
+	idleTimeout := time.Duration(option.PIPE_IDLE_TIMEOUT) * time.Second
+	if idleTimeout > 0 {
+		idleTimer = time.NewTimer(idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	if option.PIPE_LIFETIME > 0 {
+		lifetimeTimer := time.NewTimer(time.Duration(option.PIPE_LIFETIME) * time.Second)
+		defer lifetimeTimer.Stop()
+		lifetime = lifetimeTimer.C
+	}
+
+	for {
+		select {
+		case result := <-signal:
+			if p.isKilled() {
+				return reasonKilled
+			}
+			if reason == "" {
+				reason = result.reason
+				if result.halfClosed {
+					if option.HALF_CLOSE_TIMEOUT > 0 {
+						halfCloseTimer := time.NewTimer(time.Duration(option.HALF_CLOSE_TIMEOUT) * time.Second)
+						defer halfCloseTimer.Stop()
+						halfClose = halfCloseTimer.C
+					}
+					continue
+				}
+			}
+			return reason
+		case <-idle:
+			// the timer is reset to the time left since the last transfer
+			if left := idleTimeout - p.idle(); left > 0 {
+				idleTimer.Reset(left)
+				continue
+			}
+			p.close()
+			return reasonIdle
+		case <-lifetime:
+			p.close()
+			return reasonLifetime
+		case <-halfClose:
+			p.close()
+			return reasonHalfClose
+		}
+	}
+}
+
+// endCopy half-closes dst once src reaches EOF
+func endCopy(dst Ctx, closed string, err error) copyResult {
+	if err != nil {
+		return copyResult{reason: "error: " + err.Error()}
+	}
+
+	cw, ok := dst.(closeWriter)
+	return copyResult{
+		reason:     closed,
+		halfClosed: ok && cw.CloseWrite() == nil,
+	}
 }
 
 // This function will run forever
 // If need to do performance optimization in future, I will consider a go-routine pool here,
-// but it will introduce the mutex-lock overhead
-func ForwardUDP(ctxA Ctx, ctxB Ctx) {
+// but it will introduce the mutex-lock overhead.
+// The tunnel may be nil, its limits apply otherwise
+func ForwardUDP(tunnel *Tunnel, ctxA Ctx, ctxB Ctx) {
 	go func() {
 		buffer := make([]byte, option.UDP_PACKET_MAX_SIZE)
 		for {
-			nr, _ := ctxA.DecryptRead(buffer)
+			nr, err := ctxA.DecryptRead(buffer)
+			if err == errNoNonce {
+				udpDropped.Inc()
+			}
 			if nr > 0 {
 				if nr == 4 &&
 					buffer[0] == 0xCC && buffer[1] == 0xDD &&
@@ -78,10 +208,12 @@ func ForwardUDP(ctxA Ctx, ctxB Ctx) {
 					continue
 				}
 
-				nw, _ := ctxB.EncryptWrite(buffer[:nr])
-				if nw > 0 {
-					logger.Info("<== [%d bytes] ==>", nw)
+				_, err := ctxB.EncryptWrite(buffer[:nr])
+				if err != nil {
+					udpDropped.Inc()
+					continue
 				}
+				tunnel.limitPacket(true, nr)
 			}
 		}
 	}()
@@ -89,7 +221,10 @@ func ForwardUDP(ctxA Ctx, ctxB Ctx) {
 	go func() {
 		buffer := make([]byte, option.UDP_PACKET_MAX_SIZE)
 		for {
-			nr, _ := ctxB.DecryptRead(buffer)
+			nr, err := ctxB.DecryptRead(buffer)
+			if err == errNoNonce {
+				udpDropped.Inc()
+			}
 			if nr > 0 {
 				if nr == 4 &&
 					buffer[0] == 0xCC && buffer[1] == 0xDD &&
@@ -97,10 +232,12 @@ func ForwardUDP(ctxA Ctx, ctxB Ctx) {
 					continue
 				}
 
-				nw, _ := ctxA.EncryptWrite(buffer[:nr])
-				if nw > 0 {
-					logger.Info("<== [%d bytes] ==>", nw)
+				_, err := ctxA.EncryptWrite(buffer[:nr])
+				if err != nil {
+					udpDropped.Inc()
+					continue
 				}
+				tunnel.limitPacket(false, nr)
 			}
 		}
 	}()
@@ -114,7 +251,7 @@ var UDP_INIT_PACKET = []byte{
 
 // Each socket only writes the packet to the address which last sent packet to it recently,
 // instead of broadcasting to all the address
-func ForwardUnconnectedUDP(ctxA Ctx, ctxB Ctx) {
+func ForwardUnconnectedUDP(tunnel *Tunnel, ctxA Ctx, ctxB Ctx) {
 	addrRegistedA := false
 	addrRegistedB := false
 	addrRegistedSignalA := make(chan struct{})
@@ -127,7 +264,10 @@ func ForwardUnconnectedUDP(ctxA Ctx, ctxB Ctx) {
 	go func() {
 		for {
 			buffer := make([]byte, option.UDP_PACKET_MAX_SIZE)
-			nr, _ := ctxA.DecryptRead(buffer)
+			nr, err := ctxA.DecryptRead(buffer)
+			if err == errNoNonce {
+				udpDropped.Inc()
+			}
 			if nr > 0 {
 				if !addrRegistedA {
 					addrRegistedA = true
@@ -137,7 +277,11 @@ func ForwardUnconnectedUDP(ctxA Ctx, ctxB Ctx) {
 				if !(nr == 4 &&
 					buffer[0] == 0xCC && buffer[1] == 0xDD &&
 					buffer[2] == 0xEE && buffer[3] == 0xFF) {
-					packetChannelB <- buffer[:nr]
+					select {
+					case packetChannelB <- buffer[:nr]:
+					default:
+						udpDropped.Inc()
+					}
 				}
 			}
 		}
@@ -147,7 +291,10 @@ func ForwardUnconnectedUDP(ctxA Ctx, ctxB Ctx) {
 	go func() {
 		for {
 			buffer := make([]byte, option.UDP_PACKET_MAX_SIZE)
-			nr, _ := ctxB.DecryptRead(buffer)
+			nr, err := ctxB.DecryptRead(buffer)
+			if err == errNoNonce {
+				udpDropped.Inc()
+			}
 			if nr > 0 {
 				if !addrRegistedB {
 					addrRegistedB = true
@@ -157,7 +304,11 @@ func ForwardUnconnectedUDP(ctxA Ctx, ctxB Ctx) {
 				if !(nr == 4 &&
 					buffer[0] == 0xCC && buffer[1] == 0xDD &&
 					buffer[2] == 0xEE && buffer[3] == 0xFF) {
-					packetChannelA <- buffer[:nr]
+					select {
+					case packetChannelA <- buffer[:nr]:
+					default:
+						udpDropped.Inc()
+					}
 				}
 			}
 		}
@@ -166,26 +317,28 @@ func ForwardUnconnectedUDP(ctxA Ctx, ctxB Ctx) {
 	// A write
 	go func() {
 		<-addrRegistedSignalA
-		var n int
 		for {
 			packet := <-packetChannelA
-			n, _ = ctxA.EncryptWrite(packet)
-			if n > 0 {
-				logger.Info("<== [%d bytes] ==>", n)
+			_, err := ctxA.EncryptWrite(packet)
+			if err != nil {
+				udpDropped.Inc()
+				continue
 			}
+			tunnel.limitPacket(false, len(packet))
 		}
 	}()
 
 	// B write
 	go func() {
 		<-addrRegistedSignalB
-		var n int
 		for {
 			packet := <-packetChannelB
-			n, _ = ctxB.EncryptWrite(packet)
-			if n > 0 {
-				logger.Info("<== [%d bytes] ==>", n)
+			_, err := ctxB.EncryptWrite(packet)
+			if err != nil {
+				udpDropped.Inc()
+				continue
 			}
+			tunnel.limitPacket(true, len(packet))
 		}
 	}()
 
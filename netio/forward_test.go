@@ -0,0 +1,223 @@
+package netio
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"iox/logger"
+	"iox/option"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// Both ends of a TCP connection on loopback
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+// client <-> a, the pipe of a and b, b <-> target
+func forwardTCP(t *testing.T) (client *net.TCPConn, target *net.TCPConn, reason <-chan string) {
+	client, a := tcpPair(t)
+	b, target := tcpPair(t)
+	ctxA, _ := NewTCPCtx(a, false)
+	ctxB, _ := NewTCPCtx(b, false)
+
+	done := make(chan string, 1)
+	go func() {
+		p := NewPipe(nil, ctxA, ctxB)
+		done <- pipeForward(p)
+		p.close()
+	}()
+	return client, target, done
+}
+
+func TestHalfCloseTCP(t *testing.T) {
+	client, target, reason := forwardTCP(t)
+	defer client.Close()
+	defer target.Close()
+	target.SetDeadline(time.Now().Add(5 * time.Second))
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the request then EOF, like nc -N
+	client.Write([]byte("request"))
+	client.CloseWrite()
+
+	req, err := ioutil.ReadAll(target)
+	if err != nil || string(req) != "request" {
+		t.Fatalf("Target read %q, %v", req, err)
+	}
+
+	// the response after EOF still goes back
+	target.Write([]byte("response"))
+	target.Close()
+
+	resp, err := ioutil.ReadAll(client)
+	if err != nil || string(resp) != "response" {
+		t.Fatalf("Client read %q, %v", resp, err)
+	}
+	if r := <-reason; r != reasonClient {
+		t.Fatalf("Pipe closed by %q, want %q", r, reasonClient)
+	}
+}
+
+func TestHalfCloseTimeout(t *testing.T) {
+	defer func(n int) { option.HALF_CLOSE_TIMEOUT = n }(option.HALF_CLOSE_TIMEOUT)
+	option.HALF_CLOSE_TIMEOUT = 1
+
+	client, target, reason := forwardTCP(t)
+	defer client.Close()
+	defer target.Close()
+
+	// target never closes its way
+	client.CloseWrite()
+	target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := target.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Target read %v, want EOF", err)
+	}
+
+	select {
+	case r := <-reason:
+		if r != reasonHalfClose {
+			t.Fatalf("Pipe closed by %q, want %q", r, reasonHalfClose)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Half-closed pipe is kept after the timeout")
+	}
+}
+
+// client <-> a, the registered pipe of a and b, b <-> target. The access log
+// goes to a temp file, whose last record is returned once the pipe is closed
+func forwardLogged(t *testing.T) (client *net.TCPConn, target *net.TCPConn, p *Pipe, record <-chan map[string]interface{}) {
+	f, err := ioutil.TempFile("", "iox-access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	option.ACCESS_LOG = f.Name()
+	if err = logger.InitAccess(); err != nil {
+		t.Fatal(err)
+	}
+
+	client, a := tcpPair(t)
+	b, target := tcpPair(t)
+	ctxA, _ := NewTCPCtx(a, false)
+	ctxB, _ := NewTCPCtx(b, false)
+	p = NewPipe(nil, ctxA, ctxB)
+
+	done := make(chan map[string]interface{}, 1)
+	go func() {
+		p.Forward()
+		p.close()
+
+		defer os.Remove(f.Name())
+		// there is no way to close the access log, point it to nowhere
+		option.ACCESS_LOG = os.DevNull
+		logger.InitAccess()
+		option.ACCESS_LOG = ""
+
+		var last map[string]interface{}
+		content, _ := ioutil.ReadFile(f.Name())
+		for _, line := range bytes.Split(bytes.TrimSpace(content), []byte("\n")) {
+			json.Unmarshal(line, &last)
+		}
+		done <- last
+	}()
+	return client, target, p, done
+}
+
+// waitRecord fails unless the pipe is closed within d with the result
+func waitRecord(t *testing.T, record <-chan map[string]interface{}, d time.Duration, result string) {
+	select {
+	case r := <-record:
+		if r["result"] != result {
+			t.Fatalf("Access log of pipe %v, want result %q", r, result)
+		}
+	case <-time.After(d):
+		t.Fatalf("Pipe isn't closed by %q in %s", result, d)
+	}
+}
+
+// Each transfer resets the idle timer, the pipe is closed once it stops
+func TestPipeIdleTimeout(t *testing.T) {
+	defer func(n int) { option.PIPE_IDLE_TIMEOUT = n }(option.PIPE_IDLE_TIMEOUT)
+	option.PIPE_IDLE_TIMEOUT = 1
+
+	client, target, _, record := forwardLogged(t)
+	defer client.Close()
+	defer target.Close()
+
+	buf := make([]byte, 1)
+	for i := 0; i < 5; i++ {
+		time.Sleep(400 * time.Millisecond)
+		client.Write([]byte{'x'})
+		target.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := target.Read(buf); err != nil {
+			t.Fatalf("Pipe is closed with traffic every 400ms: %v", err)
+		}
+	}
+
+	waitRecord(t, record, 3*time.Second, "idle_timeout")
+}
+
+// The lifetime cuts the pipe off even if it's busy
+func TestPipeLifetime(t *testing.T) {
+	defer func(n int) { option.PIPE_LIFETIME = n }(option.PIPE_LIFETIME)
+	option.PIPE_LIFETIME = 1
+
+	client, target, _, record := forwardLogged(t)
+	defer client.Close()
+	defer target.Close()
+
+	go io.Copy(ioutil.Discard, target)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(100 * time.Millisecond):
+				client.Write([]byte{'x'})
+			}
+		}
+	}()
+
+	start := time.Now()
+	waitRecord(t, record, 3*time.Second, "lifetime")
+	if d := time.Since(start); d < 800*time.Millisecond {
+		t.Fatalf("Pipe is cut off after %s, want the lifetime 1s", d)
+	}
+}
+
+// Closing by either side is ok, killing by the admin endpoint is logged as such
+func TestPipeCloseReason(t *testing.T) {
+	client, target, _, record := forwardLogged(t)
+	client.Close()
+	ioutil.ReadAll(target)
+	target.Close()
+	waitRecord(t, record, 3*time.Second, "ok")
+
+	client, target, p, record := forwardLogged(t)
+	defer client.Close()
+	defer target.Close()
+	p.Kill()
+	waitRecord(t, record, 3*time.Second, "killed")
+}
@@ -0,0 +1,33 @@
+package netio
+
+import (
+	"errors"
+	"net"
+)
+
+var errICMPPrivilege = errors.New("ICMP needs root, or the group of process in net.ipv4.ping_group_range")
+
+// ListenICMP opens an IPv4 socket for ICMP echo. It's a raw socket when
+// privileged, which receives all the ICMP packets of host so replies must
+// be matched by the echo ID. Otherwise it's the unprivileged ping socket,
+// whose echo ID is rewritten by kernel
+func ListenICMP() (conn net.PacketConn, raw bool, err error) {
+	conn, err = net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err == nil {
+		return conn, true, nil
+	}
+
+	conn, err = listenPingSocket()
+	if err != nil {
+		return nil, false, err
+	}
+	return conn, false, nil
+}
+
+// ICMPAddr is the destination address for WriteTo of the socket from ListenICMP
+func ICMPAddr(ip net.IP, raw bool) net.Addr {
+	if raw {
+		return &net.IPAddr{IP: ip}
+	}
+	return &net.UDPAddr{IP: ip}
+}
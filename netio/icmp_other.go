@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package netio
+
+import (
+	"errors"
+	"net"
+)
+
+func listenPingSocket() (net.PacketConn, error) {
+	return nil, errors.New("ICMP needs raw socket privilege on this platform")
+}
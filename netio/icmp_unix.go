@@ -0,0 +1,26 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package netio
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// On Linux, the group of process must be in net.ipv4.ping_group_range
+func listenPingSocket() (net.PacketConn, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, unix.IPPROTO_ICMP)
+	if err == unix.EACCES || err == unix.EPERM {
+		return nil, errICMPPrivilege
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "ping")
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
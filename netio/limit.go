@@ -0,0 +1,117 @@
+package netio
+
+import (
+	"iox/option"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket of bytes per second, rate 0 is unlimited.
+// Bytes are taken after being forwarded, so a big read borrows from the
+// next second and waits it back
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(rate int64) *Limiter {
+	l := &Limiter{last: time.Now()}
+	l.SetRate(rate)
+	return l
+}
+
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// SetRate takes effect on the next transfer, the waiting ones keep the old rate
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	if rate < 0 {
+		rate = 0
+	}
+	l.rate = rate
+	if rate == 0 || l.tokens > l.burst() {
+		l.tokens = l.burst()
+	}
+}
+
+// one second of rate, but at least a full read so it won't always wait
+func (l *Limiter) burst() float64 {
+	if l.rate < option.TCP_BUFFER_SIZE {
+		return option.TCP_BUFFER_SIZE
+	}
+	return float64(l.rate)
+}
+
+func (l *Limiter) refill() {
+	now := time.Now()
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > l.burst() {
+			l.tokens = l.burst()
+		}
+	}
+	l.last = now
+}
+
+// reserve takes n bytes and returns how long to wait for them
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate == 0 {
+		return 0
+	}
+
+	l.refill()
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// Wait blocks until n bytes are allowed
+func (l *Limiter) Wait(n int) {
+	limit(n, l)
+}
+
+// limit waits for the slowest of limiters, nil ones are skipped
+func limit(n int, limiters ...*Limiter) {
+	var wait time.Duration
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		if d := l.reserve(n); d > wait {
+			wait = d
+		}
+	}
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Limits of all the tunnels together, up is from A to B side
+var (
+	globalUp   = NewLimiter(0)
+	globalDown = NewLimiter(0)
+)
+
+func SetGlobalLimit(up int64, down int64) {
+	globalUp.SetRate(up)
+	globalDown.SetRate(down)
+}
+
+func GlobalLimit() (up int64, down int64) {
+	return globalUp.Rate(), globalDown.Rate()
+}
@@ -0,0 +1,122 @@
+package netio
+
+import (
+	"io"
+	"iox/option"
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	strictRate = 1 << 20
+	looseRate  = 64 << 20
+)
+
+// client <-> a, the limited pipe of a and b in the tunnel, b <-> target
+func limitedPipe(t *testing.T, tunnel *Tunnel) (client *net.TCPConn, target *net.TCPConn, p *Pipe) {
+	client, a := tcpPair(t)
+	b, target := tcpPair(t)
+	ctxA, _ := NewTCPCtx(a, false)
+	ctxB, _ := NewTCPCtx(b, false)
+
+	p = NewPipe(tunnel, ctxA, ctxB)
+	go func() {
+		pipeForward(p)
+		p.close()
+	}()
+	return client, target, p
+}
+
+// transferTime is how long n bytes written by client take to reach target
+func transferTime(t *testing.T, client *net.TCPConn, target *net.TCPConn, n int) time.Duration {
+	start := time.Now()
+	go client.Write(make([]byte, n))
+
+	target.SetReadDeadline(start.Add(10 * time.Second))
+	if _, err := io.ReadFull(target, make([]byte, n)); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+// A new limiter starts empty, so the transfer runs at the rate from the start
+func TestLimitRate(t *testing.T) {
+	defer func(rate int64) { option.LIMIT_CONN_UP = rate }(option.LIMIT_CONN_UP)
+	option.LIMIT_CONN_UP = strictRate
+
+	client, target, _ := limitedPipe(t, nil)
+	defer client.Close()
+	defer target.Close()
+
+	if d := transferTime(t, client, target, strictRate); d < 800*time.Millisecond || d > 1500*time.Millisecond {
+		t.Fatalf("%d bytes at %d B/s took %s, want about 1s", strictRate, strictRate, d)
+	}
+}
+
+// The new rate applies to the rest of a running transfer
+func TestLimitSetRate(t *testing.T) {
+	defer func(rate int64) { option.LIMIT_CONN_UP = rate }(option.LIMIT_CONN_UP)
+	option.LIMIT_CONN_UP = strictRate
+
+	client, target, p := limitedPipe(t, nil)
+	defer client.Close()
+	defer target.Close()
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		p.SetLimit(looseRate, 0)
+	}()
+
+	// 4s at the old rate
+	if d := transferTime(t, client, target, 4*strictRate); d > 2*time.Second {
+		t.Fatalf("Transfer took %s after raising the rate", d)
+	}
+	if up, down := p.Limit(); up != looseRate || down != 0 {
+		t.Fatalf("Pipe limit %d/%d, want %d/0", up, down, looseRate)
+	}
+}
+
+// The strictest of the connection, tunnel and global limits decides
+func TestLimitNested(t *testing.T) {
+	defer func(rate int64) { option.LIMIT_CONN_UP = rate }(option.LIMIT_CONN_UP)
+	defer SetGlobalLimit(0, 0)
+
+	tests := []struct {
+		name                 string
+		conn, tunnel, global int64
+	}{
+		{"connection", strictRate, looseRate, looseRate},
+		{"tunnel", looseRate, strictRate, looseRate},
+		{"global", looseRate, 0, strictRate},
+		{"unlimited tunnel", strictRate, 0, 0},
+	}
+
+	for _, tt := range tests {
+		option.LIMIT_CONN_UP = tt.conn
+		SetGlobalLimit(tt.global, 0)
+		tunnel := AddTunnel("test", "a", "b", false, false)
+		tunnel.SetLimit(tt.tunnel, 0)
+
+		client, target, _ := limitedPipe(t, tunnel)
+		d := transferTime(t, client, target, strictRate/2)
+		client.Close()
+		target.Close()
+		tunnel.Remove()
+		// the tokens left by a loose rate would be a burst of the next one
+		SetGlobalLimit(0, 0)
+
+		if d < 350*time.Millisecond || d > 1500*time.Millisecond {
+			t.Errorf("%s: %d bytes took %s, want about 0.5s", tt.name, strictRate/2, d)
+		}
+	}
+
+	// the slowest wait of limiters, nil ones are skipped
+	fast, slow := NewLimiter(looseRate), NewLimiter(strictRate)
+	slow.Wait(strictRate)
+	start := time.Now()
+	limit(strictRate/4, fast, nil, slow)
+	if d := time.Since(start); d < 200*time.Millisecond || d > time.Second {
+		t.Fatalf("limit waited %s, want the 250ms of the slowest", d)
+	}
+}
@@ -0,0 +1,39 @@
+package netio
+
+import (
+	"iox/metrics"
+	"strconv"
+)
+
+var (
+	dialFailures = metrics.NewCounter("iox_dial_failures_total",
+		"Outgoing TCP connections failed to establish")
+	dialDuration = metrics.NewHistogram("iox_dial_duration_seconds",
+		"Time spent establishing outgoing TCP connections",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5})
+	udpDropped = metrics.NewCounter("iox_udp_packets_dropped_total",
+		"UDP packets dropped because of malformed ciphertext, full queue or write error")
+)
+
+func init() {
+	metrics.NewGaugeFunc("iox_pipes_active", "Running TCP pipes", func() float64 {
+		return float64(ActivePipes())
+	})
+
+	metrics.NewGaugeFunc("iox_agents", "Connected reverse socks5 agents", func() float64 {
+		return float64(len(Agents()))
+	})
+
+	metrics.NewCollectFunc("iox_tunnel_bytes_total", "Bytes forwarded by each tunnel, up is from A to B side",
+		"counter", []string{"tunnel", "mode", "direction"}, func() []metrics.Sample {
+			var samples []metrics.Sample
+			for _, t := range Tunnels() {
+				id := strconv.FormatUint(t.ID, 10)
+				samples = append(samples,
+					metrics.Sample{LabelValues: []string{id, t.Mode, "up"}, Value: float64(t.BytesUp())},
+					metrics.Sample{LabelValues: []string{id, t.Mode, "down"}, Value: float64(t.BytesDown())},
+				)
+			}
+			return samples
+		})
+}
@@ -0,0 +1,374 @@
+package netio
+
+import (
+	"io"
+	"iox/logger"
+	"iox/option"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Registry of what is going through iox, for the admin interface
+
+var (
+	registryMu sync.Mutex
+	lastID     uint64
+
+	tunnels = make(map[uint64]*Tunnel)
+	agents  = make(map[uint64]*Agent)
+	pipes   = make(map[uint64]*Pipe)
+)
+
+func nextID() uint64 {
+	return atomic.AddUint64(&lastID, 1)
+}
+
+// NextID is unique among the tunnels, agents and pipes of this process
+func NextID() uint64 {
+	return nextID()
+}
+
+// Tunnel is a working mode started from command line,
+// A and B are the two endpoints as given by `-l/-r`
+type Tunnel struct {
+	// accessed atomically, keep them 64-bit aligned
+	up   int64
+	down int64
+
+	ID    uint64
+	Mode  string
+	A     string
+	B     string
+	EncA  bool
+	EncB  bool
+	Start time.Time
+
+	limitUp   *Limiter
+	limitDown *Limiter
+}
+
+func AddTunnel(mode string, a string, b string, encA bool, encB bool) *Tunnel {
+	t := &Tunnel{
+		ID:        nextID(),
+		Mode:      mode,
+		A:         a,
+		B:         b,
+		EncA:      encA,
+		EncB:      encB,
+		Start:     time.Now(),
+		limitUp:   NewLimiter(option.LIMIT_TUNNEL_UP),
+		limitDown: NewLimiter(option.LIMIT_TUNNEL_DOWN),
+	}
+
+	registryMu.Lock()
+	tunnels[t.ID] = t
+	registryMu.Unlock()
+
+	return t
+}
+
+func (t *Tunnel) Remove() {
+	registryMu.Lock()
+	delete(tunnels, t.ID)
+	registryMu.Unlock()
+}
+
+// Bytes forwarded from A side to B side
+func (t *Tunnel) BytesUp() int64 {
+	return atomic.LoadInt64(&t.up)
+}
+
+// Bytes forwarded from B side to A side
+func (t *Tunnel) BytesDown() int64 {
+	return atomic.LoadInt64(&t.down)
+}
+
+// Limit of all the pipes and packets of the tunnel, byte per second
+func (t *Tunnel) Limit() (up int64, down int64) {
+	return t.limitUp.Rate(), t.limitDown.Rate()
+}
+
+func (t *Tunnel) SetLimit(up int64, down int64) {
+	t.limitUp.SetRate(up)
+	t.limitDown.SetRate(down)
+}
+
+// limitPacket waits after a UDP packet forwarded, the tunnel may be nil
+func (t *Tunnel) limitPacket(up bool, n int) {
+	var l *Limiter
+	if t != nil {
+		l = t.limitDown
+		if up {
+			l = t.limitUp
+		}
+	}
+
+	if up {
+		limit(n, l, globalUp)
+	} else {
+		limit(n, l, globalDown)
+	}
+}
+
+func Tunnels() []*Tunnel {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	list := make([]*Tunnel, 0, len(tunnels))
+	for _, t := range tunnels {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Agent is a reverse socks5 client connected to this server
+type Agent struct {
+	ID        uint64
+	Addr      string
+	Encrypted bool
+	Start     time.Time
+
+	// the agent relaying this one, 0 if it's connected to this server directly
+	Parent uint64
+
+	conn io.Closer
+}
+
+func AddAgent(addr string, encrypted bool, conn io.Closer) *Agent {
+	return AddChildAgent(0, addr, encrypted, conn)
+}
+
+// AddChildAgent adds the agent connected to this server through the parent agent
+func AddChildAgent(parent uint64, addr string, encrypted bool, conn io.Closer) *Agent {
+	a := &Agent{
+		ID:        nextID(),
+		Addr:      addr,
+		Encrypted: encrypted,
+		Start:     time.Now(),
+		Parent:    parent,
+		conn:      conn,
+	}
+
+	registryMu.Lock()
+	agents[a.ID] = a
+	registryMu.Unlock()
+
+	return a
+}
+
+func (a *Agent) Remove() {
+	registryMu.Lock()
+	delete(agents, a.ID)
+	registryMu.Unlock()
+}
+
+// Kill closes the agent session, which also ends all its pipes
+func (a *Agent) Kill() error {
+	return a.conn.Close()
+}
+
+func Agents() []*Agent {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	list := make([]*Agent, 0, len(agents))
+	for _, a := range agents {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func GetAgent(id uint64) *Agent {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return agents[id]
+}
+
+// Pipe is a pair of connections being forwarded by PipeForward.
+// A side is the client, B side is the destination
+type Pipe struct {
+	up   int64
+	down int64
+	// unix nano of the last transfer
+	active int64
+	killed int32
+
+	ID     uint64
+	Tunnel *Tunnel
+	Src    string
+	Dst    string
+	// Target requested by socks5 client, empty for fwd mode
+	Target string
+	EncA   bool
+	EncB   bool
+	Start  time.Time
+
+	ctxA Ctx
+	ctxB Ctx
+
+	limitUp   *Limiter
+	limitDown *Limiter
+}
+
+// The tunnel may be nil if the pipe doesn't belong to any working mode
+func NewPipe(tunnel *Tunnel, ctxA Ctx, ctxB Ctx) *Pipe {
+	return &Pipe{
+		ID:        nextID(),
+		Tunnel:    tunnel,
+		Src:       ctxA.RemoteAddr().String(),
+		Dst:       ctxB.RemoteAddr().String(),
+		EncA:      ctxA.Encrypted(),
+		EncB:      ctxB.Encrypted(),
+		ctxA:      ctxA,
+		ctxB:      ctxB,
+		limitUp:   NewLimiter(option.LIMIT_CONN_UP),
+		limitDown: NewLimiter(option.LIMIT_CONN_DOWN),
+	}
+}
+
+// Forward runs PipeForward with the pipe registered
+func (p *Pipe) Forward() {
+	p.Start = time.Now()
+	atomic.StoreInt64(&p.active, p.Start.UnixNano())
+
+	registryMu.Lock()
+	pipes[p.ID] = p
+	registryMu.Unlock()
+
+	defer func() {
+		registryMu.Lock()
+		delete(pipes, p.ID)
+		registryMu.Unlock()
+	}()
+
+	log := logger.Conn(p.ID)
+	if p.Target != "" {
+		log.Debug("Open pipe: %s <== FWD ==> %s (%s)", p.Src, p.Dst, p.Target)
+	} else {
+		log.Debug("Open pipe: %s <== FWD ==> %s", p.Src, p.Dst)
+	}
+
+	reason := pipeForward(p)
+
+	duration := time.Since(p.Start)
+	log.Debug("Close pipe: %s <== FWD ==> %s, up %d bytes, down %d bytes, duration %s, %s",
+		p.Src, p.Dst, p.BytesUp(), p.BytesDown(), duration.Round(time.Millisecond), reason)
+
+	result, ok := closeResults[reason]
+	if !ok {
+		result = "ok"
+	}
+
+	kind := "fwd"
+	if p.Target != "" {
+		kind = "socks"
+	}
+	logger.Access(logger.AccessRecord{
+		Start:     p.Start,
+		Kind:      kind,
+		Client:    p.Src,
+		Target:    p.Target,
+		Resolved:  p.Dst,
+		Result:    result,
+		Duration:  duration,
+		BytesUp:   p.BytesUp(),
+		BytesDown: p.BytesDown(),
+	})
+}
+
+func (p *Pipe) countUp(n int) {
+	atomic.StoreInt64(&p.active, time.Now().UnixNano())
+	atomic.AddInt64(&p.up, int64(n))
+	if p.Tunnel != nil {
+		atomic.AddInt64(&p.Tunnel.up, int64(n))
+	}
+}
+
+func (p *Pipe) countDown(n int) {
+	atomic.StoreInt64(&p.active, time.Now().UnixNano())
+	atomic.AddInt64(&p.down, int64(n))
+	if p.Tunnel != nil {
+		atomic.AddInt64(&p.Tunnel.down, int64(n))
+	}
+}
+
+// transferUp counts the bytes forwarded to B side, and waits for the limits
+func (p *Pipe) transferUp(n int) {
+	p.countUp(n)
+
+	var tunnelLimit *Limiter
+	if p.Tunnel != nil {
+		tunnelLimit = p.Tunnel.limitUp
+	}
+	limit(n, p.limitUp, tunnelLimit, globalUp)
+}
+
+func (p *Pipe) transferDown(n int) {
+	p.countDown(n)
+
+	var tunnelLimit *Limiter
+	if p.Tunnel != nil {
+		tunnelLimit = p.Tunnel.limitDown
+	}
+	limit(n, p.limitDown, tunnelLimit, globalDown)
+}
+
+// Limit of the pipe itself, byte per second
+func (p *Pipe) Limit() (up int64, down int64) {
+	return p.limitUp.Rate(), p.limitDown.Rate()
+}
+
+func (p *Pipe) SetLimit(up int64, down int64) {
+	p.limitUp.SetRate(up)
+	p.limitDown.SetRate(down)
+}
+
+func (p *Pipe) BytesUp() int64 {
+	return atomic.LoadInt64(&p.up)
+}
+
+func (p *Pipe) BytesDown() int64 {
+	return atomic.LoadInt64(&p.down)
+}
+
+// Kill closes both sides, Forward will return soon
+func (p *Pipe) Kill() {
+	atomic.StoreInt32(&p.killed, 1)
+	p.close()
+}
+
+func (p *Pipe) isKilled() bool {
+	return atomic.LoadInt32(&p.killed) == 1
+}
+
+func (p *Pipe) close() {
+	p.ctxA.Close()
+	p.ctxB.Close()
+}
+
+// Time since the last transfer either way
+func (p *Pipe) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&p.active)))
+}
+
+func Pipes() []*Pipe {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	list := make([]*Pipe, 0, len(pipes))
+	for _, p := range pipes {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func GetPipe(id uint64) *Pipe {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return pipes[id]
+}
@@ -0,0 +1,291 @@
+package netio
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"iox/option"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errDNSServer   = errors.New("DNS server must be like [udp://|tcp://|tls://]IP[:PORT][#SERVERNAME]")
+	errNoSystemDNS = errors.New("No nameserver found in /etc/resolv.conf, specify one by `--dns`")
+)
+
+var (
+	// the system one unless `--dns`, whose TTLs can't be learned so nothing is cached
+	resolver = net.DefaultResolver
+
+	// static overrides from hosts file, names are lower case
+	hosts = make(map[string][]net.IP)
+
+	cacheMu sync.Mutex
+	cache   = make(map[string]cacheEntry)
+)
+
+type cacheEntry struct {
+	ips    []net.IP
+	expire time.Time
+}
+
+// InitResolver applies the DNS options, must be called after parsing cli
+func InitResolver() error {
+	if option.HOSTS_FILE != "" {
+		if err := loadHosts(option.HOSTS_FILE); err != nil {
+			return err
+		}
+	}
+
+	if option.DNS_SERVER != "" {
+		r, err := newResolver(option.DNS_SERVER)
+		if err != nil {
+			return err
+		}
+		resolver = r
+	}
+
+	return nil
+}
+
+// ParseDNSServer parses `[udp://|tcp://|tls://]IP[:PORT][#SERVERNAME]`,
+// SERVERNAME is only for tls, the certificate is verified against the IP
+// without it
+func ParseDNSServer(server string) (network string, address string, serverName string, err error) {
+	network = "udp"
+	if i := strings.Index(server, "://"); i >= 0 {
+		network = server[:i]
+		server = server[i+3:]
+	}
+
+	if i := strings.IndexByte(server, '#'); i >= 0 {
+		serverName = server[i+1:]
+		server = server[:i]
+	}
+
+	port := "53"
+	switch network {
+	case "udp", "tcp":
+	case "tls":
+		port = "853"
+	default:
+		return "", "", "", errDNSServer
+	}
+
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), port)
+	}
+	if host, _, _ := net.SplitHostPort(server); net.ParseIP(host) == nil {
+		return "", "", "", errDNSServer
+	}
+
+	return network, server, serverName, nil
+}
+
+// SystemDNS returns the first nameserver of /etc/resolv.conf in the form of
+// ParseDNSServer, there is no such file on Windows
+func SystemDNS() (string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", errNoSystemDNS
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			return fields[1], nil
+		}
+	}
+
+	return "", errNoSystemDNS
+}
+
+func dialDNS(ctx context.Context, network string, address string, serverName string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	if network != "tls" {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(address)
+	}
+
+	// tls.Conn isn't a PacketConn, so messages are framed as over TCP
+	return tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: option.DNS_INSECURE,
+	}), nil
+}
+
+// DialDNS connects to the server parsed by ParseDNSServer within option.TIMEOUT
+func DialDNS(network string, address string, serverName string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Millisecond*time.Duration(option.TIMEOUT))
+	defer cancel()
+
+	return dialDNS(ctx, network, address, serverName)
+}
+
+func newResolver(server string) (*net.Resolver, error) {
+	network, address, serverName, err := ParseDNSServer(server)
+	if err != nil {
+		return nil, err
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, requested string, _ string) (net.Conn, error) {
+			// truncated UDP replies are retried over TCP
+			network := network
+			if network == "udp" && strings.HasPrefix(requested, "tcp") {
+				network = "tcp"
+			}
+			conn, err := dialDNS(ctx, network, address, serverName)
+			if err != nil {
+				return nil, err
+			}
+			return withTTL(ctx, conn), nil
+		},
+	}, nil
+}
+
+// Hosts file format, `IP NAME [NAME...]` per line
+func loadHosts(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Put the preferred address family first
+func sortByPreference(ips []net.IP) {
+	if option.DNS_PREFER == "" {
+		return
+	}
+
+	preferV4 := option.DNS_PREFER == "ipv4"
+	sort.SliceStable(ips, func(i, j int) bool {
+		iv4 := ips[i].To4() != nil
+		jv4 := ips[j].To4() != nil
+		return iv4 != jv4 && iv4 == preferV4
+	})
+}
+
+// Resolve looks up the host within option.TIMEOUT, IP literal is returned as is.
+// Hosts file goes first, then the cache, then the DNS server. Only the lookups
+// of `--dns` are cached, as their record TTLs are known
+func Resolve(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if ips, ok := hosts[name]; ok {
+		return ips, nil
+	}
+
+	caching := option.DNS_CACHE_TTL > 0 && resolver != net.DefaultResolver
+	if caching {
+		cacheMu.Lock()
+		entry, ok := cache[name]
+		cacheMu.Unlock()
+		if ok && time.Now().Before(entry.expire) {
+			return entry.ips, nil
+		}
+	}
+
+	collector := &ttlCollector{}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), ttlKey{}, collector),
+		time.Millisecond*time.Duration(option.TIMEOUT))
+	defer cancel()
+
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i := range addrs {
+		ips[i] = addrs[i].IP
+	}
+	sortByPreference(ips)
+
+	// cached no longer than the records live
+	ttl := time.Second * time.Duration(option.DNS_CACHE_TTL)
+	if recordTTL, ok := collector.get(); ok && recordTTL < ttl {
+		ttl = recordTTL
+	}
+	if caching && ttl > 0 {
+		storeCache(name, ips, ttl)
+	}
+
+	return ips, nil
+}
+
+// Keep the cache within DNS_CACHE_SIZE, expired entries are evicted first,
+// then the ones expiring soonest
+func storeCache(name string, ips []net.IP, ttl time.Duration) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	now := time.Now()
+	if _, ok := cache[name]; !ok && len(cache) >= option.DNS_CACHE_SIZE {
+		for k, v := range cache {
+			if now.After(v.expire) {
+				delete(cache, k)
+			}
+		}
+
+		for len(cache) >= option.DNS_CACHE_SIZE {
+			var victim string
+			var expire time.Time
+			for k, v := range cache {
+				if victim == "" || v.expire.Before(expire) {
+					victim, expire = k, v.expire
+				}
+			}
+			delete(cache, victim)
+		}
+	}
+
+	cache[name] = cacheEntry{
+		ips:    ips,
+		expire: now.Add(ttl),
+	}
+}
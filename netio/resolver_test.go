@@ -0,0 +1,332 @@
+package netio
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"iox/option"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func appendName(b []byte, name string) []byte {
+	for _, label := range splitLabels(name) {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func splitLabels(name string) []string {
+	var labels []string
+	start := 0
+	for i := 0; i <= len(name); i++ {
+		if i == len(name) || name[i] == '.' {
+			if i > start {
+				labels = append(labels, name[start:i])
+			}
+			start = i + 1
+		}
+	}
+	return labels
+}
+
+func appendRecord(b []byte, name []byte, typ uint16, ttl uint32, rdata []byte) []byte {
+	b = append(b, name...)
+	var fixed [10]byte
+	binary.BigEndian.PutUint16(fixed[0:], typ)
+	binary.BigEndian.PutUint16(fixed[2:], 1)
+	binary.BigEndian.PutUint32(fixed[4:], ttl)
+	binary.BigEndian.PutUint16(fixed[8:], uint16(len(rdata)))
+	b = append(b, fixed[:]...)
+	return append(b, rdata...)
+}
+
+// Reply of the query, A queries get a CNAME of cnameTTL to real.test and an
+// A record of aTTL, others get no answer
+func fakeReply(query []byte, cnameTTL uint32, aTTL uint32, ip net.IP) []byte {
+	end := 12
+	for query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+	qtype := binary.BigEndian.Uint16(query[end-4:])
+
+	resp := make([]byte, 12, 512)
+	copy(resp, query[:2])
+	binary.BigEndian.PutUint16(resp[2:], 0x8180)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	resp = append(resp, query[12:end]...)
+
+	if qtype != 1 {
+		return resp
+	}
+	binary.BigEndian.PutUint16(resp[6:], 2)
+
+	// the question name is at 12
+	target := appendName(nil, "real.test")
+	cnameAt := len(resp) + 12
+	resp = appendRecord(resp, []byte{0xC0, 12}, 5, cnameTTL, target)
+	return appendRecord(resp, []byte{0xC0, byte(cnameAt)}, 1, aTTL, ip.To4())
+}
+
+func TestMinAnswerTTL(t *testing.T) {
+	query := appendName(make([]byte, 12), "mixed.test")
+	query = append(query, 0, 1, 0, 1)
+	binary.BigEndian.PutUint16(query[4:], 1)
+
+	ttl, ok := minAnswerTTL(fakeReply(query, 300, 5, net.ParseIP("192.0.2.1")))
+	if !ok || ttl != 5 {
+		t.Fatalf("minAnswerTTL got %d %v, want 5", ttl, ok)
+	}
+	ttl, ok = minAnswerTTL(fakeReply(query, 7, 300, net.ParseIP("192.0.2.1")))
+	if !ok || ttl != 7 {
+		t.Fatalf("minAnswerTTL got %d %v, want the CNAME TTL 7", ttl, ok)
+	}
+
+	// no answer
+	query[len(query)-3] = 28
+	if _, ok = minAnswerTTL(fakeReply(query, 300, 5, nil)); ok {
+		t.Fatal("minAnswerTTL found a TTL without answer")
+	}
+
+	// truncated
+	resp := fakeReply(query, 300, 5, nil)
+	if _, ok = minAnswerTTL(resp[:13]); ok {
+		t.Fatal("minAnswerTTL found a TTL in malformed message")
+	}
+}
+
+func TestTTLStreamConn(t *testing.T) {
+	query := appendName(make([]byte, 12), "mixed.test")
+	query = append(query, 0, 1, 0, 1)
+	binary.BigEndian.PutUint16(query[4:], 1)
+	resp := fakeReply(query, 300, 42, net.ParseIP("192.0.2.1"))
+
+	frame := make([]byte, 2+len(resp))
+	binary.BigEndian.PutUint16(frame, uint16(len(resp)))
+	copy(frame[2:], resp)
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// written in pieces, read the way of the Go resolver
+	go func() {
+		for i := 0; i < len(frame); i += 5 {
+			end := i + 5
+			if end > len(frame) {
+				end = len(frame)
+			}
+			a.Write(frame[i:end])
+		}
+	}()
+
+	collector := &ttlCollector{}
+	conn := withTTL(context.WithValue(context.Background(), ttlKey{}, collector), b)
+	if _, ok := conn.(net.PacketConn); ok {
+		t.Fatal("Stream connection wrapped as PacketConn")
+	}
+
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(resp))); err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl, ok := collector.get(); !ok || ttl != 42*time.Second {
+		t.Fatalf("Collected TTL %v %v, want 42s", ttl, ok)
+	}
+}
+
+// The fixed cache TTL is capped by the record TTL, learned from the
+// messages of the Go resolver over UDP
+func TestResolveRecordTTL(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.WriteTo(fakeReply(buf[:n], 300, 5, net.ParseIP("192.0.2.1")), addr)
+		}
+	}()
+
+	saved := resolver
+	defer func() { resolver = saved }()
+	resolver, err = newResolver("udp://" + server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips, err := Resolve("ttl.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Resolved %v, want [192.0.2.1]", ips)
+	}
+
+	cacheMu.Lock()
+	entry, ok := cache["ttl.test"]
+	cacheMu.Unlock()
+	if !ok {
+		t.Fatal("Resolved addresses aren't cached")
+	}
+	if left := time.Until(entry.expire); left > 5*time.Second || left < 4*time.Second {
+		t.Fatalf("Cached for %v, want the record TTL 5s", left)
+	}
+}
+
+// Truncated replies over UDP are asked again over TCP of the same server
+func TestResolveTruncated(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	tcpServer, err := net.Listen("tcp", server.LocalAddr().String())
+	if err != nil {
+		t.Skip("TCP port of the UDP server is taken")
+	}
+	defer tcpServer.Close()
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			resp := fakeReply(buf[:n], 300, 300, nil)
+			resp[2] |= 0x02
+			server.WriteTo(resp, addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcpServer.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					var length [2]byte
+					if _, err := io.ReadFull(conn, length[:]); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(length[:]))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					resp := fakeReply(query, 300, 300, net.ParseIP("192.0.2.7"))
+					binary.BigEndian.PutUint16(length[:], uint16(len(resp)))
+					conn.Write(append(length[:], resp...))
+				}
+			}()
+		}
+	}()
+
+	saved := resolver
+	defer func() { resolver = saved }()
+	resolver, err = newResolver("udp://" + server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips, err := Resolve("truncated.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.7")) {
+		t.Fatalf("Resolved %v, want [192.0.2.7] over TCP", ips)
+	}
+}
+
+// Lookups of the system resolver aren't cached, their TTLs are unknown
+func TestResolveSystemNoCache(t *testing.T) {
+	if resolver != net.DefaultResolver {
+		t.Fatal("Resolver isn't the system one without --dns")
+	}
+
+	if _, err := Resolve("localhost"); err != nil {
+		t.Skip("localhost isn't resolved by system")
+	}
+
+	cacheMu.Lock()
+	_, ok := cache["localhost"]
+	cacheMu.Unlock()
+	if ok {
+		t.Fatal("Lookup of the system resolver is cached")
+	}
+}
+
+func TestStoreCacheEvicts(t *testing.T) {
+	cacheMu.Lock()
+	cache = make(map[string]cacheEntry)
+	cacheMu.Unlock()
+
+	// the first one expires soonest
+	storeCache("first", nil, time.Second)
+	for i := 1; i < option.DNS_CACHE_SIZE; i++ {
+		storeCache("name"+strconv.Itoa(i), nil, time.Minute)
+	}
+	storeCache("last", nil, time.Minute)
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	if len(cache) != option.DNS_CACHE_SIZE {
+		t.Fatalf("Cache holds %d, want %d", len(cache), option.DNS_CACHE_SIZE)
+	}
+	if _, ok := cache["first"]; ok {
+		t.Fatal("The entry expiring soonest isn't evicted")
+	}
+	if _, ok := cache["last"]; !ok {
+		t.Fatal("The new entry isn't stored")
+	}
+}
+
+// DoT certificate is verified by default, even without SERVERNAME
+func TestDialDNSVerify(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+	address := server.Listener.Addr().String()
+
+	handshake := func() error {
+		conn, err := dialDNS(context.Background(), "tls", address, "")
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return conn.(*tls.Conn).Handshake()
+	}
+
+	if err := handshake(); err == nil {
+		t.Fatal("Certificate of unknown authority is accepted")
+	}
+
+	option.DNS_INSECURE = true
+	defer func() { option.DNS_INSECURE = false }()
+	if err := handshake(); err != nil {
+		t.Fatalf("Handshake with --dns-insecure: %v", err)
+	}
+}
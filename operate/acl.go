@@ -0,0 +1,109 @@
+package operate
+
+import (
+	"iox/logger"
+	"iox/metrics"
+	"iox/netio"
+	"iox/option"
+	"net"
+)
+
+var aclDenied = metrics.NewCounter("iox_acl_denied_total",
+	"Clients dropped by the allowlist, connections of TCP or packets of UDP", "protocol")
+
+// Allowlist of the listener address. The lists of the listener, by
+// `HOST:PORT` or `:PORT`, replace the global one rather than adding to it
+func aclFor(address string) []*net.IPNet {
+	var allowed []*net.IPNet
+	allowed = append(allowed, option.ACL[address]...)
+	if _, port, err := net.SplitHostPort(address); err == nil && address != ":"+port {
+		allowed = append(allowed, option.ACL[":"+port]...)
+	}
+
+	if len(allowed) == 0 {
+		return option.ACL[""]
+	}
+	return allowed
+}
+
+func aclPermit(allowed []*net.IPNet, ip net.IP) bool {
+	for _, network := range allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Listener which drops clients not in the allowlist, before any handshake
+type aclListener struct {
+	net.Listener
+	allowed []*net.IPNet
+}
+
+func withACL(listener net.Listener, address string) net.Listener {
+	allowed := aclFor(address)
+	if len(allowed) == 0 {
+		return listener
+	}
+
+	return aclListener{
+		Listener: listener,
+		allowed:  allowed,
+	}
+}
+
+func (l aclListener) permit(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	return aclPermit(l.allowed, tcpAddr.IP)
+}
+
+func (l aclListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if l.permit(conn.RemoteAddr()) {
+			return conn, nil
+		}
+
+		logger.Warn("Refuse connection from %s on %s, not in allowlist",
+			conn.RemoteAddr().String(), l.Addr().String())
+		aclDenied.Inc("tcp")
+		conn.Close()
+	}
+}
+
+// udpPermit checks the sources of UDP listener address, nil if all are allowed.
+// Packets are dropped silently, logging each would flood
+func udpPermit(address string) func(*net.UDPAddr) bool {
+	allowed := aclFor(address)
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	return func(addr *net.UDPAddr) bool {
+		if aclPermit(allowed, addr.IP) {
+			return true
+		}
+		logger.Debug("Drop UDP packet from %s on %s, not in allowlist", addr.String(), address)
+		aclDenied.Inc("udp")
+		return false
+	}
+}
+
+// UDP listener context whose packets from the sources not allowed are dropped,
+// replies never go to them
+func newUDPListenerCtx(listener *net.UDPConn, address string, encrypted bool) (*netio.UDPCtx, error) {
+	ctx, err := netio.NewUDPCtx(listener, encrypted, false)
+	if err != nil {
+		return nil, err
+	}
+	ctx.SetPermit(udpPermit(address))
+	return ctx, nil
+}
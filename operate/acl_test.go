@@ -0,0 +1,101 @@
+package operate
+
+import (
+	"iox/option"
+	"net"
+	"testing"
+	"time"
+)
+
+func mustCIDR(s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+func TestACLListenerReplacesGlobal(t *testing.T) {
+	saved := option.ACL
+	defer func() { option.ACL = saved }()
+
+	option.ACL = map[string][]*net.IPNet{
+		"":             {mustCIDR("10.0.0.0/8")},
+		":1080":        {mustCIDR("192.0.2.0/24")},
+		"0.0.0.0:1080": {mustCIDR("198.51.100.7/32")},
+	}
+
+	cases := []struct {
+		address string
+		ip      string
+		want    bool
+	}{
+		// the global list
+		{"0.0.0.0:9999", "10.1.2.3", true},
+		{"0.0.0.0:9999", "192.0.2.1", false},
+		// lists of the listener, the global one doesn't apply
+		{"0.0.0.0:1080", "10.1.2.3", false},
+		{"0.0.0.0:1080", "192.0.2.1", true},
+		{"0.0.0.0:1080", "198.51.100.7", true},
+		{"127.0.0.1:1080", "198.51.100.7", false},
+	}
+
+	for _, c := range cases {
+		if got := aclPermit(aclFor(c.address), net.ParseIP(c.ip)); got != c.want {
+			t.Errorf("%s on %s permitted %v, want %v", c.ip, c.address, got, c.want)
+		}
+	}
+}
+
+func TestUDPListenerACL(t *testing.T) {
+	saved := option.ACL
+	defer func() { option.ACL = saved }()
+
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	address := listener.LocalAddr().String()
+
+	allowed, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer allowed.Close()
+	denied, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Skip("127.0.0.2 isn't available:", err)
+	}
+	defer denied.Close()
+
+	option.ACL = map[string][]*net.IPNet{
+		address: {mustCIDR("127.0.0.1/32")},
+	}
+	ctx, err := newUDPListenerCtx(listener, address, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	allowed.SetReadDeadline(time.Now().Add(time.Second))
+
+	denied.WriteTo([]byte("denied"), listener.LocalAddr())
+	allowed.WriteTo([]byte("allowed"), listener.LocalAddr())
+
+	buf := make([]byte, 64)
+	n, err := ctx.DecryptRead(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "allowed" {
+		t.Fatalf("Read %q, want the packet of allowed source", buf[:n])
+	}
+
+	// the reply goes to the allowed source
+	ctx.EncryptWrite([]byte("reply"))
+	n, _, err = allowed.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "reply" {
+		t.Fatalf("Allowed source read %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,278 @@
+package operate
+
+import (
+	"errors"
+	"iox/logger"
+	"iox/metrics"
+	"iox/option"
+	"net"
+	"sync"
+)
+
+var errListenerClosed = errors.New("Listener has been closed")
+
+var connRefused = metrics.NewCounter("iox_connections_refused_total",
+	"Connections refused by the concurrency limits", "reason")
+
+// Listener which bounds the connections being served, in total and of each
+// client IP. When full it stops accepting so clients queue in the backlog,
+// or refuses them with MAX_CONN_REFUSE. Clients over the IP limit are always
+// refused, waiting for them would hold up the others
+type connLimitListener struct {
+	net.Listener
+
+	// a token is taken for each connection, nil if unlimited
+	slots chan struct{}
+
+	mu     sync.Mutex
+	perIP  map[string]int
+	warned map[string]bool
+	full   bool
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func withConnLimit(listener net.Listener) net.Listener {
+	if option.MAX_CONN <= 0 && option.MAX_CONN_PER_IP <= 0 {
+		return listener
+	}
+
+	l := &connLimitListener{
+		Listener: listener,
+		perIP:    make(map[string]int),
+		warned:   make(map[string]bool),
+		closed:   make(chan struct{}),
+	}
+	if option.MAX_CONN > 0 {
+		l.slots = make(chan struct{}, option.MAX_CONN)
+	}
+	return l
+}
+
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	queue := l.slots != nil && !option.MAX_CONN_REFUSE
+
+	for {
+		if queue && !l.waitSlot() {
+			return nil, errListenerClosed
+		}
+
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if queue {
+				l.releaseSlot()
+			}
+			return nil, err
+		}
+
+		if !queue && !l.trySlot() {
+			logger.Debug("Refuse connection from %s on %s, too many connections",
+				conn.RemoteAddr().String(), l.Addr().String())
+			connRefused.Inc("listener")
+			conn.Close()
+			continue
+		}
+
+		ip := clientIP(conn.RemoteAddr())
+		if !l.acquireIP(ip) {
+			logger.Debug("Refuse connection from %s on %s, too many connections of the IP",
+				conn.RemoteAddr().String(), l.Addr().String())
+			connRefused.Inc("ip")
+			conn.Close()
+			l.releaseSlot()
+			continue
+		}
+
+		return l.wrap(conn, ip), nil
+	}
+}
+
+func (l *connLimitListener) trySlot() bool {
+	if l.slots == nil {
+		return true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		l.setFull(false)
+		return true
+	default:
+		l.setFull(true)
+		return false
+	}
+}
+
+// waitSlot blocks until a connection ends, false if the listener is closed
+func (l *connLimitListener) waitSlot() bool {
+	if l.trySlot() {
+		return true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		l.setFull(false)
+		return true
+	case <-l.closed:
+		return false
+	case <-shuttingDown:
+		return false
+	}
+}
+
+// log once each time the listener gets full
+func (l *connLimitListener) setFull(full bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if full && !l.full {
+		if option.MAX_CONN_REFUSE {
+			logger.Warn("Listener %s reached %d connections, refusing new ones", l.Addr().String(), option.MAX_CONN)
+		} else {
+			logger.Warn("Listener %s reached %d connections, queueing new ones", l.Addr().String(), option.MAX_CONN)
+		}
+	}
+	l.full = full
+}
+
+func (l *connLimitListener) releaseSlot() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (l *connLimitListener) acquireIP(ip string) bool {
+	if option.MAX_CONN_PER_IP <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.perIP[ip] >= option.MAX_CONN_PER_IP {
+		if !l.warned[ip] {
+			l.warned[ip] = true
+			logger.Warn("Client %s reached %d connections on %s, refusing new ones",
+				ip, option.MAX_CONN_PER_IP, l.Addr().String())
+		}
+		return false
+	}
+	l.perIP[ip]++
+	return true
+}
+
+func (l *connLimitListener) release(ip string) {
+	if option.MAX_CONN_PER_IP > 0 {
+		l.mu.Lock()
+		l.perIP[ip]--
+		if l.perIP[ip] <= 0 {
+			delete(l.perIP, ip)
+			delete(l.warned, ip)
+		}
+		l.mu.Unlock()
+	}
+	l.releaseSlot()
+}
+
+func (l *connLimitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// Keep *net.TCPConn embedded, so its methods like SyscallConn still work
+type limitedConn struct {
+	*net.TCPConn
+	once    sync.Once
+	release func()
+}
+
+func (l *connLimitListener) wrap(conn net.Conn, ip string) net.Conn {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		l.release(ip)
+		return conn
+	}
+
+	return &limitedConn{
+		TCPConn: tc,
+		release: func() { l.release(ip) },
+	}
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.TCPConn.Close()
+}
+
+func clientIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	return addr.String()
+}
+
+// Bounds the socks5 connections agent serves by MAX_CONN, they come as
+// streams from server rather than a listener. Like the listener it waits for
+// a slot, or refuses with MAX_CONN_REFUSE. Nil if unlimited
+type streamLimit struct {
+	slots chan struct{}
+
+	mu   sync.Mutex
+	full bool
+}
+
+func newStreamLimit() *streamLimit {
+	if option.MAX_CONN <= 0 {
+		return nil
+	}
+	return &streamLimit{slots: make(chan struct{}, option.MAX_CONN)}
+}
+
+// acquire takes a slot, false if refused or shutting down
+func (l *streamLimit) acquire() bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		l.setFull(false)
+		return true
+	default:
+	}
+
+	l.setFull(true)
+	if option.MAX_CONN_REFUSE {
+		connRefused.Inc("stream")
+		return false
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		l.setFull(false)
+		return true
+	case <-shuttingDown:
+		return false
+	}
+}
+
+func (l *streamLimit) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// log once each time it gets full
+func (l *streamLimit) setFull(full bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if full && !l.full {
+		if option.MAX_CONN_REFUSE {
+			logger.Warn("Agent reached %d socks5 connections, refusing new ones", option.MAX_CONN)
+		} else {
+			logger.Warn("Agent reached %d socks5 connections, queueing new ones", option.MAX_CONN)
+		}
+	}
+	l.full = full
+}
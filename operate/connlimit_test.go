@@ -0,0 +1,50 @@
+package operate
+
+import (
+	"iox/option"
+	"testing"
+	"time"
+)
+
+func TestStreamLimit(t *testing.T) {
+	defer func(n int, refuse bool) {
+		option.MAX_CONN, option.MAX_CONN_REFUSE = n, refuse
+	}(option.MAX_CONN, option.MAX_CONN_REFUSE)
+
+	option.MAX_CONN = 0
+	if newStreamLimit() != nil {
+		t.Fatal("Limit without MAX_CONN")
+	}
+
+	option.MAX_CONN = 2
+	option.MAX_CONN_REFUSE = true
+	limit := newStreamLimit()
+	if !limit.acquire() || !limit.acquire() {
+		t.Fatal("Refused within the limit")
+	}
+	if limit.acquire() {
+		t.Fatal("Acquired over the limit with MAX_CONN_REFUSE")
+	}
+
+	// waits for a slot instead
+	option.MAX_CONN_REFUSE = false
+	acquired := make(chan struct{})
+	go func() {
+		if limit.acquire() {
+			close(acquired)
+		}
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Acquired over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	limit.release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Still waiting after a slot is released")
+	}
+}
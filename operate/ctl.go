@@ -0,0 +1,288 @@
+package operate
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"iox/logger"
+	"iox/option"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// Control messages of protocol 3 on the ctl stream: TYPE, 4 bytes request
+// ID, 2 bytes length, then TLVs of 1 byte tag, 2 bytes length and value.
+// ID 0 is a notification, others are requests which peer replies by
+// CTL_REPLY or CTL_UNSUPPORTED of the same ID. Peers before protocol 3 talk
+// the 4 bytes Protocol, whose CMD is the TYPE and N is TLV_N
+const (
+	// the N of Protocol, like the count of CTL_CONNECT_ME
+	TLV_N = iota + 1
+)
+
+const (
+	CTL_HEADER_SIZE  = 7
+	CTL_MSG_MAX_SIZE = 0xFFFF
+)
+
+var (
+	errCtlMsg         = errors.New("Malformed control message")
+	errCtlUnsupported = errors.New("Peer doesn't support the control request, it may be an older version")
+	errCtlTimeout     = errors.New("Control request timeout")
+	errCtlClosed      = errors.New("Control connection has been closed")
+)
+
+type ctlMsg struct {
+	Type byte
+	ID   uint32
+	TLVs map[byte][]byte
+}
+
+func (m ctlMsg) n() byte {
+	if v := m.TLVs[TLV_N]; len(v) == 1 {
+		return v[0]
+	}
+	return 0
+}
+
+// ctlConn is the ctl stream speaking the protocol agreed in handshake.
+// Recv must be called in a loop, it also delivers the replies of Request
+type ctlConn struct {
+	// set by the reader when peer sent CTL_CLEANUP
+	peerCleanup int32
+
+	stream  *smux.Stream
+	version int
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	lastID  uint32
+	pending map[uint32]chan ctlMsg
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newCtlConn(stream *smux.Stream, version int) *ctlConn {
+	return &ctlConn{
+		stream:  stream,
+		version: version,
+		pending: make(map[uint32]chan ctlMsg),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Send a notification carrying n
+func (c *ctlConn) Send(typ byte, n byte) error {
+	return c.write(ctlMsg{
+		Type: typ,
+		TLVs: map[byte][]byte{TLV_N: {n}},
+	})
+}
+
+// Request sends the request and waits for the reply in TIMEOUT
+func (c *ctlConn) Request(typ byte, tlvs map[byte][]byte) (ctlMsg, error) {
+	if c.version < 3 {
+		return ctlMsg{}, errCtlUnsupported
+	}
+
+	reply := make(chan ctlMsg, 1)
+	c.mu.Lock()
+	c.lastID++
+	if c.lastID == 0 {
+		c.lastID++
+	}
+	id := c.lastID
+	c.pending[id] = reply
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(ctlMsg{Type: typ, ID: id, TLVs: tlvs}); err != nil {
+		return ctlMsg{}, err
+	}
+
+	select {
+	case m := <-reply:
+		if m.Type == CTL_UNSUPPORTED {
+			return ctlMsg{}, errCtlUnsupported
+		}
+		return m, nil
+	case <-c.closed:
+		return ctlMsg{}, errCtlClosed
+	case <-time.After(time.Duration(option.TIMEOUT) * time.Millisecond):
+		return ctlMsg{}, errCtlTimeout
+	}
+}
+
+// Ping measures the round trip of ctl stream
+func (c *ctlConn) Ping() (time.Duration, error) {
+	start := time.Now()
+	if _, err := c.Request(CTL_PING, nil); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// Recv returns the next message for caller. Replies are passed to the
+// requests, and CTL_PING is answered here
+func (c *ctlConn) Recv() (ctlMsg, error) {
+	for {
+		m, err := c.read()
+		if err != nil {
+			c.closeOnce.Do(func() { close(c.closed) })
+			return ctlMsg{}, err
+		}
+
+		switch m.Type {
+		case CTL_REPLY, CTL_UNSUPPORTED:
+			c.mu.Lock()
+			reply, ok := c.pending[m.ID]
+			c.mu.Unlock()
+			if ok {
+				select {
+				case reply <- m:
+				default:
+				}
+			}
+		case CTL_PING:
+			c.Reply(m, nil)
+		case CTL_CLEANUP:
+			atomic.StoreInt32(&c.peerCleanup, 1)
+			return m, nil
+		default:
+			return m, nil
+		}
+	}
+}
+
+// Reply the request m with the TLVs
+func (c *ctlConn) Reply(m ctlMsg, tlvs map[byte][]byte) error {
+	return c.write(ctlMsg{Type: CTL_REPLY, ID: m.ID, TLVs: tlvs})
+}
+
+// Unsupported replies the request caller doesn't know, so peer fails fast.
+// Unknown notifications are ignored
+func (c *ctlConn) Unsupported(m ctlMsg) {
+	logger.Debug("Unsupported control message 0x%x from peer", m.Type)
+	if m.ID != 0 {
+		c.write(ctlMsg{Type: CTL_UNSUPPORTED, ID: m.ID})
+	}
+}
+
+// cleanupOnShutdown notifies peer by CTL_CLEANUP when shutting down, unless
+// peer sent it first. The returned function unregisters it
+func (c *ctlConn) cleanupOnShutdown() func() {
+	return onShutdown(func() {
+		if atomic.LoadInt32(&c.peerCleanup) == 0 {
+			c.Send(CTL_CLEANUP, 0)
+		}
+	})
+}
+
+func (c *ctlConn) Close() error {
+	return c.stream.Close()
+}
+
+func (c *ctlConn) write(m ctlMsg) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.version < 3 {
+		_, err := c.stream.Write(marshal(Protocol{
+			CMD: m.Type,
+			N:   m.n(),
+		}))
+		return err
+	}
+
+	// tags in order, so the same message is the same bytes
+	tags := make([]int, 0, len(m.TLVs))
+	for tag := range m.TLVs {
+		tags = append(tags, int(tag))
+	}
+	sort.Ints(tags)
+
+	msg := make([]byte, CTL_HEADER_SIZE)
+	msg[0] = m.Type
+	binary.BigEndian.PutUint32(msg[1:], m.ID)
+	for _, tag := range tags {
+		v := m.TLVs[byte(tag)]
+		msg = append(msg, byte(tag), byte(len(v)>>8), byte(len(v)))
+		msg = append(msg, v...)
+	}
+
+	if len(msg)-CTL_HEADER_SIZE > CTL_MSG_MAX_SIZE {
+		return errCtlMsg
+	}
+	binary.BigEndian.PutUint16(msg[5:], uint16(len(msg)-CTL_HEADER_SIZE))
+
+	_, err := c.stream.Write(msg)
+	return err
+}
+
+func (c *ctlConn) read() (ctlMsg, error) {
+	if c.version < 3 {
+		pb, err := readUntilEnd(c.stream)
+		if err != nil {
+			return ctlMsg{}, err
+		}
+
+		p := unmarshal(pb)
+		return ctlMsg{
+			Type: p.CMD,
+			TLVs: map[byte][]byte{TLV_N: {p.N}},
+		}, nil
+	}
+
+	header := make([]byte, CTL_HEADER_SIZE)
+	if _, err := io.ReadFull(c.stream, header); err != nil {
+		return ctlMsg{}, err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[5:]))
+	if _, err := io.ReadFull(c.stream, payload); err != nil {
+		return ctlMsg{}, err
+	}
+
+	m := ctlMsg{
+		Type: header[0],
+		ID:   binary.BigEndian.Uint32(header[1:]),
+		TLVs: make(map[byte][]byte),
+	}
+	for len(payload) > 0 {
+		if len(payload) < 3 {
+			return ctlMsg{}, errCtlMsg
+		}
+		size := int(binary.BigEndian.Uint16(payload[1:]))
+		if len(payload) < 3+size {
+			return ctlMsg{}, errCtlMsg
+		}
+
+		m.TLVs[payload[0]] = payload[3 : 3+size]
+		payload = payload[3+size:]
+	}
+
+	return m, nil
+}
+
+// AgentRTT pings the agent connected to server directly over its ctl stream
+func AgentRTT(agentID uint64) (time.Duration, error) {
+	jobSessionsMu.Lock()
+	s, ok := jobSessions[agentID]
+	jobSessionsMu.Unlock()
+	if !ok || s.ctl == nil {
+		return 0, errJobAgent
+	}
+
+	return s.ctl.Ping()
+}
@@ -0,0 +1,171 @@
+package operate
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/xtaci/smux"
+)
+
+// The raw streams of server and agent, closed with the session of server
+func ctlStreams(t *testing.T, version int) (*smux.Session, *smux.Stream, *smux.Stream) {
+	server, agent := smuxPair(t, version)
+	a, err := server.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := agent.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, a, b
+}
+
+func TestCtlRoundTrip(t *testing.T) {
+	big := bytes.Repeat([]byte{0xAB}, CTL_MSG_MAX_SIZE-3)
+
+	tests := []struct {
+		name    string
+		version int
+		msg     ctlMsg
+		// what peer reads, msg itself if nil
+		want *ctlMsg
+	}{
+		{"notification", 3, ctlMsg{Type: CTL_CONNECT_ME, TLVs: map[byte][]byte{TLV_N: {5}}}, nil},
+		{"request", 3, ctlMsg{Type: CTL_JOB, ID: 0x01020304, TLVs: map[byte][]byte{
+			TLV_JOB_TYPE: {JOB_EXEC}, TLV_JOB_PAYLOAD: []byte(`{"command":["id"]}`), TLV_JOB_ID: {},
+		}}, nil},
+		{"no TLV", 3, ctlMsg{Type: CTL_PING, ID: 0xFFFFFFFF, TLVs: map[byte][]byte{}}, nil},
+		{"largest", 3, ctlMsg{Type: CTL_REPLY, ID: 1, TLVs: map[byte][]byte{TLV_JOB_PAYLOAD: big}}, nil},
+		{"protocol 2", 2, ctlMsg{Type: CTL_CONNECT_ME, TLVs: map[byte][]byte{TLV_N: {5}}}, nil},
+		// Protocol carries CMD and N only
+		{"protocol 2 drops", 2, ctlMsg{Type: CTL_CLEANUP, ID: 7, TLVs: map[byte][]byte{TLV_JOB_TYPE: {1}}},
+			&ctlMsg{Type: CTL_CLEANUP, TLVs: map[byte][]byte{TLV_N: {0}}}},
+	}
+
+	for _, tt := range tests {
+		session, a, b := ctlStreams(t, tt.version)
+		w, r := newCtlConn(a, tt.version), newCtlConn(b, tt.version)
+
+		errc := make(chan error, 1)
+		go func(m ctlMsg) { errc <- w.write(m) }(tt.msg)
+
+		got, err := r.read()
+		if err != nil {
+			t.Fatalf("%s: read %v", tt.name, err)
+		}
+		if err = <-errc; err != nil {
+			t.Fatalf("%s: write %v", tt.name, err)
+		}
+
+		want := tt.msg
+		if tt.want != nil {
+			want = *tt.want
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: read %+v, want %+v", tt.name, got, want)
+		}
+		session.Close()
+	}
+}
+
+// TLVs in tag order, so the same message is the same bytes
+func TestCtlWireFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		msg     ctlMsg
+		want    []byte
+	}{
+		{"tlv", 3, ctlMsg{Type: 0x10, ID: 0x01020304, TLVs: map[byte][]byte{2: []byte("ab"), 1: []byte("x")}},
+			[]byte{0x10, 1, 2, 3, 4, 0, 9, 1, 0, 1, 'x', 2, 0, 2, 'a', 'b'}},
+		{"empty", 3, ctlMsg{Type: 0x11}, []byte{0x11, 0, 0, 0, 0, 0, 0}},
+		{"protocol", 2, ctlMsg{Type: CTL_CONNECT_ME, TLVs: map[byte][]byte{TLV_N: {3}}},
+			append([]byte{CTL_CONNECT_ME, 3}, PROTO_END...)},
+	}
+
+	for _, tt := range tests {
+		session, a, b := ctlStreams(t, tt.version)
+
+		go newCtlConn(a, tt.version).write(tt.msg)
+		got := make([]byte, len(tt.want))
+		if _, err := io.ReadFull(b, got); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: wrote %x, want %x", tt.name, got, tt.want)
+		}
+		session.Close()
+	}
+
+	session, a, _ := ctlStreams(t, 3)
+	defer session.Close()
+	w := newCtlConn(a, 3)
+	overlong := ctlMsg{Type: CTL_REPLY, TLVs: map[byte][]byte{TLV_JOB_PAYLOAD: make([]byte, CTL_MSG_MAX_SIZE-2)}}
+	if err := w.write(overlong); err != errCtlMsg {
+		t.Fatalf("Write of overlong message got %v, want %v", err, errCtlMsg)
+	}
+}
+
+func TestCtlMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		want error
+	}{
+		{"short tlv header", []byte{CTL_REPLY, 0, 0, 0, 1, 0, 2, 1, 0}, errCtlMsg},
+		{"tlv over payload", []byte{CTL_REPLY, 0, 0, 0, 1, 0, 5, 1, 0, 5, 'a', 'b'}, errCtlMsg},
+		{"second tlv over payload", []byte{CTL_REPLY, 0, 0, 0, 1, 0, 8, 1, 0, 1, 'a', 2, 0, 9, 'b'}, errCtlMsg},
+		{"truncated header", []byte{CTL_REPLY, 0, 0}, io.ErrUnexpectedEOF},
+		{"truncated payload", []byte{CTL_REPLY, 0, 0, 0, 1, 0, 9, 1, 0, 6}, io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		session, a, b := ctlStreams(t, 3)
+
+		a.Write(tt.raw)
+		a.Close()
+		if _, err := newCtlConn(b, 3).read(); err != tt.want {
+			t.Errorf("%s: read %v, want %v", tt.name, err, tt.want)
+		}
+		session.Close()
+	}
+}
+
+// Protocol ends with PROTO_END in its 4 bytes, anything else is an error
+func TestReadUntilEnd(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		want []byte
+	}{
+		{"protocol", append([]byte{CTL_CLEANUP, 0}, PROTO_END...), []byte{CTL_CLEANUP, 0}},
+		{"no end", []byte{CTL_CLEANUP, 0, 0, 0, 0xEE, 0xFF}, nil},
+		{"closed", []byte{CTL_CLEANUP, 0, 0xEE}, nil},
+	}
+
+	for _, tt := range tests {
+		a, b := net.Pipe()
+		go func(raw []byte) {
+			a.Write(raw)
+			a.Close()
+		}(tt.raw)
+
+		got, err := readUntilEnd(b)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: read %x, want error", tt.name, got)
+			}
+		} else if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: read %x, %v, want %x", tt.name, got, err, tt.want)
+		}
+		b.Close()
+	}
+
+	if p := unmarshal(marshal(Protocol{CMD: CTL_CONNECT_ME, N: 9})); p.CMD != CTL_CONNECT_ME || p.N != 9 {
+		t.Fatalf("Protocol round trip got %+v", p)
+	}
+}
@@ -0,0 +1,619 @@
+package operate
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"iox/logger"
+	"iox/metrics"
+	"iox/netio"
+	"iox/option"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DNS forwarder. IDs of the client queries are rewritten to random ones, so
+// queries from different clients sharing one upstream never collide, and
+// replies are routed back to the clients by ID and question. An off-path
+// reply has to guess both the ID and the pending question.
+//
+// In reverse mode the queries are tunneled to the agent on a smux stream,
+// each frame is 2 bytes length, 1 byte transport, then the message
+
+const (
+	DNS_OVER_UDP = iota
+	DNS_OVER_TCP
+
+	DNS_HEADER_SIZE  = 12
+	DNS_MSG_MAX_SIZE = 0xFFFF
+
+	// queries in flight at most, half of the IDs so a free one is found fast
+	DNS_MAX_PENDING = 0x8000
+)
+
+var errDNSMsgTooLarge = errors.New("DNS message is too large to be framed")
+
+var dnsQueries = metrics.NewCounter("iox_dns_queries_total", "DNS queries by result", "result")
+
+type dnsPending struct {
+	id       uint16
+	question []byte
+	reply    func([]byte)
+	expire   time.Time
+}
+
+type dnsMux struct {
+	mu      sync.Mutex
+	pending map[uint16]*dnsPending
+}
+
+func newDNSMux() *dnsMux {
+	m := &dnsMux{
+		pending: make(map[uint16]*dnsPending),
+	}
+	go m.expire()
+	return m
+}
+
+// Rewrite ID of the query, the reply will be passed to the function.
+// False if there are too many queries in flight, or the query is malformed
+func (m *dnsMux) add(query []byte, reply func([]byte)) bool {
+	question := dnsQuestion(query)
+	if question == nil {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.pending) >= DNS_MAX_PENDING {
+		return false
+	}
+
+	var id uint16
+	b := make([]byte, 2)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			return false
+		}
+		id = binary.BigEndian.Uint16(b)
+		if _, ok := m.pending[id]; !ok {
+			break
+		}
+	}
+
+	m.pending[id] = &dnsPending{
+		id:       binary.BigEndian.Uint16(query),
+		question: question,
+		reply:    reply,
+		expire:   time.Now().Add(time.Millisecond * time.Duration(option.TIMEOUT)),
+	}
+	binary.BigEndian.PutUint16(query, id)
+
+	return true
+}
+
+// Route the reply back, late or unknown replies are dropped. So are those
+// whose question isn't the query's, and the query keeps waiting
+func (m *dnsMux) deliver(resp []byte) {
+	if len(resp) < DNS_HEADER_SIZE {
+		return
+	}
+
+	id := binary.BigEndian.Uint16(resp)
+
+	m.mu.Lock()
+	p, ok := m.pending[id]
+	if ok && !bytes.Equal(dnsQuestion(resp), p.question) {
+		m.mu.Unlock()
+		logger.Debug("DNS reply of ID %d doesn't match the question of query, dropped", id)
+		return
+	}
+	delete(m.pending, id)
+	m.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	binary.BigEndian.PutUint16(resp, p.id)
+	dnsQueries.Inc("answered")
+	p.reply(resp)
+}
+
+func (m *dnsMux) expire() {
+	for range time.Tick(time.Second) {
+		now := time.Now()
+
+		m.mu.Lock()
+		for id, p := range m.pending {
+			if now.After(p.expire) {
+				delete(m.pending, id)
+				dnsQueries.Inc("timeout")
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// SERVFAIL reply of the query, the question section is kept
+func servfail(query []byte) []byte {
+	end := questionEnd(query)
+	qdcount := binary.BigEndian.Uint16(query[4:])
+	if end < 0 {
+		end = DNS_HEADER_SIZE
+		qdcount = 0
+	}
+
+	resp := make([]byte, end)
+	copy(resp, query)
+
+	// QR, keep OPCODE and RD
+	resp[2] = resp[2]&0x79 | 0x80
+	// RA, RCODE 2
+	resp[3] = 0x82
+	binary.BigEndian.PutUint16(resp[4:], qdcount)
+	for i := 6; i < DNS_HEADER_SIZE; i++ {
+		resp[i] = 0
+	}
+
+	return resp
+}
+
+// questionEnd returns where the question section of msg ends, -1 if malformed
+func questionEnd(msg []byte) int {
+	if len(msg) < DNS_HEADER_SIZE {
+		return -1
+	}
+
+	end := DNS_HEADER_SIZE
+	for n := binary.BigEndian.Uint16(msg[4:]); n > 0; n-- {
+		for {
+			if end >= len(msg) {
+				return -1
+			}
+			size := int(msg[end])
+			if size == 0 {
+				end++
+				break
+			}
+			// compression pointer ends the name
+			if size&0xC0 == 0xC0 {
+				end += 2
+				break
+			}
+			if size&0xC0 != 0 {
+				return -1
+			}
+			end += size + 1
+		}
+
+		// QTYPE and QCLASS
+		end += 4
+		if end > len(msg) {
+			return -1
+		}
+	}
+	return end
+}
+
+// dnsQuestion is QDCOUNT and the question section of msg, nil if malformed
+func dnsQuestion(msg []byte) []byte {
+	end := questionEnd(msg)
+	if end < 0 {
+		return nil
+	}
+
+	question := make([]byte, 0, 2+end-DNS_HEADER_SIZE)
+	question = append(question, msg[4:6]...)
+	return append(question, msg[DNS_HEADER_SIZE:end]...)
+}
+
+// DNS message over stream, prefixed with 2 bytes length
+func readDNSMsg(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeDNSMsg(w io.Writer, msg []byte) error {
+	if len(msg) > DNS_MSG_MAX_SIZE {
+		return errDNSMsgTooLarge
+	}
+
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// Read side of the tunnel stream
+type ctxReader struct {
+	netio.Ctx
+}
+
+func (r ctxReader) Read(b []byte) (int, error) {
+	return r.DecryptRead(b)
+}
+
+// Write side of the tunnel stream, frames from different goroutines
+// must not interleave
+type ctxWriter struct {
+	mu  sync.Mutex
+	ctx netio.Ctx
+}
+
+func (w *ctxWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.ctx.EncryptWrite(b)
+}
+
+func readDNSFrame(r io.Reader) (byte, []byte, error) {
+	frame, err := readDNSMsg(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(frame) < 1+DNS_HEADER_SIZE {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	return frame[0], frame[1:], nil
+}
+
+// The transport byte takes one of the length, so messages over 0xFFFE
+// would wrap it
+func writeDNSFrame(w io.Writer, transport byte, msg []byte) error {
+	if len(msg) > DNS_MSG_MAX_SIZE-1 {
+		return errDNSMsgTooLarge
+	}
+	return writeDNSMsg(w, append([]byte{transport}, msg...))
+}
+
+// dnsUpstream sends queries to the DNS server, replies are passed to deliver.
+// Queries over TCP go upstream over TCP, so truncated replies can be retried
+type dnsUpstream struct {
+	network    string
+	address    string
+	serverName string
+	deliver    func([]byte)
+
+	udpConn *net.UDPConn
+}
+
+func newDNSUpstream(server string, deliver func([]byte)) (*dnsUpstream, error) {
+	network, address, serverName, err := netio.ParseDNSServer(server)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &dnsUpstream{
+		network:    network,
+		address:    address,
+		serverName: serverName,
+		deliver:    deliver,
+	}
+
+	if network == "udp" {
+		addr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return nil, err
+		}
+		u.udpConn, err = net.DialUDP("udp", nil, addr)
+		if err != nil {
+			return nil, err
+		}
+		go u.readUDP()
+	}
+
+	return u, nil
+}
+
+func (u *dnsUpstream) readUDP() {
+	buf := make([]byte, DNS_MSG_MAX_SIZE)
+	for {
+		n, err := u.udpConn.Read(buf)
+		if err != nil {
+			// e.g. ICMP port unreachable, the query will time out
+			logger.Debug("Read DNS reply from %s error: %s", u.address, err.Error())
+			continue
+		}
+
+		resp := make([]byte, n)
+		copy(resp, buf[:n])
+		u.deliver(resp)
+	}
+}
+
+func (u *dnsUpstream) exchange(query []byte, transport byte) {
+	if u.network == "udp" && transport == DNS_OVER_UDP {
+		if _, err := u.udpConn.Write(query); err != nil {
+			logger.Warn("Send DNS query to %s error: %s", u.address, err.Error())
+			u.deliver(servfail(query))
+		}
+		return
+	}
+
+	go u.exchangeStream(query)
+}
+
+func (u *dnsUpstream) exchangeStream(query []byte) {
+	network := u.network
+	if network == "udp" {
+		network = "tcp"
+	}
+
+	conn, err := netio.DialDNS(network, u.address, u.serverName)
+	if err != nil {
+		logger.Warn("Connect DNS server %s error: %s", u.address, err.Error())
+		u.deliver(servfail(query))
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(option.TIMEOUT)))
+
+	err = writeDNSMsg(conn, query)
+	if err == nil {
+		var resp []byte
+		resp, err = readDNSMsg(conn)
+		if err == nil {
+			u.deliver(resp)
+			return
+		}
+	}
+
+	logger.Warn("Exchange DNS query with %s error: %s", u.address, err.Error())
+	u.deliver(servfail(query))
+}
+
+// Serve DNS clients on UDP and TCP of the address, the queries are passed
+// to send with IDs rewritten by mux
+func serveDNS(local string, mux *dnsMux, send func([]byte, byte)) {
+	localAddr, err := net.ResolveUDPAddr("udp", local)
+	if err != nil {
+		logger.Error("Parse udp address %s error: %s", local, err.Error())
+		return
+	}
+	udpConn, err := net.ListenUDP("udp", localAddr)
+	if err != nil {
+		logger.Error("Listen udp on %s error: %s", local, err.Error())
+		return
+	}
+	defer udpConn.Close()
+
+	listener, err := listen(local)
+	if err != nil {
+		logger.Error("Listen on %s error: %s", local, err.Error())
+		return
+	}
+	defer listener.Close()
+
+	go serveDNSTCP(listener, mux, send)
+
+	permit := udpPermit(local)
+	buf := make([]byte, DNS_MSG_MAX_SIZE)
+	for {
+		n, clientAddr, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			if isShuttingDown() {
+				return
+			}
+			continue
+		}
+		if n < DNS_HEADER_SIZE || (permit != nil && !permit(clientAddr)) {
+			continue
+		}
+
+		query := make([]byte, n)
+		copy(query, buf[:n])
+
+		ok := mux.add(query, func(resp []byte) {
+			udpConn.WriteToUDP(resp, clientAddr)
+		})
+		if !ok {
+			dnsQueries.Inc("dropped")
+			continue
+		}
+		send(query, DNS_OVER_UDP)
+	}
+}
+
+func serveDNSTCP(listener net.Listener, mux *dnsMux, send func([]byte, byte)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if isShuttingDown() {
+				return
+			}
+			logger.Warn("Handle DNS connect error: %s", err.Error())
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+			var mu sync.Mutex
+
+			for {
+				// idle clients are closed, replies come within the timeout too
+				conn.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(option.TIMEOUT)))
+
+				query, err := readDNSMsg(conn)
+				if err != nil || len(query) < DNS_HEADER_SIZE {
+					return
+				}
+
+				ok := mux.add(query, func(resp []byte) {
+					mu.Lock()
+					writeDNSMsg(conn, resp)
+					mu.Unlock()
+				})
+				if !ok {
+					dnsQueries.Inc("dropped")
+					continue
+				}
+				send(query, DNS_OVER_TCP)
+			}
+		}()
+	}
+}
+
+// DNSLocal forwards the queries on local to upstream directly
+func DNSLocal(local string, upstream string) {
+	mux := newDNSMux()
+	up, err := newDNSUpstream(upstream, mux.deliver)
+	if err != nil {
+		logger.Error("DNS upstream %s error: %s", upstream, err.Error())
+		return
+	}
+
+	tunnel := netio.AddTunnel("dns-local", local, upstream, false, false)
+	defer tunnel.Remove()
+
+	logger.Info("Forward DNS queries on %s to %s", local, upstream)
+
+	serveDNS(local, mux, up.exchange)
+}
+
+// DNSRemote is the agent, it resolves the queries tunneled from server
+// with `--dns` or the system DNS server
+func DNSRemote(remote string, encrypted bool) {
+	server := option.DNS_SERVER
+	if server == "" {
+		var err error
+		server, err = netio.SystemDNS()
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+	}
+
+	session, ctl, err := dialHandshake(remote, clientHandshake)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	defer session.Close()
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		logger.Error("Open DNS stream error: %s", err.Error())
+		return
+	}
+	defer stream.Close()
+
+	streamCtx, err := netio.NewTCPCtx(stream, encrypted)
+	if err != nil {
+		return
+	}
+	w := &ctxWriter{ctx: streamCtx}
+
+	up, err := newDNSUpstream(server, func(resp []byte) {
+		if writeDNSFrame(w, DNS_OVER_UDP, resp) == errDNSMsgTooLarge {
+			logger.Debug("DNS reply of %d bytes is too large to be tunneled", len(resp))
+			writeDNSFrame(w, DNS_OVER_UDP, servfail(resp))
+		}
+	})
+	if err != nil {
+		logger.Error("DNS upstream %s error: %s", server, err.Error())
+		return
+	}
+
+	tunnel := netio.AddTunnel("dns-remote", remote, server, encrypted, false)
+	defer tunnel.Remove()
+
+	go handleCtl(ctl)
+
+	logger.Info("Remote DNS handshake ok (encrypted: %v), resolve with %s", encrypted, server)
+
+	for {
+		transport, query, err := readDNSFrame(ctxReader{streamCtx})
+		if err != nil {
+			if !isShuttingDown() {
+				logger.Error("DNS stream has been closed, exit now")
+			}
+			return
+		}
+
+		up.exchange(query, transport)
+	}
+}
+
+// DNSRemoteL2L waits for the agent on control, then serves DNS clients on
+// local with queries resolved by the agent
+func DNSRemoteL2L(control string, local string, cenc bool) {
+	masterListener, err := listen(control)
+	if err != nil {
+		logger.Error("Listen on %s error", control)
+		return
+	}
+	defer masterListener.Close()
+
+	logger.Debug("Listen on %s for reverse DNS", control)
+
+	session, ctl, err := acceptHandshake(masterListener, serverHandshake)
+	if err != nil {
+		// only when shutting down
+		return
+	}
+	defer session.Close()
+
+	stream, err := session.AcceptStream()
+	if err != nil {
+		logger.Error("Accept DNS stream error: %s", err.Error())
+		return
+	}
+	defer stream.Close()
+
+	streamCtx, err := netio.NewTCPCtx(stream, cenc)
+	if err != nil {
+		return
+	}
+	w := &ctxWriter{ctx: streamCtx}
+
+	logger.Info("Reverse DNS server handshake ok from %s (encrypted: %v)", session.RemoteAddr().String(), cenc)
+	logger.Info("DNS server is listening on %s", local)
+
+	tunnel := netio.AddTunnel("dns-server", control, local, cenc, false)
+	defer tunnel.Remove()
+
+	agent := netio.AddAgent(session.RemoteAddr().String(), cenc, session)
+	defer agent.Remove()
+
+	go handleCtl(ctl)
+
+	mux := newDNSMux()
+	go func() {
+		for {
+			_, resp, err := readDNSFrame(ctxReader{streamCtx})
+			if err != nil {
+				if isShuttingDown() {
+					return
+				}
+				logger.Error("DNS stream has been closed, exit now")
+				os.Exit(-1)
+			}
+
+			mux.deliver(resp)
+		}
+	}()
+
+	serveDNS(local, mux, func(query []byte, transport byte) {
+		if writeDNSFrame(w, transport, query) == errDNSMsgTooLarge {
+			logger.Debug("DNS query of %d bytes is too large to be tunneled", len(query))
+			dnsQueries.Inc("dropped")
+		}
+	})
+}
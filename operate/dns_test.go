@@ -0,0 +1,155 @@
+package operate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"iox/option"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A query of name, type A and class IN
+func dnsQuery(id uint16, name string) []byte {
+	msg := make([]byte, DNS_HEADER_SIZE)
+	binary.BigEndian.PutUint16(msg, id)
+	// RD
+	msg[2] = 0x01
+	binary.BigEndian.PutUint16(msg[4:], 1)
+
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0, 0, 1, 0, 1)
+}
+
+// The reply of query with an answer pointing to the question name
+func dnsReply(query []byte) []byte {
+	resp := append([]byte{}, query...)
+	resp[2] |= 0x80
+	binary.BigEndian.PutUint16(resp[6:], 1)
+	return append(resp, 0xC0, DNS_HEADER_SIZE, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 10, 0, 0, 1)
+}
+
+func TestDNSMuxDeliver(t *testing.T) {
+	m := newDNSMux()
+	replies := make(chan []byte, 8)
+	reply := func(resp []byte) { replies <- resp }
+
+	q1 := dnsQuery(0x1234, "example.com")
+	q2 := dnsQuery(0x1234, "example.org")
+	if !m.add(q1, reply) || !m.add(q2, reply) {
+		t.Fatal("Queries aren't added")
+	}
+	id1, id2 := binary.BigEndian.Uint16(q1), binary.BigEndian.Uint16(q2)
+	if id1 == id2 {
+		t.Fatalf("Queries of the same client ID share ID %d upstream", id1)
+	}
+
+	// spoofed reply of the right ID but another question keeps the query
+	spoofed := dnsReply(dnsQuery(id1, "example.net"))
+	m.deliver(spoofed)
+	// unknown ID
+	m.deliver(dnsReply(dnsQuery(id1+id2+1, "example.com")))
+	select {
+	case resp := <-replies:
+		t.Fatalf("Mismatched reply delivered: %x", resp)
+	default:
+	}
+
+	m.deliver(dnsReply(q2))
+	m.deliver(dnsReply(q1))
+	for _, want := range []string{"example.org", "example.com"} {
+		resp := <-replies
+		if binary.BigEndian.Uint16(resp) != 0x1234 {
+			t.Fatalf("Reply ID %x isn't restored", binary.BigEndian.Uint16(resp))
+		}
+		if !bytes.Equal(dnsQuestion(resp), dnsQuestion(dnsQuery(0x1234, want))) {
+			t.Fatalf("Reply of %s got another question", want)
+		}
+	}
+
+	// a duplicate reply is late
+	m.deliver(dnsReply(q1))
+	select {
+	case <-replies:
+		t.Fatal("Duplicate reply delivered")
+	default:
+	}
+}
+
+func TestDNSMuxID(t *testing.T) {
+	m := newDNSMux()
+
+	ids := make(map[uint16]bool)
+	sequential := true
+	var last uint16
+	for i := 0; i < 64; i++ {
+		q := dnsQuery(1, "example.com")
+		if !m.add(q, func([]byte) {}) {
+			t.Fatal("Query isn't added")
+		}
+		id := binary.BigEndian.Uint16(q)
+		if ids[id] {
+			t.Fatalf("ID %d is pending already", id)
+		}
+		ids[id] = true
+		if i > 0 && id != last+1 {
+			sequential = false
+		}
+		last = id
+	}
+	if sequential {
+		t.Fatal("IDs are sequential")
+	}
+
+	if m.add([]byte{1, 2, 3}, func([]byte) {}) {
+		t.Fatal("Short query is added")
+	}
+	truncated := dnsQuery(1, "example.com")
+	if m.add(truncated[:len(truncated)-2], func([]byte) {}) {
+		t.Fatal("Truncated question is added")
+	}
+}
+
+func TestDNSMuxExpire(t *testing.T) {
+	timeout := option.TIMEOUT
+	option.TIMEOUT = 10
+	defer func() { option.TIMEOUT = timeout }()
+
+	m := newDNSMux()
+	delivered := false
+	q := dnsQuery(1, "example.com")
+	m.add(q, func([]byte) { delivered = true })
+
+	time.Sleep(1500 * time.Millisecond)
+	m.mu.Lock()
+	pending := len(m.pending)
+	m.mu.Unlock()
+	if pending != 0 {
+		t.Fatalf("%d queries pending after timeout", pending)
+	}
+
+	m.deliver(dnsReply(q))
+	if delivered {
+		t.Fatal("Late reply delivered")
+	}
+}
+
+func TestServfail(t *testing.T) {
+	q := dnsQuery(0x4321, "example.com")
+	resp := servfail(dnsReply(q))
+
+	if binary.BigEndian.Uint16(resp) != 0x4321 || resp[2] != 0x81 || resp[3] != 0x82 {
+		t.Fatalf("SERVFAIL header %x", resp[:4])
+	}
+	if !bytes.Equal(dnsQuestion(resp), dnsQuestion(q)) || len(resp) != len(q) {
+		t.Fatalf("SERVFAIL question %x", resp)
+	}
+
+	resp = servfail(q[:DNS_HEADER_SIZE+3])
+	if len(resp) != DNS_HEADER_SIZE || binary.BigEndian.Uint16(resp[4:]) != 0 {
+		t.Fatalf("SERVFAIL of malformed query %x", resp)
+	}
+}
@@ -0,0 +1,139 @@
+package operate
+
+import (
+	"iox/option"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// duplexStream is a socks5 connection over two streams of one way each,
+// since closing a smux stream closes both ways. CloseWrite closes the one
+// being written, then peer reads EOF from it while the other way goes on.
+// The session has twice the streams, but each window only fills one way
+type duplexStream struct {
+	r *smux.Stream
+	w *smux.Stream
+}
+
+func (s *duplexStream) Read(b []byte) (int, error) {
+	return s.r.Read(b)
+}
+
+func (s *duplexStream) Write(b []byte) (int, error) {
+	return s.w.Write(b)
+}
+
+func (s *duplexStream) CloseWrite() error {
+	return s.w.Close()
+}
+
+func (s *duplexStream) Close() error {
+	s.w.Close()
+	return s.r.Close()
+}
+
+func (s *duplexStream) LocalAddr() net.Addr {
+	return s.r.LocalAddr()
+}
+
+func (s *duplexStream) RemoteAddr() net.Addr {
+	return s.r.RemoteAddr()
+}
+
+func (s *duplexStream) SetDeadline(t time.Time) error {
+	s.w.SetDeadline(t)
+	return s.r.SetDeadline(t)
+}
+
+func (s *duplexStream) SetReadDeadline(t time.Time) error {
+	return s.r.SetReadDeadline(t)
+}
+
+func (s *duplexStream) SetWriteDeadline(t time.Time) error {
+	return s.w.SetWriteDeadline(t)
+}
+
+// openDuplex opens the pair to agent, STREAM_SOCKS_UP is written by server
+func openDuplex(session *smux.Session, id uint64) (*duplexStream, error) {
+	up, err := openStream(session, STREAM_SOCKS_UP, id)
+	if err != nil {
+		return nil, err
+	}
+
+	down, err := openStream(session, STREAM_SOCKS_DOWN, id)
+	if err != nil {
+		up.Close()
+		return nil, err
+	}
+
+	return &duplexStream{r: down, w: up}, nil
+}
+
+type pairKey struct {
+	session *smux.Session
+	id      uint64
+}
+
+// The half of a pair waiting for the other one
+type halfStream struct {
+	kind   byte
+	stream *smux.Stream
+	timer  *time.Timer
+}
+
+var (
+	pairsMu sync.Mutex
+	pairs   = make(map[pairKey]*halfStream)
+)
+
+// acceptDuplex pairs the stream with the other one of the same ID. The
+// first of them is kept without a goroutine waiting and gets nil, the second
+// gets the pair. A half unmatched in TIMEOUT is closed, and so are the new
+// ones while MAX_CONNECTION are unmatched
+func acceptDuplex(session *smux.Session, kind byte, id uint64, stream *smux.Stream) *duplexStream {
+	key := pairKey{session, id}
+
+	pairsMu.Lock()
+	half, ok := pairs[key]
+	if !ok {
+		if len(pairs) >= MAX_CONNECTION {
+			pairsMu.Unlock()
+			stream.Close()
+			return nil
+		}
+
+		half = &halfStream{kind: kind, stream: stream}
+		half.timer = time.AfterFunc(time.Millisecond*time.Duration(option.TIMEOUT), func() {
+			pairsMu.Lock()
+			waiting := pairs[key] == half
+			if waiting {
+				delete(pairs, key)
+			}
+			pairsMu.Unlock()
+
+			// unless the other one took it just now
+			if waiting {
+				stream.Close()
+			}
+		})
+		pairs[key] = half
+		pairsMu.Unlock()
+		return nil
+	}
+	delete(pairs, key)
+	pairsMu.Unlock()
+	half.timer.Stop()
+
+	if half.kind == kind {
+		half.stream.Close()
+		stream.Close()
+		return nil
+	}
+	if kind == STREAM_SOCKS_UP {
+		return &duplexStream{r: stream, w: half.stream}
+	}
+	return &duplexStream{r: half.stream, w: stream}
+}
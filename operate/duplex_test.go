@@ -0,0 +1,196 @@
+package operate
+
+import (
+	"io/ioutil"
+	"iox/netio"
+	"iox/option"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// The sessions of server and agent at the protocol version
+func smuxPair(t *testing.T, version int) (*smux.Session, *smux.Session) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, _ := smux.Server(accepted, smuxConfig())
+	agent, _ := smux.Client(dialed, smuxConfig())
+	trackSession(server, version)
+	trackSession(agent, version)
+	return server, agent
+}
+
+// acceptPair accepts the streams of agent until a pair is made
+func acceptPair(t *testing.T, agent *smux.Session) *duplexStream {
+	for {
+		stream, err := agent.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		kind, id, err := readStreamHeader(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn := acceptDuplex(agent, kind, id, stream); conn != nil {
+			return conn
+		}
+	}
+}
+
+func TestDuplexHalfClose(t *testing.T) {
+	server, agent := smuxPair(t, PROTOCOL_VERSION)
+	defer server.Close()
+	defer agent.Close()
+
+	conn, err := openDuplex(server, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pair := acceptPair(t, agent)
+	defer pair.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	pair.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("request"))
+	conn.CloseWrite()
+	req, err := ioutil.ReadAll(pair)
+	if err != nil || string(req) != "request" {
+		t.Fatalf("Agent read %q, %v", req, err)
+	}
+
+	// the other way goes on after EOF
+	pair.Write([]byte("response"))
+	pair.CloseWrite()
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil || string(resp) != "response" {
+		t.Fatalf("Server read %q, %v", resp, err)
+	}
+}
+
+func pendingHalves() int {
+	pairsMu.Lock()
+	defer pairsMu.Unlock()
+	return len(pairs)
+}
+
+// Halves without the other one are kept without waiting, then closed
+func TestAcceptDuplexUnmatched(t *testing.T) {
+	defer func(n int) { option.TIMEOUT = n }(option.TIMEOUT)
+	option.TIMEOUT = 200
+
+	server, agent := smuxPair(t, PROTOCOL_VERSION)
+	defer server.Close()
+	defer agent.Close()
+
+	up, err := openStream(server, STREAM_SOCKS_UP, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, _ := agent.AcceptStream()
+	kind, id, _ := readStreamHeader(stream)
+
+	start := time.Now()
+	if acceptDuplex(agent, kind, id, stream) != nil {
+		t.Fatal("Paired a single half")
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatal("The first half waits for the other one")
+	}
+	if n := pendingHalves(); n != 1 {
+		t.Fatalf("%d halves pending, want 1", n)
+	}
+
+	// closed by agent after TIMEOUT
+	up.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = up.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Unmatched half isn't closed")
+	}
+	if n := pendingHalves(); n != 0 {
+		t.Fatalf("%d halves pending after TIMEOUT, want 0", n)
+	}
+
+	// two halves of the same way aren't a pair
+	for i := 0; i < 2; i++ {
+		if _, err = openStream(server, STREAM_SOCKS_UP, 3); err != nil {
+			t.Fatal(err)
+		}
+		stream, _ := agent.AcceptStream()
+		kind, id, _ := readStreamHeader(stream)
+		if acceptDuplex(agent, kind, id, stream) != nil {
+			t.Fatal("Paired two halves of the same way")
+		}
+	}
+	if n := pendingHalves(); n != 0 {
+		t.Fatalf("%d halves pending, want 0", n)
+	}
+}
+
+// Agents before protocol 4 have a stream for both ways, the pipe is closed
+// at the first EOF
+func TestHalfCloseOldPeer(t *testing.T) {
+	server, agent := smuxPair(t, 3)
+	defer server.Close()
+	defer agent.Close()
+
+	stream, err := openStream(server, STREAM_SOCKS, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, _ := agent.AcceptStream()
+	readStreamHeader(remote)
+	defer remote.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	local, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localCtx, _ := netio.NewTCPCtx(local, false)
+	streamCtx, _ := netio.NewTCPCtx(stream, false)
+	done := make(chan struct{})
+	go func() {
+		netio.NewPipe(nil, localCtx, streamCtx).Forward()
+		localCtx.Close()
+		streamCtx.Close()
+		close(done)
+	}()
+
+	client.Write([]byte("request"))
+	client.(*net.TCPConn).CloseWrite()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Pipe to old peer is kept after EOF")
+	}
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if req, _ := ioutil.ReadAll(remote); string(req) != "request" {
+		t.Fatalf("Agent read %q, want the request before EOF", req)
+	}
+}
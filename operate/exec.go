@@ -0,0 +1,150 @@
+package operate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"iox/logger"
+	"iox/option"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// After the command exits, its output is read for this long at most, as a
+// child left in background may hold the pipes
+const EXEC_WAIT_DELAY = time.Second
+
+var (
+	errExecDisabled = errors.New("Exec is disabled on agent, enable it by `--allow-exec`")
+	errExecCommand  = errors.New("Exec needs a command")
+)
+
+// ExecRequest is the JOB_EXEC payload, the command isn't run by shell
+type ExecRequest struct {
+	Command []string `json:"command"`
+}
+
+// ExecOutput is streamed by agent, Stream is `stdout` or `stderr`
+type ExecOutput struct {
+	Stream string `json:"stream"`
+	Data   []byte `json:"data"`
+}
+
+type ExecResult struct {
+	ExitCode int `json:"exit_code"`
+}
+
+// Exec asks the agent to run the command, onOutput is called with the output
+// as soon as it's read. The command is killed if ctx is cancelled
+func Exec(ctx context.Context, agentID uint64, req ExecRequest, onOutput func(ExecOutput) error) (ExecResult, error) {
+	var result ExecResult
+	err := runJob(ctx, agentID, JOB_EXEC, req, func(payload []byte) error {
+		var output ExecOutput
+		if err := json.Unmarshal(payload, &output); err != nil {
+			return err
+		}
+		return onOutput(output)
+	}, &result)
+	return result, err
+}
+
+func handleExec(ctx context.Context, payload []byte, s *jobStream) (interface{}, error) {
+	if !option.ALLOW_EXEC {
+		return nil, errExecDisabled
+	}
+
+	var req ExecRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+	if len(req.Command) == 0 {
+		return nil, errExecCommand
+	}
+
+	logger.Info("Exec %q for server", req.Command)
+
+	cmd := exec.Command(req.Command[0], req.Command[1:]...)
+	setProcessGroup(cmd)
+
+	// the pipes are made here rather than by cmd, so Wait doesn't close them
+	// while the output is still being read
+	stdout, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer stdout.Close()
+	stderr, stderrW, err := os.Pipe()
+	if err != nil {
+		stdoutW.Close()
+		return nil, err
+	}
+	defer stderr.Close()
+
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+	err = cmd.Start()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go sendOutput(&wg, "stdout", stdout, s.Send)
+	go sendOutput(&wg, "stderr", stderr, s.Send)
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-exited:
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		err = <-exited
+	}
+
+	select {
+	case <-drained:
+	case <-time.After(EXEC_WAIT_DELAY):
+		stdout.Close()
+		stderr.Close()
+		<-drained
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return ExecResult{ExitCode: exitErr.ExitCode()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ExecResult{ExitCode: 0}, nil
+}
+
+func sendOutput(wg *sync.WaitGroup, stream string, r io.Reader, send func(v interface{}) error) {
+	defer wg.Done()
+
+	buf := make([]byte, 0x4000)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			send(ExecOutput{
+				Stream: stream,
+				Data:   buf[:n],
+			})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
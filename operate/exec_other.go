@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package operate
+
+import "os/exec"
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// Only the command itself is killed, its pipes are closed after EXEC_WAIT_DELAY
+// in case a child is still holding them
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
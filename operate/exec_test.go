@@ -0,0 +1,113 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package operate
+
+import (
+	"context"
+	"io/ioutil"
+	"iox/crypto"
+	"iox/option"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func execOutput(ctx context.Context, agentID uint64, command ...string) (string, ExecResult, error) {
+	var output strings.Builder
+	result, err := Exec(ctx, agentID, ExecRequest{Command: command}, func(o ExecOutput) error {
+		output.Write(o.Data)
+		return nil
+	})
+	return output.String(), result, err
+}
+
+// execAgent allows exec with the key, the returned function restores them
+func execAgent() func() {
+	key := crypto.SECRET_KEY
+	crypto.SECRET_KEY = []byte("iox exec test key")
+	option.ALLOW_EXEC = true
+
+	return func() {
+		crypto.SECRET_KEY = key
+		option.ALLOW_EXEC = false
+	}
+}
+
+// A zombie waiting for its new parent counts as gone
+func processGone(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return true
+	}
+	stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat))
+	return len(fields) > 2 && fields[2] == "Z"
+}
+
+func TestExecBackgroundChild(t *testing.T) {
+	session := jobAgent(t, 1010)
+	defer session.Close()
+	defer removeJobSession(1010)
+
+	defer execAgent()()
+
+	// the child in background holds stdout after the shell exits
+	start := time.Now()
+	output, result, err := execOutput(context.Background(), 1010, "sh", "-c", "sleep 30 & echo done; exit 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "done\n" || result.ExitCode != 3 {
+		t.Fatalf("Exec output %q, exit code %d", output, result.ExitCode)
+	}
+	if elapsed := time.Since(start); elapsed > EXEC_WAIT_DELAY+2*time.Second {
+		t.Fatalf("Exec returned after %s", elapsed)
+	}
+}
+
+func TestExecCancel(t *testing.T) {
+	session := jobAgent(t, 1011)
+	defer session.Close()
+	defer removeJobSession(1011)
+
+	defer execAgent()()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the PID of the child in background is sent before cancelling
+	pid := make(chan int, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Exec(ctx, 1011, ExecRequest{Command: []string{"sh", "-c", "sleep 30 & echo $!; wait"}}, func(o ExecOutput) error {
+			n, err := strconv.Atoi(strings.TrimSpace(string(o.Data)))
+			if err == nil {
+				pid <- n
+			}
+			return nil
+		})
+	}()
+
+	var child int
+	select {
+	case child = <-pid:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No output of exec")
+	}
+	cancel()
+	<-done
+
+	for i := 0; !processGone(child); i++ {
+		if i == 50 {
+			syscall.Kill(child, syscall.SIGKILL)
+			t.Fatal("Child in background survives the cancelled exec")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package operate
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// The command leads its own process group, so the children it starts in
+// background are killed with it
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,446 @@
+package operate
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"iox/logger"
+	"iox/option"
+	"os"
+	"time"
+)
+
+const (
+	// the file is written to PATH.part until it's verified, a later
+	// transfer of the same PATH resumes from it
+	FILE_PART_SUFFIX = ".part"
+
+	fileProgressInterval = 200 * time.Millisecond
+)
+
+var (
+	errFileDisabled = errors.New("File transfer is disabled on agent, enable it by `--allow-file`")
+	errFileChecksum = errors.New("SHA-256 mismatch, the partial file is removed")
+	errFileChanged  = errors.New("File size changed while transferring")
+	errFileDir      = errors.New("Can't transfer a directory")
+)
+
+// FileRequest is the transfer between the path of server and agent
+type FileRequest struct {
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+}
+
+type FileProgress struct {
+	Done int64 `json:"done"`
+	Size int64 `json:"size"`
+}
+
+type FileResult struct {
+	Size int64 `json:"size"`
+
+	// bytes kept from the partial file
+	Resumed int64  `json:"resumed"`
+	SHA256  string `json:"sha256"`
+}
+
+// JOB_GET payload, Offset is the size of server's partial file and Prefix is its SHA-256
+type fileGetRequest struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Prefix []byte `json:"prefix"`
+}
+
+// JOB_PUT payload
+type filePutRequest struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// The receiver tells its partial file by Offset and Prefix, then the sender
+// tells where the data starts by Size and Offset. It's 0 unless the prefix
+// matches the file
+type fileStart struct {
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset"`
+	Prefix []byte `json:"prefix,omitempty"`
+}
+
+type fileEnd struct {
+	SHA256 []byte `json:"sha256"`
+}
+
+// Open the partial file of path with its SHA-256. It's emptied if larger
+// than size, which is ignored if negative
+func openPart(path string, size int64) (*os.File, int64, hash.Hash, error) {
+	f, err := os.OpenFile(path+FILE_PART_SUFFIX, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	h := sha256.New()
+	offset, err := io.Copy(h, f)
+	if err == nil && size >= 0 && offset > size {
+		offset, err = 0, restartPart(f, h)
+	}
+	if err != nil {
+		f.Close()
+		return nil, 0, nil, err
+	}
+	return f, offset, h, nil
+}
+
+// Remove the partial file if nothing was kept, after a failed transfer
+func removeEmptyPart(f *os.File) {
+	if info, err := f.Stat(); err == nil && info.Size() == 0 {
+		os.Remove(f.Name())
+	}
+}
+
+func restartPart(f *os.File, h hash.Hash) error {
+	h.Reset()
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
+
+// Verify the partial file of receiver against the first offset bytes of
+// source f. Returns where the data starts, f and h are at the position
+func resumeFrom(f *os.File, h hash.Hash, size int64, offset int64, prefix []byte) (int64, error) {
+	if offset > 0 && offset <= size {
+		if _, err := io.CopyN(h, f, offset); err != nil {
+			return 0, err
+		}
+		if bytes.Equal(h.Sum(nil), prefix) {
+			return offset, nil
+		}
+	}
+
+	h.Reset()
+	_, err := f.Seek(0, io.SeekStart)
+	return 0, err
+}
+
+// Send the source f from offset to size by send, h is updated
+func sendFile(ctx context.Context, f *os.File, h hash.Hash, offset int64, size int64,
+	send func(v interface{}) error, onProgress func(done int64) error) error {
+	buf := make([]byte, option.TCP_BUFFER_SIZE)
+	r := io.LimitReader(f, size-offset)
+	done := offset
+
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		n, err := r.Read(buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			if err := send(rawMsg(buf[:n])); err != nil {
+				return err
+			}
+			done += int64(n)
+			if err := onProgress(done); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if done != size {
+		return errFileChanged
+	}
+	return nil
+}
+
+// Report at most every fileProgressInterval, and the last one
+func throttleProgress(size int64, onProgress func(FileProgress) error) func(int64) error {
+	var last time.Time
+	return func(done int64) error {
+		if done < size && time.Since(last) < fileProgressInterval {
+			return nil
+		}
+		last = time.Now()
+		return onProgress(FileProgress{Done: done, Size: size})
+	}
+}
+
+// Get downloads the remote file of agent to local, resuming from local.part
+func Get(ctx context.Context, agentID uint64, req FileRequest, onProgress func(FileProgress) error) (result FileResult, err error) {
+	part, offset, h, err := openPart(req.Local, -1)
+	if err != nil {
+		return FileResult{}, err
+	}
+	defer func() {
+		if err != nil {
+			removeEmptyPart(part)
+		}
+		part.Close()
+	}()
+
+	j, err := startJob(ctx, agentID, JOB_GET, fileGetRequest{
+		Path:   req.Remote,
+		Offset: offset,
+		Prefix: h.Sum(nil),
+	})
+	if err != nil {
+		return FileResult{}, err
+	}
+	defer j.Close()
+
+	var start *fileStart
+	var progress func(int64) error
+	done := int64(0)
+	var end fileEnd
+
+	err = j.Wait(func(payload []byte) error {
+		if start == nil {
+			start = &fileStart{}
+			if err := json.Unmarshal(payload, start); err != nil {
+				return err
+			}
+			switch start.Offset {
+			case offset:
+			case 0:
+				if err := restartPart(part, h); err != nil {
+					return err
+				}
+			default:
+				return errJobMsg
+			}
+			done = start.Offset
+			progress = throttleProgress(start.Size, onProgress)
+			return progress(done)
+		}
+
+		if _, err := part.Write(payload); err != nil {
+			return err
+		}
+		h.Write(payload)
+		done += int64(len(payload))
+		return progress(done)
+	}, &end)
+	if err != nil {
+		return FileResult{}, err
+	}
+	if start == nil || done != start.Size {
+		return FileResult{}, errFileChanged
+	}
+
+	part.Close()
+	if !bytes.Equal(end.SHA256, h.Sum(nil)) {
+		os.Remove(req.Local + FILE_PART_SUFFIX)
+		return FileResult{}, errFileChecksum
+	}
+	if err = os.Rename(req.Local+FILE_PART_SUFFIX, req.Local); err != nil {
+		return FileResult{}, err
+	}
+
+	return FileResult{
+		Size:    start.Size,
+		Resumed: start.Offset,
+		SHA256:  hex.EncodeToString(end.SHA256),
+	}, nil
+}
+
+// Put uploads the local file to remote path of agent, resuming from remote.part
+func Put(ctx context.Context, agentID uint64, req FileRequest, onProgress func(FileProgress) error) (FileResult, error) {
+	f, err := os.Open(req.Local)
+	if err != nil {
+		return FileResult{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return FileResult{}, err
+	}
+	if info.IsDir() {
+		return FileResult{}, errFileDir
+	}
+	size := info.Size()
+
+	j, err := startJob(ctx, agentID, JOB_PUT, filePutRequest{
+		Path: req.Remote,
+		Size: size,
+	})
+	if err != nil {
+		return FileResult{}, err
+	}
+	defer j.Close()
+
+	// partial file of agent
+	payload, err := j.Recv()
+	if err != nil {
+		return FileResult{}, err
+	}
+	var part fileStart
+	if err = json.Unmarshal(payload, &part); err != nil {
+		return FileResult{}, err
+	}
+
+	h := sha256.New()
+	offset, err := resumeFrom(f, h, size, part.Offset, part.Prefix)
+	if err != nil {
+		return FileResult{}, err
+	}
+	if err = j.Send(fileStart{Size: size, Offset: offset}); err != nil {
+		return FileResult{}, err
+	}
+
+	err = sendFile(ctx, f, h, offset, size, j.Send, throttleProgress(size, onProgress))
+	if err == nil {
+		err = j.Send(fileEnd{SHA256: h.Sum(nil)})
+	}
+
+	// the error of agent explains better if any
+	var end fileEnd
+	if waitErr := j.Wait(nil, &end); waitErr != nil || err != nil {
+		if waitErr != nil && waitErr != io.EOF {
+			return FileResult{}, waitErr
+		}
+		return FileResult{}, err
+	}
+
+	return FileResult{
+		Size:    size,
+		Resumed: offset,
+		SHA256:  hex.EncodeToString(end.SHA256),
+	}, nil
+}
+
+func handleGet(ctx context.Context, payload []byte, s *jobStream) (interface{}, error) {
+	if !option.ALLOW_FILE {
+		return nil, errFileDisabled
+	}
+
+	var req fileGetRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, errFileDir
+	}
+	size := info.Size()
+
+	h := sha256.New()
+	offset, err := resumeFrom(f, h, size, req.Offset, req.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Send file %s to server, %d bytes from %d", req.Path, size, offset)
+
+	if err = s.Send(fileStart{Size: size, Offset: offset}); err != nil {
+		return nil, err
+	}
+	err = sendFile(ctx, f, h, offset, size, s.Send, func(int64) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+
+	return fileEnd{SHA256: h.Sum(nil)}, nil
+}
+
+func handlePut(ctx context.Context, payload []byte, s *jobStream) (result interface{}, err error) {
+	if !option.ALLOW_FILE {
+		return nil, errFileDisabled
+	}
+
+	var req filePutRequest
+	if err = json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+
+	part, offset, h, err := openPart(req.Path, req.Size)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			removeEmptyPart(part)
+		}
+		part.Close()
+	}()
+
+	if err = s.Send(fileStart{Offset: offset, Prefix: h.Sum(nil)}); err != nil {
+		return nil, err
+	}
+
+	payload, err = s.Recv()
+	if err != nil {
+		return nil, err
+	}
+	var start fileStart
+	if err = json.Unmarshal(payload, &start); err != nil {
+		return nil, err
+	}
+	switch start.Offset {
+	case offset:
+	case 0:
+		if err = restartPart(part, h); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errJobMsg
+	}
+
+	logger.Info("Receive file %s from server, %d bytes from %d", req.Path, req.Size, start.Offset)
+
+	// the partial file is kept if interrupted
+	received := start.Offset
+	for received < req.Size {
+		payload, err = s.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if _, err = part.Write(payload); err != nil {
+			return nil, err
+		}
+		h.Write(payload)
+		received += int64(len(payload))
+	}
+
+	payload, err = s.Recv()
+	if err != nil {
+		return nil, err
+	}
+	var end fileEnd
+	if err = json.Unmarshal(payload, &end); err != nil {
+		return nil, err
+	}
+
+	part.Close()
+	if received != req.Size || !bytes.Equal(end.SHA256, h.Sum(nil)) {
+		os.Remove(req.Path + FILE_PART_SUFFIX)
+		return nil, errFileChecksum
+	}
+	if err = os.Rename(req.Path+FILE_PART_SUFFIX, req.Path); err != nil {
+		return nil, err
+	}
+
+	return end, nil
+}
@@ -0,0 +1,196 @@
+package operate
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"iox/crypto"
+	"iox/option"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func sum(b []byte) []byte {
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "iox-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestOpenPart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+
+	// new part
+	f, offset, h, err := openPart(path, 10)
+	if err != nil || offset != 0 || !bytes.Equal(h.Sum(nil), sum(nil)) {
+		t.Fatalf("New part at %d, %v", offset, err)
+	}
+	f.Write([]byte("hello"))
+	f.Close()
+
+	f, offset, h, err = openPart(path, 10)
+	if err != nil || offset != 5 || !bytes.Equal(h.Sum(nil), sum([]byte("hello"))) {
+		t.Fatalf("Part resumed at %d, %v", offset, err)
+	}
+	// the position is the end of part
+	f.Write([]byte(" world"))
+	f.Close()
+
+	// larger than the file now
+	f, offset, h, err = openPart(path, 5)
+	if err != nil || offset != 0 || !bytes.Equal(h.Sum(nil), sum(nil)) {
+		t.Fatalf("Part larger than the file at %d, %v", offset, err)
+	}
+	f.Close()
+	if content, _ := ioutil.ReadFile(path + FILE_PART_SUFFIX); len(content) != 0 {
+		t.Fatalf("Part larger than the file is kept: %q", content)
+	}
+}
+
+func TestResumeFrom(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	content := []byte("hello world")
+	ioutil.WriteFile(path, content, 0600)
+
+	tests := []struct {
+		name   string
+		offset int64
+		prefix []byte
+		want   int64
+	}{
+		{"match", 5, sum(content[:5]), 5},
+		{"whole", 11, sum(content), 11},
+		{"mismatch", 5, sum([]byte("HELLO")), 0},
+		{"larger", 12, sum(append(content, '!')), 0},
+		{"empty", 0, sum(nil), 0},
+	}
+
+	for _, tt := range tests {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h := sha256.New()
+		got, err := resumeFrom(f, h, int64(len(content)), tt.offset, tt.prefix)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: resumed from %d, %v, want %d", tt.name, got, err, tt.want)
+		}
+
+		// f and h continue from there
+		rest, _ := ioutil.ReadAll(f)
+		h.Write(rest)
+		if !bytes.Equal(rest, content[tt.want:]) || !bytes.Equal(h.Sum(nil), sum(content)) {
+			t.Errorf("%s: read %q after resuming", tt.name, rest)
+		}
+		f.Close()
+	}
+}
+
+// fileAgent allows file transfer with the key, the returned function restores them
+func fileAgent() func() {
+	key := crypto.SECRET_KEY
+	crypto.SECRET_KEY = []byte("iox file test key")
+	option.ALLOW_FILE = true
+
+	return func() {
+		crypto.SECRET_KEY = key
+		option.ALLOW_FILE = false
+	}
+}
+
+func TestGetResume(t *testing.T) {
+	session := jobAgent(t, 1012)
+	defer session.Close()
+	defer removeJobSession(1012)
+	defer fileAgent()()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	remote := filepath.Join(dir, "remote")
+	local := filepath.Join(dir, "local")
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	ioutil.WriteFile(remote, content, 0600)
+
+	tests := []struct {
+		name    string
+		part    []byte
+		resumed int64
+	}{
+		{"matching part", content[:40000], 40000},
+		{"mismatched part", []byte("not the prefix"), 0},
+		{"no part", nil, 0},
+	}
+
+	for _, tt := range tests {
+		os.Remove(local)
+		if tt.part != nil {
+			ioutil.WriteFile(local+FILE_PART_SUFFIX, tt.part, 0600)
+		}
+
+		result, err := Get(context.Background(), 1012, FileRequest{Local: local, Remote: remote},
+			func(FileProgress) error { return nil })
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if result.Resumed != tt.resumed || result.Size != int64(len(content)) {
+			t.Errorf("%s: got %+v, want resumed from %d", tt.name, result, tt.resumed)
+		}
+		if got, _ := ioutil.ReadFile(local); !bytes.Equal(got, content) {
+			t.Errorf("%s: downloaded %d bytes differ", tt.name, len(got))
+		}
+		if _, err = os.Stat(local + FILE_PART_SUFFIX); !os.IsNotExist(err) {
+			t.Errorf("%s: part is kept after download", tt.name)
+		}
+	}
+}
+
+// handleBadGet sends the file of one byte with a wrong SHA-256
+func handleBadGet(ctx context.Context, payload []byte, s *jobStream) (interface{}, error) {
+	if err := s.Send(fileStart{Size: 1}); err != nil {
+		return nil, err
+	}
+	if err := s.Send(rawMsg("x")); err != nil {
+		return nil, err
+	}
+	return fileEnd{SHA256: sum([]byte("y"))}, nil
+}
+
+func TestGetChecksum(t *testing.T) {
+	handler := jobHandlers[JOB_GET]
+	jobHandlers[JOB_GET] = handleBadGet
+	defer func() { jobHandlers[JOB_GET] = handler }()
+
+	session := jobAgent(t, 1013)
+	defer session.Close()
+	defer removeJobSession(1013)
+	defer fileAgent()()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "local")
+
+	_, err := Get(context.Background(), 1013, FileRequest{Local: local, Remote: "remote"},
+		func(FileProgress) error { return nil })
+	if err == nil || err.Error() != errFileChecksum.Error() {
+		t.Fatalf("Get of wrong SHA-256 got %v, want %v", err, errFileChecksum)
+	}
+	if _, err = os.Stat(local + FILE_PART_SUFFIX); !os.IsNotExist(err) {
+		t.Fatal("Part is kept after SHA-256 mismatch")
+	}
+	if _, err = os.Stat(local); !os.IsNotExist(err) {
+		t.Fatal("File of wrong SHA-256 is renamed")
+	}
+}
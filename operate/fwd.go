@@ -1,27 +1,38 @@
 package operate
 
 import (
+	"errors"
 	"iox/crypto"
 	"iox/logger"
 	"iox/netio"
 	"iox/option"
+	"iox/policy"
 	"net"
+	"strconv"
 	"time"
 )
 
+var errRemoteDenied = errors.New("Remote denied by policy")
+
 func local2RemoteTCP(local string, remote string, lenc bool, renc bool) {
-	listener, err := net.Listen("tcp", local)
+	listener, err := listen(local)
 	if err != nil {
-		logger.Warn("Listen on %s error: %s", local, err.Error())
+		logger.Error("Listen on %s error: %s", local, err.Error())
 		return
 	}
 	defer listener.Close()
 
+	tunnel := netio.AddTunnel("fwd-l2r", local, remote, lenc, renc)
+	defer tunnel.Remove()
+
 	for {
-		logger.Info("Wait for connection on %s", local)
+		logger.Debug("Wait for connection on %s", local)
 
 		localConn, err := listener.Accept()
 		if err != nil {
+			if isShuttingDown() {
+				return
+			}
 			logger.Warn("Handle local connect error: %s", err.Error())
 			continue
 		}
@@ -29,8 +40,8 @@ func local2RemoteTCP(local string, remote string, lenc bool, renc bool) {
 		go func() {
 			defer localConn.Close()
 
-			logger.Info("Connection from %s", localConn.RemoteAddr().String())
-			logger.Info("Connecting " + remote)
+			logger.Debug("Connection from %s", localConn.RemoteAddr().String())
+			logger.Debug("Connecting " + remote)
 
 			localConnCtx, err := netio.NewTCPCtx(localConn, lenc)
 			if err != nil {
@@ -38,10 +49,7 @@ func local2RemoteTCP(local string, remote string, lenc bool, renc bool) {
 				return
 			}
 
-			remoteConn, err := net.DialTimeout(
-				"tcp", remote,
-				time.Millisecond*time.Duration(option.TIMEOUT),
-			)
+			remoteConn, err := dialRemote(remote)
 			if err != nil {
 				logger.Warn("Connect remote %s error: %s", remote, err.Error())
 				return
@@ -54,11 +62,7 @@ func local2RemoteTCP(local string, remote string, lenc bool, renc bool) {
 				return
 			}
 
-			logger.Info("Open pipe: %s <== FWD ==> %s",
-				localConn.RemoteAddr().String(), remoteConn.RemoteAddr().String())
-			netio.PipeForward(localConnCtx, remoteConnCtx)
-			logger.Info("Close pipe: %s <== FWD ==> %s",
-				localConn.RemoteAddr().String(), remoteConn.RemoteAddr().String())
+			netio.NewPipe(tunnel, localConnCtx, remoteConnCtx).Forward()
 		}()
 	}
 
@@ -67,29 +71,29 @@ func local2RemoteTCP(local string, remote string, lenc bool, renc bool) {
 func local2RemoteUDP(local string, remote string, lenc bool, renc bool) {
 	localAddr, err := net.ResolveUDPAddr("udp", local)
 	if err != nil {
-		logger.Warn("Parse udp address %s error: %s", local, err.Error())
+		logger.Error("Parse udp address %s error: %s", local, err.Error())
 		return
 	}
 	listener, err := net.ListenUDP("udp", localAddr)
 	if err != nil {
-		logger.Warn("Listen udp on %s error: %s", local, err.Error())
+		logger.Error("Listen udp on %s error: %s", local, err.Error())
 		return
 	}
 	defer listener.Close()
 
-	remoteAddr, err := net.ResolveUDPAddr("udp", remote)
+	remoteAddr, err := resolveRemoteUDP(remote)
 	if err != nil {
-		logger.Warn("Parse udp address %s error: %s", local, err.Error())
+		logger.Error("Parse udp address %s error: %s", local, err.Error())
 		return
 	}
 	remoteConn, err := net.DialUDP("udp", nil, remoteAddr)
 	if err != nil {
-		logger.Warn("Dial remote udp %s error: %s", local, err.Error())
+		logger.Error("Dial remote udp %s error: %s", local, err.Error())
 		return
 	}
 	defer remoteConn.Close()
 
-	listenerCtx, err := netio.NewUDPCtx(listener, lenc, false)
+	listenerCtx, err := newUDPListenerCtx(listener, local, lenc)
 	if err != nil {
 		return
 	}
@@ -98,16 +102,109 @@ func local2RemoteUDP(local string, remote string, lenc bool, renc bool) {
 		return
 	}
 
-	netio.ForwardUDP(listenerCtx, remoteCtx)
+	tunnel := netio.AddTunnel("fwd-l2r-udp", local, remote, lenc, renc)
+	defer tunnel.Remove()
+
+	netio.ForwardUDP(tunnel, listenerCtx, remoteCtx)
+}
+
+// Check the fwd remote against destination policy when starting, so a remote
+// denied as a whole fails early. Each connection is checked by dialRemote
+func remoteAllowed(remote string) bool {
+	if !policy.Enabled() {
+		return true
+	}
+
+	host, port, err := net.SplitHostPort(remote)
+	if err != nil {
+		logger.Error("Parse remote address %s error: %s", remote, err.Error())
+		return false
+	}
+	portNum, _ := strconv.Atoi(port)
+
+	ips, err := netio.Resolve(host)
+	if err != nil {
+		logger.Error("Resolve remote %s error: %s", remote, err.Error())
+		return false
+	}
+
+	if allowed, rule := policy.Filter(host, ips, portNum); len(allowed) == 0 {
+		logger.Error("Forward to %s denied by policy `%s`", remote, rule)
+		return false
+	}
+	return true
+}
+
+// dialRemote resolves the remote for each connection, as the records may
+// change, and dials only the addresses allowed by policy like socks5 CONNECT
+func dialRemote(remote string) (net.Conn, error) {
+	if !policy.Enabled() {
+		return netio.DialTCP(remote)
+	}
+
+	host, port, err := net.SplitHostPort(remote)
+	if err != nil {
+		return nil, err
+	}
+	portNum, _ := strconv.Atoi(port)
+
+	ips, err := netio.Resolve(host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, rule := policy.Filter(host, ips, portNum)
+	if len(ips) == 0 {
+		logger.Warn("Forward to %s denied by policy `%s`", remote, rule)
+		return nil, errRemoteDenied
+	}
+
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = netio.DialTCP(net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// resolveRemoteUDP picks the first address of the UDP remote allowed by policy,
+// the socket is dialed once so it's resolved once as well
+func resolveRemoteUDP(remote string) (*net.UDPAddr, error) {
+	if !policy.Enabled() {
+		return net.ResolveUDPAddr("udp", remote)
+	}
+
+	host, port, err := net.SplitHostPort(remote)
+	if err != nil {
+		return nil, err
+	}
+	portNum, _ := strconv.Atoi(port)
+
+	ips, err := netio.Resolve(host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, _ = policy.Filter(host, ips, portNum)
+	if len(ips) == 0 {
+		return nil, errRemoteDenied
+	}
+	return &net.UDPAddr{IP: ips[0], Port: portNum}, nil
 }
 
 func Local2Remote(local string, remote string, lenc bool, renc bool) {
+	if !remoteAllowed(remote) {
+		return
+	}
+
 	if option.PROTOCOL == "TCP" {
-		logger.Success("Forward TCP traffic between %s (encrypted: %v) and %s (encrypted: %v)",
+		logger.Info("Forward TCP traffic between %s (encrypted: %v) and %s (encrypted: %v)",
 			local, lenc, remote, renc)
 		local2RemoteTCP(local, remote, lenc, renc)
 	} else {
-		logger.Success("Forward UDP traffic between %s (encrypted: %v) and %s (encrypted: %v)",
+		logger.Info("Forward UDP traffic between %s (encrypted: %v) and %s (encrypted: %v)",
 			local, lenc, remote, renc)
 		local2RemoteUDP(local, remote, lenc, renc)
 	}
@@ -117,6 +214,9 @@ func local2LocalTCP(localA string, localB string, laenc bool, lbenc bool) {
 	var listenerA net.Listener
 	var listenerB net.Listener
 
+	tunnel := netio.AddTunnel("fwd-l2l", localA, localB, laenc, lbenc)
+	defer tunnel.Remove()
+
 	for {
 		signal := make(chan byte)
 		var localConnA net.Conn
@@ -124,19 +224,22 @@ func local2LocalTCP(localA string, localB string, laenc bool, lbenc bool) {
 
 		go func() {
 			var err error
-			listenerA, err = net.Listen("tcp", localA)
+			listenerA, err = listen(localA)
 			if err != nil {
-				logger.Warn("Listen on %s error: %s", localA, err.Error())
+				logger.Error("Listen on %s error: %s", localA, err.Error())
 				return
 			}
 			defer listenerA.Close()
 
 			for {
-				logger.Info("Wait for connection on %s", localA)
+				logger.Debug("Wait for connection on %s", localA)
 
 				var err error
 				localConnA, err = listenerA.Accept()
 				if err != nil {
+					if isShuttingDown() {
+						return
+					}
 					logger.Warn("Handle connection error: %s", err.Error())
 					continue
 				}
@@ -147,19 +250,22 @@ func local2LocalTCP(localA string, localB string, laenc bool, lbenc bool) {
 
 		go func() {
 			var err error
-			listenerB, err = net.Listen("tcp", localB)
+			listenerB, err = listen(localB)
 			if err != nil {
-				logger.Warn("Listen on %s error: %s", localB, err.Error())
+				logger.Error("Listen on %s error: %s", localB, err.Error())
 				return
 			}
 			defer listenerB.Close()
 
 			for {
-				logger.Info("Wait for connection on %s", localB)
+				logger.Debug("Wait for connection on %s", localB)
 
 				var err error
 				localConnB, err = listenerB.Accept()
 				if err != nil {
+					if isShuttingDown() {
+						return
+					}
 					logger.Warn("Handle connection error: %s", err.Error())
 					continue
 				}
@@ -170,9 +276,9 @@ func local2LocalTCP(localA string, localB string, laenc bool, lbenc bool) {
 
 		switch <-signal {
 		case 'A':
-			logger.Info("%s connected, waiting for %s", localA, localB)
+			logger.Debug("%s connected, waiting for %s", localA, localB)
 		case 'B':
-			logger.Info("%s connected, waiting for %s", localB, localA)
+			logger.Debug("%s connected, waiting for %s", localB, localA)
 		}
 
 		<-signal
@@ -198,11 +304,7 @@ func local2LocalTCP(localA string, localB string, laenc bool, lbenc bool) {
 				logger.Warn("handle local %s error: %s", localB, err.Error())
 			}
 
-			logger.Info("Open pipe: %s <== FWD ==> %s",
-				localConnA.RemoteAddr().String(), localConnB.RemoteAddr().String())
-			netio.PipeForward(localConnCtxA, localConnCtxB)
-			logger.Info("Close pipe: %s <== FWD ==> %s",
-				localConnA.RemoteAddr().String(), localConnB.RemoteAddr().String())
+			netio.NewPipe(tunnel, localConnCtxA, localConnCtxB).Forward()
 		}()
 	}
 }
@@ -210,54 +312,60 @@ func local2LocalTCP(localA string, localB string, laenc bool, lbenc bool) {
 func local2LocalUDP(localA string, localB string, laenc bool, lbenc bool) {
 	localAddrA, err := net.ResolveUDPAddr("udp", localA)
 	if err != nil {
-		logger.Warn("Parse udp address %s error: %s", localA, err.Error())
+		logger.Error("Parse udp address %s error: %s", localA, err.Error())
 		return
 	}
 	listenerA, err := net.ListenUDP("udp", localAddrA)
 	if err != nil {
-		logger.Warn("Listen udp on %s error: %s", localA, err.Error())
+		logger.Error("Listen udp on %s error: %s", localA, err.Error())
 		return
 	}
 	defer listenerA.Close()
 
 	localAddrB, err := net.ResolveUDPAddr("udp", localB)
 	if err != nil {
-		logger.Warn("Parse udp address %s error: %s", localB, err.Error())
+		logger.Error("Parse udp address %s error: %s", localB, err.Error())
 		return
 	}
 	listenerB, err := net.ListenUDP("udp", localAddrB)
 	if err != nil {
-		logger.Warn("Listen udp on %s error: %s", localB, err.Error())
+		logger.Error("Listen udp on %s error: %s", localB, err.Error())
 		return
 	}
 	defer listenerB.Close()
 
-	listenerCtxA, err := netio.NewUDPCtx(listenerA, laenc, false)
+	listenerCtxA, err := newUDPListenerCtx(listenerA, localA, laenc)
 	if err != nil {
 		return
 	}
-	listenerCtxB, err := netio.NewUDPCtx(listenerB, lbenc, false)
+	listenerCtxB, err := newUDPListenerCtx(listenerB, localB, lbenc)
 	if err != nil {
 		return
 	}
 
-	netio.ForwardUnconnectedUDP(listenerCtxA, listenerCtxB)
+	tunnel := netio.AddTunnel("fwd-l2l-udp", localA, localB, laenc, lbenc)
+	defer tunnel.Remove()
+
+	netio.ForwardUnconnectedUDP(tunnel, listenerCtxA, listenerCtxB)
 }
 
 func Local2Local(localA string, localB string, laenc bool, lbenc bool) {
 	if option.PROTOCOL == "TCP" {
-		logger.Success("Forward TCP traffic between %s (encrypted: %v) and %s (encrypted: %v)",
+		logger.Info("Forward TCP traffic between %s (encrypted: %v) and %s (encrypted: %v)",
 			localA, laenc, localB, lbenc)
 
 		local2LocalTCP(localA, localB, laenc, lbenc)
 	} else {
-		logger.Success("Forward UDP traffic between %s (encrypted: %v) and %s (encrypted: %v)",
+		logger.Info("Forward UDP traffic between %s (encrypted: %v) and %s (encrypted: %v)",
 			localA, laenc, localB, lbenc)
 		local2LocalUDP(localA, localB, laenc, lbenc)
 	}
 }
 
 func remote2remoteTCP(remoteA string, remoteB string, raenc bool, rbenc bool) {
+	tunnel := netio.AddTunnel("fwd-r2r", remoteA, remoteB, raenc, rbenc)
+	defer tunnel.Remove()
+
 	for {
 		var remoteConnA net.Conn
 		var remoteConnB net.Conn
@@ -267,14 +375,15 @@ func remote2remoteTCP(remoteA string, remoteB string, raenc bool, rbenc bool) {
 		go func() {
 			for {
 				var err error
-				logger.Info("Connecting remote %s", remoteA)
+				logger.Debug("Connecting remote %s", remoteA)
+
+				if isShuttingDown() {
+					return
+				}
 
-				remoteConnA, err = net.DialTimeout(
-					"tcp", remoteA,
-					time.Millisecond*time.Duration(option.TIMEOUT),
-				)
+				remoteConnA, err = dialRemote(remoteA)
 				if err != nil {
-					logger.Info("Connect remote %s error, retrying", remoteA)
+					logger.Debug("Connect remote %s error, retrying", remoteA)
 					time.Sleep(option.CONNECTING_RETRY_DURATION * time.Millisecond)
 					continue
 				}
@@ -287,14 +396,15 @@ func remote2remoteTCP(remoteA string, remoteB string, raenc bool, rbenc bool) {
 		go func() {
 			for {
 				var err error
-				logger.Info("Connecting remote %s", remoteB)
+				logger.Debug("Connecting remote %s", remoteB)
 
-				remoteConnB, err = net.DialTimeout(
-					"tcp", remoteB,
-					time.Millisecond*time.Duration(option.TIMEOUT),
-				)
+				if isShuttingDown() {
+					return
+				}
+
+				remoteConnB, err = dialRemote(remoteB)
 				if err != nil {
-					logger.Info("Connect remote %s error, retrying", remoteB)
+					logger.Debug("Connect remote %s error, retrying", remoteB)
 					time.Sleep(option.CONNECTING_RETRY_DURATION * time.Millisecond)
 					continue
 				}
@@ -328,37 +438,33 @@ func remote2remoteTCP(remoteA string, remoteB string, raenc bool, rbenc bool) {
 					logger.Warn("Handle remote %s error: %s", remoteB, err.Error())
 				}
 
-				logger.Info("Start pipe: %s <== FWD ==> %s",
-					remoteConnA.RemoteAddr().String(), remoteConnB.RemoteAddr().String())
-				netio.PipeForward(remoteConnCtxA, remoteConnCtxB)
-				logger.Info("Close pipe: %s <== FWD ==> %s",
-					remoteConnA.RemoteAddr().String(), remoteConnB.RemoteAddr().String())
+				netio.NewPipe(tunnel, remoteConnCtxA, remoteConnCtxB).Forward()
 			}
 		}()
 	}
 }
 
 func remote2remoteUDP(remoteA string, remoteB string, raenc bool, rbenc bool) {
-	remoteAddrA, err := net.ResolveUDPAddr("udp", remoteA)
+	remoteAddrA, err := resolveRemoteUDP(remoteA)
 	if err != nil {
-		logger.Warn("Parse udp address %s error: %s", remoteA, err.Error())
+		logger.Error("Parse udp address %s error: %s", remoteA, err.Error())
 		return
 	}
 	remoteConnA, err := net.DialUDP("udp", nil, remoteAddrA)
 	if err != nil {
-		logger.Warn("Dial remote udp %s error: %s", remoteA, err.Error())
+		logger.Error("Dial remote udp %s error: %s", remoteA, err.Error())
 		return
 	}
 	defer remoteConnA.Close()
 
-	remoteAddrB, err := net.ResolveUDPAddr("udp", remoteB)
+	remoteAddrB, err := resolveRemoteUDP(remoteB)
 	if err != nil {
-		logger.Warn("Parse udp address %s error: %s", remoteB, err.Error())
+		logger.Error("Parse udp address %s error: %s", remoteB, err.Error())
 		return
 	}
 	remoteConnB, err := net.DialUDP("udp", nil, remoteAddrB)
 	if err != nil {
-		logger.Warn("Dial remote udp %s error: %s", remoteB, err.Error())
+		logger.Error("Dial remote udp %s error: %s", remoteB, err.Error())
 		return
 	}
 	defer remoteConnB.Close()
@@ -413,16 +519,23 @@ func remote2remoteUDP(remoteA string, remoteB string, raenc bool, rbenc bool) {
 		}
 	}
 
-	netio.ForwardUDP(remoteCtxA, remoteCtxB)
+	tunnel := netio.AddTunnel("fwd-r2r-udp", remoteA, remoteB, raenc, rbenc)
+	defer tunnel.Remove()
+
+	netio.ForwardUDP(tunnel, remoteCtxA, remoteCtxB)
 }
 
 func Remote2Remote(remoteA string, remoteB string, raenc bool, rbenc bool) {
+	if !remoteAllowed(remoteA) || !remoteAllowed(remoteB) {
+		return
+	}
+
 	if option.PROTOCOL == "TCP" {
-		logger.Success("Forward TCP traffic between %s (encrypted: %v) and %s (encrypted: %v)",
+		logger.Info("Forward TCP traffic between %s (encrypted: %v) and %s (encrypted: %v)",
 			remoteA, raenc, remoteB, rbenc)
 		remote2remoteTCP(remoteA, remoteB, raenc, rbenc)
 	} else {
-		logger.Success("Forward UDP traffic between %s (encrypted: %v) and %s (encrypted: %v)",
+		logger.Info("Forward UDP traffic between %s (encrypted: %v) and %s (encrypted: %v)",
 			remoteA, raenc, remoteB, rbenc)
 		remote2remoteUDP(remoteA, remoteB, raenc, rbenc)
 	}
@@ -0,0 +1,109 @@
+package operate
+
+import (
+	"io/ioutil"
+	"iox/netio"
+	"iox/option"
+	"iox/policy"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func writeTemp(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "iox-fwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func loadHostsFile(t *testing.T, content string) {
+	hosts := writeTemp(t, content)
+	defer os.Remove(hosts)
+
+	option.HOSTS_FILE = hosts
+	defer func() { option.HOSTS_FILE = "" }()
+	if err := netio.InitResolver(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDialRemotePolicy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+
+	accepted := make(chan struct{}, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			accepted <- struct{}{}
+		}
+	}()
+
+	rules := writeTemp(t, "allow 127.0.0.3/32\nallow allowed.fwd.test\ndeny 127.0.0.1/32\n")
+	defer os.Remove(rules)
+	if err = policy.Load(rules); err != nil {
+		t.Fatal(err)
+	}
+	defer policy.Load(os.DevNull)
+
+	loadHostsFile(t, "127.0.0.3 rebind.fwd.test\n127.0.0.1 denied.fwd.test\n127.0.0.1 allowed.fwd.test\n")
+
+	remote := net.JoinHostPort("rebind.fwd.test", port)
+	if !remoteAllowed(remote) {
+		t.Fatal("Remote with an allowed address is refused at startup")
+	}
+	if remoteAllowed(net.JoinHostPort("denied.fwd.test", port)) {
+		t.Fatal("Denied remote is allowed at startup")
+	}
+
+	// the record changes to a denied address after startup
+	loadHostsFile(t, "127.0.0.1 rebind.fwd.test\n")
+	conn, err := dialRemote(remote)
+	if err == nil {
+		conn.Close()
+		t.Fatal("Dialed the address denied by policy")
+	}
+	if err == errRemoteDenied {
+		t.Fatal("Denied the remote with an allowed address")
+	}
+
+	if _, err = dialRemote(net.JoinHostPort("denied.fwd.test", port)); err != errRemoteDenied {
+		t.Fatalf("Dial of denied remote got %v, want %v", err, errRemoteDenied)
+	}
+
+	select {
+	case <-accepted:
+		t.Fatal("Denied address is connected")
+	default:
+	}
+
+	conn, err = dialRemote(net.JoinHostPort("allowed.fwd.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	<-accepted
+
+	addr, err := resolveRemoteUDP(remote)
+	if err != nil || !addr.IP.Equal(net.IPv4(127, 0, 0, 3)) {
+		t.Fatalf("UDP remote resolved to %v, %v", addr, err)
+	}
+	if _, err = resolveRemoteUDP(net.JoinHostPort("denied.fwd.test", port)); err != errRemoteDenied {
+		t.Fatalf("UDP denied remote got %v, want %v", err, errRemoteDenied)
+	}
+}
@@ -0,0 +1,722 @@
+package operate
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"iox/crypto"
+	"iox/logger"
+	"iox/netio"
+	"iox/option"
+	"iox/socks5"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// Jobs are run by the reverse socks5 agent for server. Server asks for the
+// job by CTL_JOB on the ctl stream, the reply acks it, then server opens the
+// STREAM_JOB of the same ID for its data. Each message on the job stream is
+// TYPE, 4 bytes length, then JSON payload: agent may stream JOB_DATA, then
+// replies the result or error. Closing the stream cancels the job
+const (
+	JOB_RESULT = iota + 0x10
+	JOB_ERROR
+	JOB_DATA
+)
+
+const (
+	JOB_PING = iota + 0x20
+	JOB_SCAN
+	JOB_EXEC
+	JOB_GET
+	JOB_PUT
+
+	// the stream becomes a socks5 connection served by agent
+	JOB_SOCKS
+	JOB_AGENTS
+	JOB_KILL
+)
+
+// TLVs of CTL_JOB and CTL_JOB_AUTH, the ID is 8 bytes. The request to a
+// relayed agent carries the IDs of each hop in TLV_JOB_ROUTE, see forward.
+// The failure is replied by TLV_JOB_ERROR
+const (
+	TLV_JOB_TYPE = iota + 0x10
+	TLV_JOB_ID
+	TLV_JOB_PAYLOAD
+	TLV_JOB_ROUTE
+	TLV_JOB_CHALLENGE
+	TLV_JOB_MAC
+	TLV_JOB_ERROR
+)
+
+const JOB_MSG_MAX_SIZE = 0x1000000
+
+var (
+	errJobMsg         = errors.New("Malformed job message")
+	errJobUnsupported = errors.New("Agent doesn't take jobs, it may be an older version")
+	errJobType        = errors.New("Agent doesn't support the job")
+	errJobBusy        = errors.New("Too many jobs waiting for their streams")
+	errJobAgent       = errors.New("No such agent, or it doesn't take jobs")
+	errJobTargets     = errors.New("Too many targets of the job")
+	errJobNoKey       = errors.New("The job must be authenticated by key, specify it by `-k` param")
+	errJobAuth        = errors.New("Job authentication failed, the key doesn't match")
+)
+
+// Jobs authenticated by key. The reply of CTL_JOB carries a random challenge,
+// then server sends CTL_JOB_AUTH with HMAC-SHA256(key, challenge | TYPE | job
+// payload) before opening the stream
+var authJobs = map[byte]bool{
+	JOB_EXEC: true,
+	JOB_GET:  true,
+	JOB_PUT:  true,
+}
+
+// Run by agent, payload is the JSON of job request. ctx is done when
+// server closed the stream
+type jobHandler func(ctx context.Context, payload []byte, s *jobStream) (interface{}, error)
+
+var jobHandlers = map[byte]jobHandler{
+	JOB_PING:   handlePing,
+	JOB_SCAN:   handleScan,
+	JOB_EXEC:   handleExec,
+	JOB_GET:    handleGet,
+	JOB_PUT:    handlePut,
+	JOB_AGENTS: handleAgentsJob,
+	JOB_KILL:   handleKill,
+}
+
+type jobSession struct {
+	session   *smux.Session
+	ctl       *ctlConn
+	encrypted bool
+}
+
+var (
+	jobSessionsMu sync.Mutex
+	jobSessions   = make(map[uint64]jobSession)
+)
+
+// Agents with the ID take jobs over the session
+func addJobSession(agentID uint64, session *smux.Session, ctl *ctlConn, encrypted bool) {
+	jobSessionsMu.Lock()
+	jobSessions[agentID] = jobSession{session, ctl, encrypted}
+	jobSessionsMu.Unlock()
+}
+
+func removeJobSession(agentID uint64) {
+	jobSessionsMu.Lock()
+	delete(jobSessions, agentID)
+	jobSessionsMu.Unlock()
+}
+
+// rawMsg is sent as is rather than JSON, for file data
+type rawMsg []byte
+
+func writeJobMsg(w io.Writer, typ byte, v interface{}) error {
+	payload, ok := v.(rawMsg)
+	if !ok {
+		var err error
+		payload, err = json.Marshal(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	msg := make([]byte, 5+len(payload))
+	msg[0] = typ
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(payload)))
+	copy(msg[5:], payload)
+
+	_, err := w.Write(msg)
+	return err
+}
+
+func readJobMsg(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > JOB_MSG_MAX_SIZE {
+		return 0, nil, errJobMsg
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// job is the server side of a job stream
+type job struct {
+	ctx    context.Context
+	stream *smux.Stream
+	conn   netio.Ctx
+	r      io.Reader
+	w      io.Writer
+	done   chan struct{}
+}
+
+// startJob asks agent for the job and returns once agent acked it.
+// Cancelling ctx cancels the job. The job of relayed agent goes through the
+// session of the root agent and each relaying agent
+func startJob(ctx context.Context, agentID uint64, typ byte, req interface{}) (*job, error) {
+	root := agentID
+	jobSessionsMu.Lock()
+	route, relayed := relayRoutes[agentID]
+	if relayed {
+		root = route.root
+	}
+	s, ok := jobSessions[root]
+	jobSessionsMu.Unlock()
+	if !ok {
+		return nil, errJobAgent
+	}
+
+	reqPayload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if authJobs[typ] && crypto.SECRET_KEY == nil {
+		return nil, errJobNoKey
+	}
+
+	id := netio.NextID()
+	tlvs := jobTLVs(id, route.hops)
+	tlvs[TLV_JOB_TYPE] = []byte{typ}
+	tlvs[TLV_JOB_PAYLOAD] = reqPayload
+	reply, err := jobRequest(s.ctl, CTL_JOB, tlvs)
+	if err != nil {
+		return nil, err
+	}
+
+	if authJobs[typ] {
+		tlvs = jobTLVs(id, route.hops)
+		tlvs[TLV_JOB_MAC] = jobMAC(reply.TLVs[TLV_JOB_CHALLENGE], typ, reqPayload)
+		if _, err = jobRequest(s.ctl, CTL_JOB_AUTH, tlvs); err != nil {
+			return nil, err
+		}
+	}
+
+	stream, err := openStream(s.session, STREAM_JOB, id)
+	if err != nil {
+		return nil, err
+	}
+
+	streamCtx, err := netio.NewEndpointTCPCtx(stream, s.encrypted)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	j := &job{
+		ctx:    ctx,
+		stream: stream,
+		conn:   streamCtx,
+		r:      ctxReader{streamCtx},
+		w:      &ctxWriter{ctx: streamCtx},
+		done:   make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.Close()
+		case <-j.done:
+		}
+	}()
+
+	return j, nil
+}
+
+func jobTLVs(id uint64, hops []uint64) map[byte][]byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, id)
+	tlvs := map[byte][]byte{TLV_JOB_ID: b}
+
+	if len(hops) > 0 {
+		route := make([]byte, 8*len(hops))
+		for i, hop := range hops {
+			binary.BigEndian.PutUint64(route[8*i:], hop)
+		}
+		tlvs[TLV_JOB_ROUTE] = route
+	}
+	return tlvs
+}
+
+// Send the request on ctl, the failure replied by agent is returned as error
+func jobRequest(ctl *ctlConn, typ byte, tlvs map[byte][]byte) (ctlMsg, error) {
+	reply, err := ctl.Request(typ, tlvs)
+	if err == errCtlUnsupported {
+		return ctlMsg{}, errJobUnsupported
+	}
+	if err != nil {
+		return ctlMsg{}, err
+	}
+
+	if msg, ok := reply.TLVs[TLV_JOB_ERROR]; ok {
+		return ctlMsg{}, errors.New(string(msg))
+	}
+	return reply, nil
+}
+
+func (j *job) Close() {
+	close(j.done)
+	j.stream.Close()
+}
+
+// Send JOB_DATA to agent
+func (j *job) Send(v interface{}) error {
+	return writeJobMsg(j.w, JOB_DATA, v)
+}
+
+// Recv returns the next JOB_DATA payload from agent
+func (j *job) Recv() ([]byte, error) {
+	typ, payload, err := readJobMsg(j.r)
+	if err != nil {
+		if j.ctx.Err() != nil {
+			return nil, j.ctx.Err()
+		}
+		return nil, err
+	}
+
+	switch typ {
+	case JOB_DATA:
+		return payload, nil
+	case JOB_ERROR:
+		return nil, jobError(payload)
+	default:
+		return nil, errJobMsg
+	}
+}
+
+// Wait reads the JOB_DATA from agent and passes them to onData until the
+// result, which is decoded into resp. onData can be nil if agent streams nothing
+func (j *job) Wait(onData func([]byte) error, resp interface{}) error {
+	for {
+		typ, payload, err := readJobMsg(j.r)
+		if err != nil {
+			if j.ctx.Err() != nil {
+				return j.ctx.Err()
+			}
+			return err
+		}
+
+		switch typ {
+		case JOB_DATA:
+			if onData == nil {
+				return errJobMsg
+			}
+			if err = onData(payload); err != nil {
+				return err
+			}
+		case JOB_RESULT:
+			return json.Unmarshal(payload, resp)
+		case JOB_ERROR:
+			return jobError(payload)
+		default:
+			return errJobMsg
+		}
+	}
+}
+
+// runJob runs the job which takes nothing but the request, see Wait for the args
+func runJob(ctx context.Context, agentID uint64, typ byte, req interface{}, onData func([]byte) error, resp interface{}) error {
+	j, err := startJob(ctx, agentID, typ, req)
+	if err != nil {
+		return err
+	}
+	defer j.Close()
+
+	return j.Wait(onData, resp)
+}
+
+// CIDRs are expanded to IPs, except the network and broadcast address of
+// IPv4. Domains are kept for the job to resolve
+func expandTargets(targets []string, max int) ([]string, error) {
+	hosts := []string{}
+
+	for _, target := range targets {
+		if !strings.Contains(target, "/") {
+			if len(hosts) >= max {
+				return nil, errJobTargets
+			}
+			hosts = append(hosts, target)
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(target)
+		if err != nil {
+			return nil, err
+		}
+		ones, bits := network.Mask.Size()
+		if bits-ones > 24 || len(hosts)+1<<uint(bits-ones) > max {
+			return nil, errJobTargets
+		}
+
+		n := 1 << uint(bits-ones)
+		ip := network.IP
+		for i := 0; i < n; i++ {
+			if !(bits == 8*net.IPv4len && ones < 31 && (i == 0 || i == n-1)) {
+				hosts = append(hosts, ip.String())
+			}
+			ip = nextIP(ip)
+		}
+	}
+
+	return hosts, nil
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func jobMAC(challenge []byte, typ byte, payload []byte) []byte {
+	mac := hmac.New(sha256.New, crypto.SECRET_KEY)
+	mac.Write(challenge)
+	mac.Write([]byte{typ})
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func jobError(payload []byte) error {
+	var msg string
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return errJobMsg
+	}
+	return errors.New(msg)
+}
+
+// serveStreams serves the streams opened by server until the session is
+// closed, the relayed pipes and socks5 connections belong to the tunnel.
+// Socks5 connections are bounded by limit, job streams must be acked in jobs
+func serveStreams(session *smux.Session, encrypted bool, tunnel *netio.Tunnel, limit *streamLimit, jobs *agentJobs) {
+	version := sessionVersion(session)
+
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			kind, id, err := readStreamHeader(stream)
+			if err != nil {
+				stream.Close()
+				return
+			}
+
+			switch kind {
+			case STREAM_JOB:
+				j := jobs.take(id)
+				if j == nil {
+					logger.Debug("Job stream #%d from server isn't acked", id)
+					stream.Close()
+					return
+				}
+				serveJob(stream, id, encrypted, tunnel, j)
+			case STREAM_SOCKS:
+				defer stream.Close()
+				if !limit.acquire() {
+					return
+				}
+				defer limit.release()
+				logger.Debug("Socks5 stream #%d from server", id)
+
+				connCtx, err := netio.NewTCPCtx(stream, encrypted)
+				if err != nil {
+					return
+				}
+				socks5.HandleConnection(tunnel, connCtx)
+			case STREAM_SOCKS_UP, STREAM_SOCKS_DOWN:
+				conn := acceptDuplex(session, kind, id, stream)
+				if conn == nil {
+					return
+				}
+				defer conn.Close()
+				if !limit.acquire() {
+					return
+				}
+				defer limit.release()
+				logger.Debug("Socks5 stream #%d from server", id)
+
+				connCtx, err := netio.NewTCPCtx(conn, encrypted)
+				if err != nil {
+					return
+				}
+				if version < 5 {
+					socks5.HandleConnection(tunnel, connCtx)
+					return
+				}
+
+				client, err := readClientAddr(connCtx)
+				if err != nil {
+					return
+				}
+				socks5.HandleConnection(tunnel, withClient(connCtx, client))
+			default:
+				stream.Close()
+			}
+		}()
+	}
+}
+
+// jobStream is the agent side of a job stream
+type jobStream struct {
+	w    io.Writer
+	data chan []byte
+}
+
+// Send JOB_DATA to server
+func (s *jobStream) Send(v interface{}) error {
+	return writeJobMsg(s.w, JOB_DATA, v)
+}
+
+// Recv returns the next JOB_DATA payload from server
+func (s *jobStream) Recv() ([]byte, error) {
+	payload, ok := <-s.data
+	if !ok {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return payload, nil
+}
+
+func serveJob(stream *smux.Stream, id uint64, encrypted bool, tunnel *netio.Tunnel, j *agentJob) {
+	defer stream.Close()
+
+	streamCtx, err := netio.NewEndpointTCPCtx(stream, encrypted)
+	if err != nil {
+		return
+	}
+
+	// the stream is taken over rather than running a handler
+	if j.relay != nil {
+		relayJob(tunnel, id, streamCtx, *j.relay)
+		return
+	}
+	if j.typ == JOB_SOCKS {
+		var req socksRequest
+		if json.Unmarshal(j.payload, &req) == nil {
+			socks5.HandleConnection(tunnel, withClient(streamCtx, clientAddr(req.Client)))
+		}
+		return
+	}
+
+	r := ctxReader{streamCtx}
+	w := &ctxWriter{ctx: streamCtx}
+
+	// the job is cancelled once server closed the stream
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := &jobStream{
+		w:    w,
+		data: make(chan []byte),
+	}
+	go func() {
+		defer cancel()
+		defer close(s.data)
+
+		for {
+			typ, payload, err := readJobMsg(r)
+			if err != nil || typ != JOB_DATA {
+				return
+			}
+			select {
+			case s.data <- payload:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	result, err := jobHandlers[j.typ](ctx, j.payload, s)
+	if err != nil {
+		logger.Debug("Job 0x%x error: %s", j.typ, err.Error())
+		writeJobMsg(w, JOB_ERROR, err.Error())
+		return
+	}
+	writeJobMsg(w, JOB_RESULT, result)
+}
+
+// agentJobs are the jobs acked to server on the ctl stream, waiting for
+// their streams. They expire in TIMEOUT
+type agentJobs struct {
+	mu   sync.Mutex
+	jobs map[uint64]*agentJob
+}
+
+type agentJob struct {
+	typ     byte
+	payload []byte
+
+	// set until CTL_JOB_AUTH is verified, for authJobs
+	challenge []byte
+
+	// the downstream agent which acked the job, when relaying
+	relay *jobSession
+
+	timer *time.Timer
+}
+
+func newAgentJobs() *agentJobs {
+	return &agentJobs{jobs: make(map[uint64]*agentJob)}
+}
+
+// serveRequest replies CTL_JOB and CTL_JOB_AUTH from server
+func (t *agentJobs) serveRequest(ctl *ctlConn, m ctlMsg) {
+	tlvs, err := t.request(m)
+	if err != nil {
+		tlvs = map[byte][]byte{TLV_JOB_ERROR: []byte(err.Error())}
+	}
+	ctl.Reply(m, tlvs)
+}
+
+func (t *agentJobs) request(m ctlMsg) (map[byte][]byte, error) {
+	idb, route := m.TLVs[TLV_JOB_ID], m.TLVs[TLV_JOB_ROUTE]
+	if len(idb) != 8 || len(route)%8 != 0 {
+		return nil, errJobMsg
+	}
+	id := binary.BigEndian.Uint64(idb)
+
+	if len(route) > 0 {
+		return t.forward(id, m, route)
+	}
+
+	switch m.Type {
+	case CTL_JOB:
+		typ := m.TLVs[TLV_JOB_TYPE]
+		if len(typ) != 1 {
+			return nil, errJobMsg
+		}
+		if _, ok := jobHandlers[typ[0]]; !ok && typ[0] != JOB_SOCKS {
+			return nil, errJobType
+		}
+
+		j := &agentJob{
+			typ:     typ[0],
+			payload: m.TLVs[TLV_JOB_PAYLOAD],
+		}
+		reply := make(map[byte][]byte)
+		if authJobs[j.typ] {
+			if crypto.SECRET_KEY == nil {
+				return nil, errJobNoKey
+			}
+			j.challenge = make([]byte, 32)
+			if _, err := rand.Read(j.challenge); err != nil {
+				return nil, err
+			}
+			reply[TLV_JOB_CHALLENGE] = j.challenge
+		}
+
+		return reply, t.add(id, j)
+	case CTL_JOB_AUTH:
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		j, ok := t.jobs[id]
+		if !ok || j.challenge == nil {
+			return nil, errJobMsg
+		}
+		if !hmac.Equal(m.TLVs[TLV_JOB_MAC], jobMAC(j.challenge, j.typ, j.payload)) {
+			j.timer.Stop()
+			delete(t.jobs, id)
+			logger.Warn("Job 0x%x from server rejected: %s", j.typ, errJobAuth.Error())
+			return nil, errJobAuth
+		}
+
+		j.challenge = nil
+		return nil, nil
+	default:
+		return nil, errJobMsg
+	}
+}
+
+// forward passes the request to the downstream agent of the first hop. Once
+// it acked CTL_JOB, the job stream of the same ID is connected to it
+func (t *agentJobs) forward(id uint64, m ctlMsg, route []byte) (map[byte][]byte, error) {
+	jobSessionsMu.Lock()
+	s, ok := jobSessions[binary.BigEndian.Uint64(route)]
+	jobSessionsMu.Unlock()
+	if !ok {
+		return nil, errJobAgent
+	}
+
+	tlvs := make(map[byte][]byte, len(m.TLVs))
+	for tag, v := range m.TLVs {
+		tlvs[tag] = v
+	}
+	if len(route) > 8 {
+		tlvs[TLV_JOB_ROUTE] = route[8:]
+	} else {
+		delete(tlvs, TLV_JOB_ROUTE)
+	}
+
+	reply, err := jobRequest(s.ctl, m.Type, tlvs)
+	if err != nil {
+		return nil, err
+	}
+	if m.Type == CTL_JOB {
+		return reply.TLVs, t.add(id, &agentJob{relay: &s})
+	}
+	return reply.TLVs, nil
+}
+
+func (t *agentJobs) add(id uint64, j *agentJob) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.jobs) >= MAX_CONNECTION {
+		return errJobBusy
+	}
+	if old, ok := t.jobs[id]; ok {
+		old.timer.Stop()
+	}
+
+	j.timer = time.AfterFunc(time.Duration(option.TIMEOUT)*time.Millisecond, func() {
+		t.mu.Lock()
+		if t.jobs[id] == j {
+			delete(t.jobs, id)
+		}
+		t.mu.Unlock()
+	})
+	t.jobs[id] = j
+	return nil
+}
+
+// take returns the job of the stream, nil if it's unknown or not authenticated
+func (t *agentJobs) take(id uint64) *agentJob {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	j, ok := t.jobs[id]
+	if !ok {
+		return nil
+	}
+	j.timer.Stop()
+	delete(t.jobs, id)
+
+	if j.challenge != nil {
+		return nil
+	}
+	return j
+}
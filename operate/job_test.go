@@ -0,0 +1,222 @@
+package operate
+
+import (
+	"context"
+	"encoding/json"
+	"iox/crypto"
+	"testing"
+
+	"github.com/xtaci/smux"
+)
+
+// served by the test agents only
+const jobEcho = 0x7F
+
+// handleEcho streams the payload back, then returns the data from server
+func handleEcho(ctx context.Context, payload []byte, s *jobStream) (interface{}, error) {
+	if err := s.Send(rawMsg(payload)); err != nil {
+		return nil, err
+	}
+	data, err := s.Recv()
+	if err != nil {
+		return nil, err
+	}
+	return rawMsg(data), nil
+}
+
+func init() {
+	jobHandlers[jobEcho] = handleEcho
+}
+
+// ctlPair opens the ctl stream of server, whose replies are read in background
+func ctlPair(t *testing.T, server, agent *smux.Session) (*ctlConn, *ctlConn) {
+	stream, err := server.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := agent.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverCtl := newCtlConn(stream, PROTOCOL_VERSION)
+	agentCtl := newCtlConn(accepted, PROTOCOL_VERSION)
+	go func() {
+		for {
+			m, err := serverCtl.Recv()
+			if err != nil {
+				return
+			}
+			serverCtl.Unsupported(m)
+		}
+	}()
+	return serverCtl, agentCtl
+}
+
+// jobAgent serves the jobs of server as agent with the ID, like serveAgent
+func jobAgent(t *testing.T, agentID uint64) *smux.Session {
+	server, agent := smuxPair(t, PROTOCOL_VERSION)
+	serverCtl, agentCtl := ctlPair(t, server, agent)
+	addJobSession(agentID, server, serverCtl, false)
+
+	jobs := newAgentJobs()
+	go serveStreams(agent, false, nil, newStreamLimit(), jobs)
+	go func() {
+		for {
+			m, err := agentCtl.Recv()
+			if err != nil {
+				return
+			}
+			switch m.Type {
+			case CTL_JOB, CTL_JOB_AUTH:
+				go jobs.serveRequest(agentCtl, m)
+			default:
+				agentCtl.Unsupported(m)
+			}
+		}
+	}()
+	return server
+}
+
+func echoJob(t *testing.T, agentID uint64) {
+	j, err := startJob(context.Background(), agentID, jobEcho, "ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	payload, err := j.Recv()
+	if err != nil || string(payload) != `"ping"` {
+		t.Fatalf("Job data %q, %v", payload, err)
+	}
+	if err = j.Send("pong"); err != nil {
+		t.Fatal(err)
+	}
+
+	var result string
+	if err = j.Wait(nil, &result); err != nil || result != "pong" {
+		t.Fatalf("Job result %q, %v", result, err)
+	}
+}
+
+func TestJobCtl(t *testing.T) {
+	session := jobAgent(t, 1001)
+	defer session.Close()
+	defer removeJobSession(1001)
+
+	echoJob(t, 1001)
+
+	var nodes []agentNode
+	if err := runJob(context.Background(), 1001, JOB_AGENTS, nil, nil, &nodes); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := startJob(context.Background(), 1001, 0x7E, nil)
+	if err == nil || err.Error() != errJobType.Error() {
+		t.Fatalf("Unknown job got %v", err)
+	}
+}
+
+func TestJobAuth(t *testing.T) {
+	session := jobAgent(t, 1002)
+	defer session.Close()
+	defer removeJobSession(1002)
+
+	authJobs[jobEcho] = true
+	key := crypto.SECRET_KEY
+	defer func() {
+		delete(authJobs, jobEcho)
+		crypto.SECRET_KEY = key
+	}()
+
+	crypto.SECRET_KEY = nil
+	if _, err := startJob(context.Background(), 1002, jobEcho, "ping"); err != errJobNoKey {
+		t.Fatalf("Job without key got %v", err)
+	}
+
+	crypto.SECRET_KEY = []byte("iox job test key")
+	echoJob(t, 1002)
+
+	jobSessionsMu.Lock()
+	s := jobSessions[1002]
+	jobSessionsMu.Unlock()
+
+	tlvs := jobTLVs(1, nil)
+	tlvs[TLV_JOB_TYPE] = []byte{jobEcho}
+	tlvs[TLV_JOB_PAYLOAD] = []byte(`"ping"`)
+	if _, err := jobRequest(s.ctl, CTL_JOB, tlvs); err != nil {
+		t.Fatal(err)
+	}
+
+	tlvs = jobTLVs(1, nil)
+	tlvs[TLV_JOB_MAC] = make([]byte, 32)
+	_, err := jobRequest(s.ctl, CTL_JOB_AUTH, tlvs)
+	if err == nil || err.Error() != errJobAuth.Error() {
+		t.Fatalf("Wrong MAC got %v", err)
+	}
+
+	// the rejected job isn't served
+	stream, err := openStream(s.session, STREAM_JOB, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if _, _, err = readJobMsg(stream); err == nil {
+		t.Fatal("Rejected job got a stream")
+	}
+}
+
+// The job of agent 1005 relayed by 1004, which is relayed by 1003
+func TestJobRelay(t *testing.T) {
+	root := jobAgent(t, 1003)
+	defer root.Close()
+	defer removeJobSession(1003)
+	child := jobAgent(t, 1004)
+	defer child.Close()
+	defer removeJobSession(1004)
+	leaf := jobAgent(t, 1005)
+	defer leaf.Close()
+	defer removeJobSession(1005)
+
+	jobSessionsMu.Lock()
+	relayRoutes[1006] = relayRoute{1003, []uint64{1004, 1005}}
+	relayRoutes[1007] = relayRoute{1003, []uint64{1008}}
+	jobSessionsMu.Unlock()
+	defer func() {
+		jobSessionsMu.Lock()
+		delete(relayRoutes, 1006)
+		delete(relayRoutes, 1007)
+		jobSessionsMu.Unlock()
+	}()
+
+	echoJob(t, 1006)
+
+	_, err := startJob(context.Background(), 1007, jobEcho, "ping")
+	if err == nil || err.Error() != errJobAgent.Error() {
+		t.Fatalf("Job of unknown hop got %v", err)
+	}
+}
+
+func TestJobUnsupported(t *testing.T) {
+	server, agent := smuxPair(t, 3)
+	defer server.Close()
+	serverCtl, agentCtl := ctlPair(t, server, agent)
+	addJobSession(1009, server, serverCtl, false)
+	defer removeJobSession(1009)
+
+	// agents before jobs reply CTL_UNSUPPORTED
+	go func() {
+		for {
+			m, err := agentCtl.Recv()
+			if err != nil {
+				return
+			}
+			agentCtl.Unsupported(m)
+		}
+	}()
+
+	var result json.RawMessage
+	if err := runJob(context.Background(), 1009, jobEcho, nil, nil, &result); err != errJobUnsupported {
+		t.Fatalf("Job of older agent got %v", err)
+	}
+}
@@ -0,0 +1,26 @@
+package operate
+
+import (
+	"iox/logger"
+	"iox/metrics"
+	"strconv"
+)
+
+// ServeMetrics exposes /metrics on the address, it should be called in a new
+// goroutine. A bare PORT listens on loopback, and like other listeners it
+// takes the allowlist and connection limits
+func ServeMetrics(address string) {
+	if _, err := strconv.Atoi(address); err == nil {
+		address = "127.0.0.1:" + address
+	}
+
+	listener, err := listen(address)
+	if err != nil {
+		logger.Error("Metrics listen on %s error: %s", address, err.Error())
+		return
+	}
+
+	if err = metrics.Serve(listener); err != nil && !isShuttingDown() {
+		logger.Warn("Metrics endpoint error: %s", err.Error())
+	}
+}
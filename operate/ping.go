@@ -0,0 +1,243 @@
+package operate
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"iox/netio"
+	"iox/option"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	ICMP_ECHO_REPLY   = 0
+	ICMP_ECHO_REQUEST = 8
+)
+
+var errPingIPv6 = errors.New("Only IPv4 targets can be pinged")
+
+// PingRequest is the JOB_PING payload, targets are IP, CIDR or domain
+type PingRequest struct {
+	Targets []string `json:"targets"`
+
+	// echo requests sent to each target at most, until one is replied
+	Count int `json:"count"`
+
+	// wait for each echo reply, millisecond
+	Timeout int `json:"timeout"`
+}
+
+type PingResult struct {
+	Target string  `json:"target"`
+	IP     string  `json:"ip,omitempty"`
+	Alive  bool    `json:"alive"`
+	RTT    float64 `json:"rtt_ms,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// Ping asks the agent to send ICMP echo to the targets
+func Ping(ctx context.Context, agentID uint64, req PingRequest) ([]PingResult, error) {
+	var results []PingResult
+	err := runJob(ctx, agentID, JOB_PING, req, nil, &results)
+	return results, err
+}
+
+type pingWaiter struct {
+	ip    net.IP
+	reply chan time.Time
+}
+
+// pinger sends echo requests on one socket, replies are matched by sequence
+type pinger struct {
+	conn net.PacketConn
+	raw  bool
+	id   uint16
+
+	mu      sync.Mutex
+	seq     uint16
+	waiters map[uint16]pingWaiter
+}
+
+func handlePing(ctx context.Context, payload []byte, s *jobStream) (interface{}, error) {
+	var req PingRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+	if req.Count < 1 {
+		req.Count = 1
+	}
+	if req.Timeout < 1 {
+		req.Timeout = option.TIMEOUT
+	}
+
+	targets, err := expandTargets(req.Targets, option.PING_MAX_TARGETS)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, raw, err := netio.ListenICMP()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	p := &pinger{
+		conn:    conn,
+		raw:     raw,
+		id:      uint16(rand.Intn(0x10000)),
+		waiters: make(map[uint16]pingWaiter),
+	}
+	go p.readReplies()
+
+	timeout := time.Duration(req.Timeout) * time.Millisecond
+	results := make([]PingResult, len(targets))
+	sem := make(chan struct{}, option.PING_CONCURRENCY)
+	wg := sync.WaitGroup{}
+
+	for i, target := range targets {
+		if ctx.Err() != nil {
+			break
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(r *PingResult, target string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			r.Target = target
+			p.probe(r, req.Count, timeout)
+		}(&results[i], target)
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+// Resolve the target to the first IPv4 address, r.IP or r.Error is set
+func resolvePingTarget(r *PingResult) net.IP {
+	ips, err := netio.Resolve(r.Target)
+	if err != nil {
+		r.Error = err.Error()
+		return nil
+	}
+
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			r.IP = ip.String()
+			return ip.To4()
+		}
+	}
+	r.Error = errPingIPv6.Error()
+	return nil
+}
+
+// Send echo requests until one is replied, r.Alive and r.RTT are set then
+func (p *pinger) probe(r *PingResult, count int, timeout time.Duration) {
+	ip := resolvePingTarget(r)
+	if ip == nil {
+		return
+	}
+
+	for i := 0; i < count; i++ {
+		w := pingWaiter{ip: ip, reply: make(chan time.Time, 1)}
+
+		p.mu.Lock()
+		p.seq++
+		seq := p.seq
+		p.waiters[seq] = w
+		p.mu.Unlock()
+
+		start := time.Now()
+		_, err := p.conn.WriteTo(icmpEcho(p.id, seq), netio.ICMPAddr(ip, p.raw))
+		if err == nil {
+			select {
+			case end := <-w.reply:
+				r.Alive = true
+				r.RTT = float64(end.Sub(start).Microseconds()) / 1000
+			case <-time.After(timeout):
+			}
+		}
+
+		p.mu.Lock()
+		delete(p.waiters, seq)
+		p.mu.Unlock()
+
+		if err != nil {
+			r.Error = err.Error()
+			return
+		}
+		if r.Alive {
+			return
+		}
+	}
+}
+
+// Returns when the socket is closed
+func (p *pinger) readReplies() {
+	buf := make([]byte, 0x10000)
+
+	for {
+		n, addr, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		end := time.Now()
+
+		b := buf[:n]
+		// ping socket on darwin keeps the IP header
+		if len(b) >= 20 && b[0]>>4 == 4 {
+			b = b[int(b[0]&0x0F)*4:]
+		}
+		if len(b) < 8 || b[0] != ICMP_ECHO_REPLY {
+			continue
+		}
+		if p.raw && binary.BigEndian.Uint16(b[4:]) != p.id {
+			continue
+		}
+
+		var ip net.IP
+		switch a := addr.(type) {
+		case *net.IPAddr:
+			ip = a.IP
+		case *net.UDPAddr:
+			ip = a.IP
+		}
+
+		seq := binary.BigEndian.Uint16(b[6:])
+		p.mu.Lock()
+		w, ok := p.waiters[seq]
+		p.mu.Unlock()
+
+		if ok && w.ip.Equal(ip) {
+			select {
+			case w.reply <- end:
+			default:
+			}
+		}
+	}
+}
+
+func icmpEcho(id uint16, seq uint16) []byte {
+	b := make([]byte, 16)
+	b[0] = ICMP_ECHO_REQUEST
+	binary.BigEndian.PutUint16(b[4:], id)
+	binary.BigEndian.PutUint16(b[6:], seq)
+	copy(b[8:], "iox-ping")
+
+	var s uint32
+	for i := 0; i < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	for s>>16 != 0 {
+		s = s&0xFFFF + s>>16
+	}
+	binary.BigEndian.PutUint16(b[2:], ^uint16(s))
+	return b
+}
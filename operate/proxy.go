@@ -3,24 +3,33 @@ package operate
 import (
 	"iox/logger"
 	"iox/netio"
+	"iox/option"
 	"iox/socks5"
 	"net"
 	"os"
-	"os/signal"
+
+	"github.com/xtaci/smux"
 )
 
 func ProxyLocal(local string, encrypted bool) {
-	listener, err := net.Listen("tcp", local)
+	listener, err := listen(local)
 	if err != nil {
-		logger.Warn("Socks5 listen on %s error: %s", local, err.Error())
+		logger.Error("Socks5 listen on %s error: %s", local, err.Error())
 		return
 	}
+	defer listener.Close()
+
+	tunnel := netio.AddTunnel("proxy-local", local, "", encrypted, false)
+	defer tunnel.Remove()
 
-	logger.Success("Start socks5 server on %s (encrypted: %v)", local, encrypted)
+	logger.Info("Start socks5 server on %s (encrypted: %v)", local, encrypted)
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if isShuttingDown() {
+				return
+			}
 			logger.Warn("Socks5 handle local connect error: %s", err.Error())
 			continue
 		}
@@ -32,58 +41,99 @@ func ProxyLocal(local string, encrypted bool) {
 				return
 			}
 
-			socks5.HandleConnection(connCtx)
+			socks5.HandleConnection(tunnel, connCtx)
 		}()
 	}
 }
 
 func ProxyRemote(remote string, encrypted bool) {
-	session, ctlStream, err := clientHandshake(remote)
+	session, ctl, err := dialHandshake(remote, clientHandshake)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	defer session.Close()
+
+	logger.Info("Remote socks5 handshake ok (encrypted: %v)", encrypted)
+
+	tunnel := netio.AddTunnel("proxy-remote", remote, "", encrypted, false)
+	defer tunnel.Remove()
+
+	serveAgent(session, ctl, tunnel, encrypted)
+}
+
+// ProxyBind is the agent listening for server, for the host which can be
+// reached but can't reach out
+func ProxyBind(local string, encrypted bool) {
+	listener, err := listen(local)
+	if err != nil {
+		logger.Error("Listen on %s error", local)
+		return
+	}
+
+	logger.Info("Wait for reverse socks5 server on %s (encrypted: %v)", local, encrypted)
+
+	// only one server is served, like dialing out
+	session, ctl, err := acceptHandshake(listener, clientHandshake)
+	listener.Close()
 	if err != nil {
-		logger.Warn(err.Error())
+		// only when shutting down
 		return
 	}
 	defer session.Close()
 
-	logger.Success("Remote socks5 handshake ok (encrypted: %v)", encrypted)
+	logger.Info("Bind socks5 handshake ok from %s (encrypted: %v)", session.RemoteAddr().String(), encrypted)
+
+	tunnel := netio.AddTunnel("proxy-bind", local, "", encrypted, false)
+	defer tunnel.Remove()
+
+	serveAgent(session, ctl, tunnel, encrypted)
+}
+
+// serveAgent makes the socks5 connections asked by server, no matter who
+// connected the session
+func serveAgent(session *smux.Session, ctl *ctlConn, tunnel *netio.Tunnel, encrypted bool) {
+	limit := newStreamLimit()
+	jobs := newAgentJobs()
+	go serveStreams(session, encrypted, tunnel, limit, jobs)
+
+	if option.RELAY != "" {
+		go serveRelay(option.RELAY, option.RELAY_ENC, func() {
+			ctl.Send(CTL_AGENTS_CHANGED, 0)
+		})
+	}
 
 	connectRequest := make(chan uint8, MAX_CONNECTION)
 	defer close(connectRequest)
 	endSignal := make(chan struct{})
 
-	// handle ctrl+C
-	{
-		sigs := make(chan os.Signal)
-		signal.Notify(sigs, os.Interrupt)
-		go func() {
-			<-sigs
-			ctlStream.Write(marshal(Protocol{
-				CMD: CTL_CLEANUP,
-				N:   0,
-			}))
-			logger.Success("Recv Ctrl+C, exit now")
-			os.Exit(0)
-		}()
-	}
+	// notify remote when shutting down, unless remote asked for it
+	ctl.cleanupOnShutdown()
 
 	// handle ctl stream
 	go func() {
-		defer ctlStream.Close()
+		defer ctl.Close()
 
 		for {
-			pb, err := readUntilEnd(ctlStream)
+			m, err := ctl.Recv()
 			if err != nil {
-				logger.Warn("Control connection has been closed, exit now")
+				if isShuttingDown() {
+					return
+				}
+				logger.Error("Control connection has been closed, exit now")
 				os.Exit(-1)
 			}
 
-			p := unmarshal(pb)
-			switch p.CMD {
+			switch m.Type {
 			case CTL_CONNECT_ME:
-				connectRequest <- p.N
+				connectRequest <- m.n()
+			case CTL_JOB, CTL_JOB_AUTH:
+				go jobs.serveRequest(ctl, m)
 			case CTL_CLEANUP:
 				endSignal <- struct{}{}
 				return
+			default:
+				ctl.Unsupported(m)
 			}
 		}
 	}()
@@ -92,24 +142,32 @@ func ProxyRemote(remote string, encrypted bool) {
 	for {
 		select {
 		case <-endSignal:
-			logger.Success("Recv exit signal from remote, exit now")
-			return
+			logger.Info("Recv exit signal from remote, shutting down")
+			shutdown(0)
 		case n := <-connectRequest:
+			if isShuttingDown() {
+				continue
+			}
 			for n > 0 {
 				go func() {
 					stream, err := session.OpenStream()
 					if err != nil {
-						logger.Info(err.Error())
+						logger.Debug(err.Error())
 						return
 					}
 					defer stream.Close()
 
+					if !limit.acquire() {
+						return
+					}
+					defer limit.release()
+
 					connCtx, err := netio.NewTCPCtx(stream, encrypted)
 					if err != nil {
 						return
 					}
 
-					socks5.HandleConnection(connCtx)
+					socks5.HandleConnection(tunnel, connCtx)
 				}()
 				n--
 			}
@@ -118,65 +176,166 @@ func ProxyRemote(remote string, encrypted bool) {
 }
 
 func ProxyRemoteL2L(control string, local string, cenc bool, lenc bool) {
-	masterListener, err := net.Listen("tcp", control)
+	masterListener, err := listen(control)
 	if err != nil {
-		logger.Warn("Listen on %s error", control)
+		logger.Error("Listen on %s error", control)
 		return
 	}
 	defer masterListener.Close()
 
-	logger.Info("Listen on %s for reverse socks5", control)
+	logger.Debug("Listen on %s for reverse socks5", control)
 
-	localListener, err := net.Listen("tcp", local)
+	localListener, err := listen(local)
 	if err != nil {
-		logger.Warn("Listen on %s error", local)
+		logger.Error("Listen on %s error", local)
 		return
 	}
 	defer localListener.Close()
 
-	session, ctlStream, err := serverHandshake(masterListener)
+	session, ctl, err := acceptHandshake(masterListener, serverHandshake)
 	if err != nil {
-		logger.Warn(err.Error())
+		// only when shutting down
 		return
 	}
 	defer session.Close()
-	defer ctlStream.Close()
+	defer ctl.Close()
 
-	logger.Success("Reverse socks5 server handshake ok from %s (encrypted: %v)", session.RemoteAddr().String(), cenc)
-	logger.Success("Socks5 server is listening on %s (encrypted: %v)", local, lenc)
+	logger.Info("Reverse socks5 server handshake ok from %s (encrypted: %v)", session.RemoteAddr().String(), cenc)
+	logger.Info("Socks5 server is listening on %s (encrypted: %v)", local, lenc)
 
-	// handle ctrl+C
-	{
-		sigs := make(chan os.Signal)
-		signal.Notify(sigs, os.Interrupt)
-		go func() {
-			<-sigs
-			ctlStream.Write(marshal(Protocol{
-				CMD: CTL_CLEANUP,
-				N:   0,
-			}))
-			logger.Success("Recv Ctrl+C, exit now")
-			os.Exit(0)
-		}()
+	tunnel := netio.AddTunnel("proxy-server", control, local, cenc, lenc)
+	defer tunnel.Remove()
+
+	serveServer(session, ctl, tunnel, localListener, cenc, lenc)
+}
+
+// ProxyBindL2R connects the agent listening on remote, then serves socks5
+// clients on local the same as ProxyRemoteL2L
+func ProxyBindL2R(local string, remote string, lenc bool, renc bool) {
+	localListener, err := listen(local)
+	if err != nil {
+		logger.Error("Listen on %s error", local)
+		return
 	}
+	defer localListener.Close()
 
-	localConnBuffer := make(chan net.Conn, MAX_CONNECTION)
-	defer close(localConnBuffer)
+	session, ctl, err := dialHandshake(remote, serverHandshake)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	defer session.Close()
+	defer ctl.Close()
+
+	logger.Info("Bind socks5 server handshake ok to %s (encrypted: %v)", remote, renc)
+	logger.Info("Socks5 server is listening on %s (encrypted: %v)", local, lenc)
+
+	tunnel := netio.AddTunnel("proxy-bind-server", remote, local, renc, lenc)
+	defer tunnel.Remove()
+
+	serveServer(session, ctl, tunnel, localListener, renc, lenc)
+}
+
+// serveServer serves socks5 clients on localListener by the agent of
+// session, until the session is closed
+func serveServer(session *smux.Session, ctl *ctlConn, tunnel *netio.Tunnel, localListener net.Listener, cenc bool, lenc bool) {
+	agent := netio.AddAgent(session.RemoteAddr().String(), cenc, session)
+	defer agent.Remove()
+
+	addJobSession(agent.ID, session, ctl, cenc)
+	defer removeJobSession(agent.ID)
+
+	defer closeRoutes(agent.ID)
+	defer removeRelayed(agent)
+
+	// notify remote when shutting down, unless remote asked for it
+	ctl.cleanupOnShutdown()
+
+	// handlers of the streams opened by remote, in the order of CONNECT_ME
+	streamHandlers := make(chan func(net.Conn), MAX_CONNECTION)
+	version := sessionVersion(session)
+
+	// the socks5 connection to remote, the request is written by handler.
+	// It's decrypted here even if FORWARD_WITHOUT_DEC, as server reads the
+	// requests of clients and agents since protocol 5 read their addresses first
+	serve := func(client net.Addr, handler func(netio.Ctx)) func(net.Conn) {
+		return func(conn net.Conn) {
+			connCtx, err := netio.NewEndpointTCPCtx(conn, cenc)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			if version >= 5 {
+				if err = writeClientAddr(connCtx, client); err != nil {
+					conn.Close()
+					return
+				}
+			}
+			handler(connCtx)
+		}
+	}
+
+	// open a socks5 stream to remote for the client, which will be passed to
+	// the handler. Agents before protocol 2 are asked to open it by CONNECT_ME
+	connect := func(client net.Addr, handler func(netio.Ctx)) error {
+		if version >= 4 {
+			id := netio.NextID()
+			conn, err := openDuplex(session, id)
+			if err != nil {
+				return err
+			}
+			logger.Debug("Socks5 stream #%d to agent", id)
+
+			go serve(client, handler)(conn)
+			return nil
+		}
+
+		if version >= 2 {
+			id := netio.NextID()
+			stream, err := openStream(session, STREAM_SOCKS, id)
+			if err != nil {
+				return err
+			}
+			logger.Debug("Socks5 stream #%d to agent", id)
+
+			go serve(client, handler)(stream)
+			return nil
+		}
+
+		streamHandlers <- serve(client, handler)
+
+		if err := ctl.Send(CTL_CONNECT_ME, 1); err != nil {
+			logger.Error("Control connection has been closed, exit now")
+			os.Exit(-1)
+		}
+		return nil
+	}
+
+	if option.TUN_DEVICE != "" {
+		go serveTUN(tunnel, connect)
+	}
 
 	// handle ctl stream read
 	go func() {
 		for {
-			pb, err := readUntilEnd(ctlStream)
+			m, err := ctl.Recv()
 			if err != nil {
-				logger.Warn("Control connection has been closed, exit now")
+				if isShuttingDown() {
+					return
+				}
+				logger.Error("Control connection has been closed, exit now")
 				os.Exit(-1)
 			}
 
-			p := unmarshal(pb)
-			switch p.CMD {
+			switch m.Type {
+			case CTL_AGENTS_CHANGED:
+				go syncRelayed(agent)
 			case CTL_CLEANUP:
-				logger.Success("Recv exit signal from remote, exit now")
-				os.Exit(0)
+				logger.Info("Recv exit signal from remote, shutting down")
+				go shutdown(0)
+				return
+			default:
+				ctl.Unsupported(m)
 			}
 		}
 	}()
@@ -186,18 +345,35 @@ func ProxyRemoteL2L(control string, local string, cenc bool, lenc bool) {
 		for {
 			localConn, err := localListener.Accept()
 			if err != nil {
+				if isShuttingDown() {
+					return
+				}
 				continue
 			}
 
-			localConnBuffer <- localConn
-
-			_, err = ctlStream.Write(marshal(Protocol{
-				CMD: CTL_CONNECT_ME,
-				N:   1,
-			}))
+			err = connect(localConn.RemoteAddr(), func(remoteConnCtx netio.Ctx) {
+				defer remoteConnCtx.Close()
+				defer localConn.Close()
+
+				localConnCtx, err := netio.NewEndpointTCPCtx(localConn, lenc)
+				if err != nil {
+					return
+				}
+
+				// the request is passed to remote here, so it's recorded
+				// as a socks5 one with the target
+				target, ok := socks5.Relay(localConnCtx, remoteConnCtx)
+				if !ok {
+					return
+				}
+
+				pipe := netio.NewPipe(tunnel, localConnCtx, remoteConnCtx)
+				pipe.Target = target
+				pipe.Forward()
+			})
 			if err != nil {
-				logger.Warn("Control connection has been closed, exit now")
-				os.Exit(-1)
+				logger.Debug("Open socks5 stream error: %s", err.Error())
+				localConn.Close()
 			}
 		}
 	}()
@@ -205,26 +381,19 @@ func ProxyRemoteL2L(control string, local string, cenc bool, lenc bool) {
 	for {
 		remoteStream, err := session.AcceptStream()
 		if err != nil {
-			continue
-		}
-
-		localConn := <-localConnBuffer
-
-		go func() {
-			defer remoteStream.Close()
-			defer localConn.Close()
-
-			remoteConnCtx, err := netio.NewTCPCtx(remoteStream, cenc)
-			if err != nil {
+			if session.IsClosed() {
 				return
 			}
+			continue
+		}
 
-			localConnCtx, err := netio.NewTCPCtx(localConn, lenc)
-			if err != nil {
-				return
-			}
+		// agents of protocol 2 open nothing
+		if version >= 2 {
+			remoteStream.Close()
+			continue
+		}
 
-			netio.PipeForward(remoteConnCtx, localConnCtx)
-		}()
+		handler := <-streamHandlers
+		go handler(remoteStream)
 	}
 }
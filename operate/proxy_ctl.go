@@ -1,9 +1,17 @@
 package operate
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
+	"iox/logger"
+	"iox/metrics"
+	"iox/netio"
 	"iox/option"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/xtaci/smux"
@@ -14,6 +22,18 @@ const (
 	CTL_CONNECT_ME
 	CTL_CLEANUP
 
+	// agents relayed by the sender changed, sync them by JOB_AGENTS
+	CTL_AGENTS_CHANGED
+
+	// since protocol 3, see ctlConn
+	CTL_REPLY
+	CTL_UNSUPPORTED
+	CTL_PING
+
+	// asked by server to start a job, see startJob
+	CTL_JOB
+	CTL_JOB_AUTH
+
 	MAX_CONNECTION   = 0x800
 	CLIENT_HANDSHAKE = 0xC0
 	SERVER_HANDSHAKE = 0xE0
@@ -28,6 +48,52 @@ type Protocol struct {
 
 var PROTO_END = []byte{0xEE, 0xFF}
 
+var (
+	sessionsMu sync.Mutex
+	// the protocol version agreed with peer of each session
+	sessions = make(map[*smux.Session]int)
+)
+
+func trackSession(session *smux.Session, version int) {
+	sessionsMu.Lock()
+	sessions[session] = version
+	sessionsMu.Unlock()
+}
+
+func sessionVersion(session *smux.Session) int {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	return sessions[session]
+}
+
+// Drop the closed sessions, then apply fn to the alive ones
+func aliveSessions(fn func(*smux.Session)) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+
+	for session := range sessions {
+		if session.IsClosed() {
+			delete(sessions, session)
+			continue
+		}
+		fn(session)
+	}
+}
+
+func init() {
+	metrics.NewGaugeFunc("iox_smux_sessions", "Open smux sessions", func() float64 {
+		n := 0
+		aliveSessions(func(*smux.Session) { n++ })
+		return float64(n)
+	})
+
+	metrics.NewGaugeFunc("iox_smux_streams", "Open smux streams of all sessions", func() float64 {
+		n := 0
+		aliveSessions(func(session *smux.Session) { n += session.NumStreams() })
+		return float64(n)
+	})
+}
+
 func marshal(p Protocol) []byte {
 	buf := make([]byte, 4)
 	buf[0] = p.CMD
@@ -78,93 +144,409 @@ func readUntilEnd(conn net.Conn) ([]byte, error) {
 	return output[:2], nil
 }
 
-func serverHandshake(listener net.Listener) (*smux.Session, *smux.Stream, error) {
-	var conn net.Conn
-	var session *smux.Session
-	var ctlStream *smux.Stream
-	var err error
+// Exchange CTL_CLEANUP with peer, send it when shutting down and shut down
+// when peer sent it. Returns when the ctl stream is closed
+func handleCtl(ctl *ctlConn) {
+	defer ctl.cleanupOnShutdown()()
 
 	for {
-		conn, err = listener.Accept()
+		m, err := ctl.Recv()
 		if err != nil {
-			continue
+			return
 		}
 
-		session, err = smux.Server(conn, &smux.Config{
-			Version:           2,
-			KeepAliveInterval: option.SMUX_KEEPALIVE_INTERVAL * time.Second,
-			KeepAliveTimeout:  option.SMUX_KEEPALIVE_TIMEOUT * time.Second,
-			MaxFrameSize:      option.SMUX_FRAMESIZE,
-			MaxReceiveBuffer:  option.SMUX_RECVBUFFER,
-			MaxStreamBuffer:   option.SMUX_STREAMBUFFER,
-		})
-		if err != nil {
-			return nil, nil, err
+		switch m.Type {
+		case CTL_CLEANUP:
+			logger.Info("Recv exit signal from remote, shutting down")
+			go shutdown(0)
+			return
+		default:
+			ctl.Unsupported(m)
 		}
+	}
+}
+
+var (
+	errHandshake = errors.New("Connect to remote forward server error")
+	errPreamble  = errors.New("Peer didn't send the smux preamble, it may be an older version")
+
+	// the peer we connected is expected to be iox, v0.4 reads the preamble
+	// as a smux frame and drops the session
+	errLegacyPeer = mismatchError("Peer didn't reply the preamble, it may be iox v0.4 or before, which this version can't connect to. Upgrade it")
+)
+
+// Before smux starts, client sends the preamble and server replies its own:
+// "IOX", protocol version, smux version, keepalive interval and timeout in
+// seconds (2 bytes each). Both sides check the peer's smux settings, so a
+// mismatch fails the handshake rather than stalling or dropping the session
+// later. The lower protocol version of both sides is used
+var PREAMBLE_MAGIC = []byte("IOX")
+
+const (
+	PREAMBLE_SIZE = 9
+
+	// 1: agent opens the socks5 streams on CTL_CONNECT_ME. Agents of v0.4
+	//    start smux without the preamble, see legacyPreamble
+	// 2: server opens the streams with STREAM_* header
+	// 3: control messages with request ID and TLVs
+	// 4: socks5 connection is a pair of streams for half-close, see duplexStream
+	// 5: socks5 connection starts with the client address, see writeClientAddr
+	PROTOCOL_VERSION = 5
+)
+
+type preamble struct {
+	version     int
+	smuxVersion int
+	interval    int
+	timeout     int
+}
+
+// Streams opened by server start with the header in plain, so the cipher
+// of the data after it is untouched: kind, then 8 bytes connection ID for
+// STREAM_SOCKS* which is logged by both sides
+const (
+	STREAM_JOB = iota + 1
+	STREAM_SOCKS
+
+	// since protocol 4, the pair of the same ID is one socks5 connection
+	STREAM_SOCKS_UP
+	STREAM_SOCKS_DOWN
+
+	STREAM_HEADER_SIZE = 9
+)
+
+func smuxConfig() *smux.Config {
+	return &smux.Config{
+		Version:           option.SMUX_VERSION,
+		KeepAliveInterval: time.Duration(option.SMUX_KEEPALIVE_INTERVAL) * time.Second,
+		KeepAliveTimeout:  time.Duration(option.SMUX_KEEPALIVE_TIMEOUT) * time.Second,
+		MaxFrameSize:      option.SMUX_FRAMESIZE,
+		MaxReceiveBuffer:  option.SMUX_RECVBUFFER,
+		MaxStreamBuffer:   option.SMUX_STREAMBUFFER,
+	}
+}
+
+func writePreamble(conn net.Conn) error {
+	b := make([]byte, PREAMBLE_SIZE)
+	copy(b, PREAMBLE_MAGIC)
+	b[3] = PROTOCOL_VERSION
+	b[4] = byte(option.SMUX_VERSION)
+	binary.BigEndian.PutUint16(b[5:], uint16(option.SMUX_KEEPALIVE_INTERVAL))
+	binary.BigEndian.PutUint16(b[7:], uint16(option.SMUX_KEEPALIVE_TIMEOUT))
+
+	_, err := conn.Write(b)
+	return err
+}
+
+// readPreamble returns the preamble of peer and the conn to read after it.
+// An agent of v0.4 starts smux without preamble, its first frame is the SYN
+// of ctl stream. It's taken as protocol 1 then, and the frame is kept in conn
+func readPreamble(conn net.Conn) (preamble, net.Conn, error) {
+	b := make([]byte, PREAMBLE_SIZE)
+	if _, err := io.ReadFull(conn, b[:SMUX_HEADER_SIZE]); err != nil {
+		return preamble{}, nil, errPreamble
+	}
+	if isSmuxSYN(b) {
+		return legacyPreamble(int(b[0])), &replayConn{
+			Conn: conn,
+			r:    io.MultiReader(bytes.NewReader(b[:SMUX_HEADER_SIZE]), conn),
+		}, nil
+	}
+
+	if _, err := io.ReadFull(conn, b[SMUX_HEADER_SIZE:]); err != nil || !bytesEq(b[:3], PREAMBLE_MAGIC) || b[3] == 0 {
+		return preamble{}, nil, errPreamble
+	}
+
+	return preamble{
+		version:     int(b[3]),
+		smuxVersion: int(b[4]),
+		interval:    int(binary.BigEndian.Uint16(b[5:])),
+		timeout:     int(binary.BigEndian.Uint16(b[7:])),
+	}, conn, nil
+}
+
+// Header of smux frame: version, cmd, length and stream ID in little endian
+const (
+	SMUX_HEADER_SIZE = 8
+	SMUX_CMD_SYN     = 0
+)
+
+func isSmuxSYN(b []byte) bool {
+	return (b[0] == 1 || b[0] == 2) && b[1] == SMUX_CMD_SYN && b[2] == 0 && b[3] == 0
+}
+
+// The settings of v0.4, which were fixed
+func legacyPreamble(smuxVersion int) preamble {
+	return preamble{
+		version:     1,
+		smuxVersion: smuxVersion,
+		interval:    20,
+		timeout:     60,
+	}
+}
+
+// replayConn reads the bytes read ahead first
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// mismatchError is the peer speaking iox with other settings, rather than a
+// stray connection, so it's worth a warning
+type mismatchError string
+
+func (e mismatchError) Error() string {
+	return string(e)
+}
+
+// Each side sends keepalive by its interval, so it must be less than the
+// timeout of the other side
+func checkPreamble(p preamble) error {
+	if p.smuxVersion != option.SMUX_VERSION {
+		return mismatchError(fmt.Sprintf("Smux version mismatch, local %d, remote %d. Set the same `--smux-version` on both sides",
+			option.SMUX_VERSION, p.smuxVersion))
+	}
+
+	if p.interval >= option.SMUX_KEEPALIVE_TIMEOUT || option.SMUX_KEEPALIVE_INTERVAL >= p.timeout {
+		return mismatchError(fmt.Sprintf("Smux keepalive mismatch, local %ds/%ds, remote %ds/%ds. Each side's interval must be less than the other's timeout",
+			option.SMUX_KEEPALIVE_INTERVAL, option.SMUX_KEEPALIVE_TIMEOUT, p.interval, p.timeout))
+	}
+	return nil
+}
+
+func (p preamble) agreedVersion() int {
+	if p.version < PROTOCOL_VERSION {
+		return p.version
+	}
+	return PROTOCOL_VERSION
+}
+
+// openStream opens the stream to agent, with the header if agent knows it
+func openStream(session *smux.Session, kind byte, id uint64) (*smux.Stream, error) {
+	stream, err := session.OpenStream()
+	if err != nil || sessionVersion(session) < 2 {
+		return stream, err
+	}
+
+	header := make([]byte, STREAM_HEADER_SIZE)
+	header[0] = kind
+	binary.BigEndian.PutUint64(header[1:], id)
+	if _, err = stream.Write(header); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// The address of socks5 client, passed from server to agent
+type clientAddr string
+
+func (a clientAddr) Network() string {
+	return "tcp"
+}
+
+func (a clientAddr) String() string {
+	return string(a)
+}
+
+// A socks5 connection from server starts with the address of its client,
+// 1 byte length then the string, inside the cipher unlike the header
+func writeClientAddr(ctx netio.Ctx, addr net.Addr) error {
+	s := addr.String()
+	if len(s) > 0xFF {
+		s = ""
+	}
+
+	_, err := ctx.EncryptWrite(append([]byte{byte(len(s))}, s...))
+	return err
+}
+
+func readClientAddr(ctx netio.Ctx) (net.Addr, error) {
+	r := ctxReader{ctx}
+
+	size := make([]byte, 1)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return nil, err
+	}
+	addr := make([]byte, size[0])
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return nil, err
+	}
+	return clientAddr(addr), nil
+}
+
+// Ctx of the socks5 connection from server, whose RemoteAddr is the client
+// of server rather than the session, so the records of agent show it
+type clientCtx struct {
+	*netio.TCPCtx
+	client net.Addr
+}
 
-		ctlStream, err = session.AcceptStream()
+func (c clientCtx) RemoteAddr() net.Addr {
+	return c.client
+}
+
+// The client may be unknown, then ctx is kept
+func withClient(ctx *netio.TCPCtx, client net.Addr) netio.Ctx {
+	if client.String() == "" {
+		return ctx
+	}
+	return clientCtx{TCPCtx: ctx, client: client}
+}
+
+func readStreamHeader(stream *smux.Stream) (kind byte, id uint64, err error) {
+	header := make([]byte, STREAM_HEADER_SIZE)
+	if _, err = io.ReadFull(stream, header); err != nil {
+		return 0, 0, err
+	}
+	return header[0], binary.BigEndian.Uint64(header[1:]), nil
+}
+
+type handshakeFunc func(conn net.Conn) (*smux.Session, *ctlConn, error)
+
+// Accept connections until one completes the handshake, fails only when shutting down
+func acceptHandshake(listener net.Listener, handshake handshakeFunc) (*smux.Session, *ctlConn, error) {
+	for {
+		conn, err := listener.Accept()
 		if err != nil {
-			return nil, nil, err
+			if isShuttingDown() {
+				return nil, nil, err
+			}
+			continue
 		}
 
-		pb, err := readUntilEnd(ctlStream)
+		session, ctl, err := handshake(conn)
 		if err != nil {
+			logHandshakeError(conn, err)
+			conn.Close()
 			continue
 		}
+		return session, ctl, nil
+	}
+}
 
-		p := unmarshal(pb)
-		if p.CMD == CTL_HANDSHAKE && p.N == CLIENT_HANDSHAKE {
-			ctlStream.Write(marshal(Protocol{
-				CMD: CTL_HANDSHAKE,
-				N:   SERVER_HANDSHAKE,
-			}))
-			break
+// The mismatch is warned, other errors are mostly of stray connections
+func logHandshakeError(conn net.Conn, err error) {
+	if _, ok := err.(mismatchError); ok {
+		logger.Warn("Handshake with %s error: %s", conn.RemoteAddr().String(), err.Error())
+		return
+	}
+	logger.Debug("Handshake with %s error: %s", conn.RemoteAddr().String(), err.Error())
+}
+
+func dialHandshake(remote string, handshake handshakeFunc) (*smux.Session, *ctlConn, error) {
+	conn, err := netio.DialTCP(remote)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session, ctl, err := handshake(conn)
+	if err != nil {
+		conn.Close()
+		if err == errPreamble {
+			err = errLegacyPeer
 		}
+		return nil, nil, err
+	}
+	return session, ctl, nil
+}
+
+// The side serving socks5 clients or DNS clients, waits for CLIENT_HANDSHAKE.
+// The handshake must be done in TIMEOUT, so a stray connection can't hang it
+func serverHandshake(conn net.Conn) (*smux.Session, *ctlConn, error) {
+	conn.SetDeadline(time.Now().Add(time.Duration(option.TIMEOUT) * time.Millisecond))
+
+	peer, conn, err := readPreamble(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, legacy := conn.(*replayConn); legacy {
+		logger.Warn("Agent %s didn't send the preamble, it may be iox v0.4 or before. Serving it by protocol 1, upgrade it for the features since",
+			conn.RemoteAddr().String())
+	} else if err = writePreamble(conn); err != nil {
+		return nil, nil, err
+	}
+	if err = checkPreamble(peer); err != nil {
+		return nil, nil, err
+	}
+
+	session, err := smux.Server(conn, smuxConfig())
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return session, ctlStream, nil
+	ctlStream, err := session.AcceptStream()
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	ctl := newCtlConn(ctlStream, peer.agreedVersion())
+
+	m, err := ctl.read()
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	if !(m.Type == CTL_HANDSHAKE && m.n() == CLIENT_HANDSHAKE) {
+		session.Close()
+		return nil, nil, errHandshake
+	}
+
+	ctl.Send(CTL_HANDSHAKE, SERVER_HANDSHAKE)
+	conn.SetDeadline(time.Time{})
+
+	trackSession(session, ctl.version)
+	return session, ctl, nil
 }
 
-func clientHandshake(remote string) (*smux.Session, *smux.Stream, error) {
-	conn, err := net.DialTimeout(
-		"tcp", remote,
-		time.Millisecond*time.Duration(option.TIMEOUT),
-	)
+// The agent side, sends CLIENT_HANDSHAKE no matter who connected
+func clientHandshake(conn net.Conn) (*smux.Session, *ctlConn, error) {
+	conn.SetDeadline(time.Now().Add(time.Duration(option.TIMEOUT) * time.Millisecond))
+
+	if err := writePreamble(conn); err != nil {
+		return nil, nil, err
+	}
+	peer, conn, err := readPreamble(conn)
 	if err != nil {
 		return nil, nil, err
 	}
+	// only agents of v0.4 start smux right away
+	if _, legacy := conn.(*replayConn); legacy {
+		return nil, nil, errPreamble
+	}
+	if err = checkPreamble(peer); err != nil {
+		return nil, nil, err
+	}
 
-	session, err := smux.Client(conn, &smux.Config{
-		Version:           2,
-		KeepAliveInterval: option.SMUX_KEEPALIVE_INTERVAL * time.Second,
-		KeepAliveTimeout:  option.SMUX_KEEPALIVE_TIMEOUT * time.Second,
-		MaxFrameSize:      option.SMUX_FRAMESIZE,
-		MaxReceiveBuffer:  option.SMUX_RECVBUFFER,
-		MaxStreamBuffer:   option.SMUX_STREAMBUFFER,
-	})
+	session, err := smux.Client(conn, smuxConfig())
 	if err != nil {
 		return nil, nil, err
 	}
 
 	ctlStream, err := session.OpenStream()
 	if err != nil {
+		session.Close()
 		return nil, nil, err
 	}
+	ctl := newCtlConn(ctlStream, peer.agreedVersion())
 
-	ctlStream.Write(marshal(Protocol{
-		CMD: CTL_HANDSHAKE,
-		N:   CLIENT_HANDSHAKE,
-	}))
+	ctl.Send(CTL_HANDSHAKE, CLIENT_HANDSHAKE)
 
-	pb, err := readUntilEnd(ctlStream)
+	m, err := ctl.read()
 	if err != nil {
-		return nil, nil, errors.New("Connect to remote forward server error")
+		session.Close()
+		return nil, nil, errHandshake
 	}
-
-	p := unmarshal(pb)
-	if !(p.CMD == CTL_HANDSHAKE && p.N == SERVER_HANDSHAKE) {
-		return nil, nil, errors.New("Connect to remote forward server error")
+	if !(m.Type == CTL_HANDSHAKE && m.n() == SERVER_HANDSHAKE) {
+		session.Close()
+		return nil, nil, errHandshake
 	}
+	conn.SetDeadline(time.Time{})
 
-	return session, ctlStream, nil
+	trackSession(session, ctl.version)
+	return session, ctl, nil
 }
@@ -0,0 +1,160 @@
+package operate
+
+import (
+	"bytes"
+	"io"
+	"iox/netio"
+	"iox/socks5"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+func TestClientAddr(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ctxA, _ := netio.NewTCPCtx(a, false)
+	ctxB, _ := netio.NewTCPCtx(b, false)
+
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	go writeClientAddr(ctxA, client)
+	addr, err := readClientAddr(ctxB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := withClient(ctxB, addr)
+	if ctx.RemoteAddr().String() != client.String() {
+		t.Fatalf("RemoteAddr is %s, want the client %s", ctx.RemoteAddr().String(), client.String())
+	}
+
+	// too long to send, the stream address is kept
+	go writeClientAddr(ctxA, clientAddr(strings.Repeat("a", 0x100)))
+	if addr, err = readClientAddr(ctxB); err != nil {
+		t.Fatal(err)
+	}
+	if ctx = withClient(ctxB, addr); ctx != netio.Ctx(ctxB) {
+		t.Fatalf("RemoteAddr is %s of unknown client", ctx.RemoteAddr().String())
+	}
+}
+
+// An agent of v0.4: smux without the preamble, ctl messages of Protocol,
+// and socks5 streams opened on CTL_CONNECT_ME
+func legacyAgent(t *testing.T, server string) {
+	conn, err := net.Dial("tcp", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := smux.DefaultConfig()
+	config.Version = 2
+	session, err := smux.Client(conn, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctlStream, err := session.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctlStream.Write(marshal(Protocol{CMD: CTL_HANDSHAKE, N: CLIENT_HANDSHAKE}))
+	pb, err := readUntilEnd(ctlStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := unmarshal(pb); !(p.CMD == CTL_HANDSHAKE && p.N == SERVER_HANDSHAKE) {
+		t.Fatalf("Server replied %v to handshake", p)
+	}
+
+	go func() {
+		for {
+			pb, err := readUntilEnd(ctlStream)
+			if err != nil {
+				return
+			}
+			p := unmarshal(pb)
+			if p.CMD != CTL_CONNECT_ME {
+				continue
+			}
+			for i := 0; i < int(p.N); i++ {
+				stream, err := session.OpenStream()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer stream.Close()
+					ctx, _ := netio.NewTCPCtx(stream, false)
+					socks5.HandleConnection(nil, ctx)
+				}()
+			}
+		}
+	}()
+}
+
+// The session and listeners are kept, serveServer exits the process once
+// the agent is gone
+func TestLegacyAgent(t *testing.T) {
+	master, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versions := make(chan int, 1)
+	go func() {
+		conn, err := master.Accept()
+		if err != nil {
+			return
+		}
+		session, ctl, err := serverHandshake(conn)
+		if err != nil {
+			t.Error(err)
+			versions <- 0
+			return
+		}
+		versions <- sessionVersion(session)
+		serveServer(session, ctl, nil, local, false, false)
+	}()
+
+	legacyAgent(t, master.Addr().String())
+	if v := <-versions; v != 1 {
+		t.Fatalf("Agent of v0.4 served by protocol %d, want 1", v)
+	}
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := net.Dial("tcp", local.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	connCtx, _ := netio.NewTCPCtx(conn, false)
+	if err = socks5.Connect(connCtx, echo.Addr().String()); err != nil {
+		t.Fatalf("CONNECT through agent of v0.4: %v", err)
+	}
+
+	msg := []byte("hello v0.4")
+	conn.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err = io.ReadFull(conn, got); err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("Echo got %q, %v", got, err)
+	}
+}
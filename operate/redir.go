@@ -0,0 +1,92 @@
+package operate
+
+import (
+	"errors"
+	"iox/logger"
+	"iox/netio"
+	"iox/option"
+	"iox/socks5"
+	"net"
+)
+
+var errRedirLoop = errors.New("destination is the listener itself")
+
+// Direct connection to the listener looks like a TPROXY one to itself
+func isListenerAddr(listener net.Listener, dst *net.TCPAddr) bool {
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.Port == dst.Port && (addr.IP.IsUnspecified() || addr.IP.Equal(dst.IP))
+}
+
+// Redir accepts connections redirected by iptables, then asks the socks5
+// server on remote to connect their original destinations
+func Redir(local string, remote string, renc bool) {
+	if !redirSupported {
+		logger.Error("Transparent proxy is only supported on Linux")
+		return
+	}
+
+	listener, err := listenWith(redirListenConfig(), local)
+	if err != nil {
+		logger.Error("Listen on %s error: %s", local, err.Error())
+		return
+	}
+	defer listener.Close()
+
+	tunnel := netio.AddTunnel("redir", local, remote, false, renc)
+	defer tunnel.Remove()
+
+	logger.Info("Start transparent proxy on %s via socks5 server %s (encrypted: %v, tproxy: %v)",
+		local, remote, renc, option.REDIR_TPROXY)
+
+	for {
+		localConn, err := listener.Accept()
+		if err != nil {
+			if isShuttingDown() {
+				return
+			}
+			logger.Warn("Handle local connect error: %s", err.Error())
+			continue
+		}
+
+		go func() {
+			defer localConn.Close()
+
+			dst, err := originalDst(localConn)
+			if err == nil && isListenerAddr(listener, dst) {
+				err = errRedirLoop
+			}
+			if err != nil {
+				logger.Warn("Get original destination of %s error: %s",
+					localConn.RemoteAddr().String(), err.Error())
+				return
+			}
+			target := dst.String()
+
+			remoteConn, err := netio.DialTCP(remote)
+			if err != nil {
+				logger.Warn("Connect socks5 server %s error: %s", remote, err.Error())
+				return
+			}
+			defer remoteConn.Close()
+
+			remoteConnCtx, err := netio.NewTCPCtx(remoteConn, renc)
+			if err != nil {
+				return
+			}
+
+			if err = socks5.Connect(remoteConnCtx, target); err != nil {
+				logger.Warn("Socks5 server %s connect %s error: %s", remote, target, err.Error())
+				return
+			}
+
+			localConnCtx, err := netio.NewTCPCtx(localConn, false)
+			if err != nil {
+				return
+			}
+
+			pipe := netio.NewPipe(tunnel, localConnCtx, remoteConnCtx)
+			pipe.Target = target
+			pipe.Forward()
+		}()
+	}
+}
@@ -0,0 +1,99 @@
+//go:build linux
+// +build linux
+
+package operate
+
+import (
+	"errors"
+	"iox/option"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var errNotRedirected = errors.New("not redirected by iptables")
+
+const (
+	redirSupported = true
+
+	// same value for IPv6 as IP6T_SO_ORIGINAL_DST
+	SO_ORIGINAL_DST = 80
+)
+
+// IP_TRANSPARENT lets the listener accept connections to any address,
+// as routed by TPROXY rules. It requires CAP_NET_ADMIN
+func redirListenConfig() net.ListenConfig {
+	if !option.REDIR_TPROXY {
+		return net.ListenConfig{}
+	}
+
+	return net.ListenConfig{
+		Control: func(network string, address string, c syscall.RawConn) error {
+			var err error
+			c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					err = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+					if err != nil {
+						return
+					}
+				}
+				err = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+			})
+			return err
+		},
+	}
+}
+
+// The destination before REDIRECT, or the local address for TPROXY
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	localAddr := conn.LocalAddr().(*net.TCPAddr)
+	if option.REDIR_TPROXY {
+		return localAddr, nil
+	}
+
+	rawConn, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if localAddr.IP.To4() != nil {
+			// sockaddr_in fits in ipv6_mreq: family, port, address
+			mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, SO_ORIGINAL_DST)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			b := mreq.Multiaddr
+			dst = &net.TCPAddr{
+				IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+				Port: int(b[2])<<8 | int(b[3]),
+			}
+			return
+		}
+
+		// sockaddr_in6 is the head of ip6_mtuinfo
+		info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, SO_ORIGINAL_DST)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		dst = &net.TCPAddr{
+			IP:   net.IP(info.Addr.Addr[:]),
+			Port: int(port[0])<<8 | int(port[1]),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr == unix.ENOENT {
+		return nil, errNotRedirected
+	}
+
+	return dst, sockErr
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package operate
+
+import (
+	"errors"
+	"net"
+)
+
+const redirSupported = false
+
+func redirListenConfig() net.ListenConfig {
+	return net.ListenConfig{}
+}
+
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("Transparent proxy is only supported on Linux")
+}
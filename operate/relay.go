@@ -0,0 +1,251 @@
+package operate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"iox/logger"
+	"iox/netio"
+	"sync"
+
+	"github.com/xtaci/smux"
+)
+
+// Agents can relay downstream agents, which connect to the `--relay`
+// listener of agent the same way as to server. Server learns the tree by
+// JOB_AGENTS once an agent reports CTL_AGENTS_CHANGED, and the jobs of
+// downstream agents are forwarded by each relaying agent, see agentJobs
+
+type relayRequest struct {
+	Agent uint64 `json:"agent"`
+}
+
+// agentNode is a downstream agent with its own downstream agents,
+// the ID is assigned by the relaying agent
+type agentNode struct {
+	ID        uint64      `json:"id"`
+	Addr      string      `json:"addr"`
+	Encrypted bool        `json:"encrypted"`
+	Agents    []agentNode `json:"agents,omitempty"`
+}
+
+// Route of the relayed agent: the agent connected to server directly, and
+// the IDs assigned by each relaying agent from there down
+type relayRoute struct {
+	root uint64
+	hops []uint64
+}
+
+var (
+	// guarded by jobSessionsMu, as startJob looks up both
+	relayRoutes = make(map[uint64]relayRoute)
+
+	// the relayed agents of each root agent, by their hops
+	relayMu sync.Mutex
+	relayed = make(map[uint64]map[string]*netio.Agent)
+)
+
+// serveRelay takes the downstream agents on local, notify tells server the
+// agents changed. Runs until shutting down
+func serveRelay(local string, encrypted bool, notify func()) {
+	listener, err := listen(local)
+	if err != nil {
+		logger.Error("Relay listen on %s error: %s", local, err.Error())
+		return
+	}
+	defer listener.Close()
+
+	logger.Info("Relay downstream agents on %s (encrypted: %v)", local, encrypted)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if isShuttingDown() {
+				return
+			}
+			continue
+		}
+
+		go func() {
+			session, ctl, err := serverHandshake(conn)
+			if err != nil {
+				logHandshakeError(conn, err)
+				conn.Close()
+				return
+			}
+
+			relayChild(session, ctl, encrypted, notify)
+		}()
+	}
+}
+
+func relayChild(session *smux.Session, ctl *ctlConn, encrypted bool, notify func()) {
+	defer session.Close()
+	defer ctl.Close()
+
+	agent := netio.AddAgent(session.RemoteAddr().String(), encrypted, session)
+	addJobSession(agent.ID, session, ctl, encrypted)
+	logger.Info("Downstream agent %d handshake ok from %s (encrypted: %v)", agent.ID, agent.Addr, encrypted)
+	notify()
+
+	defer func() {
+		removeJobSession(agent.ID)
+		agent.Remove()
+		logger.Info("Downstream agent %d (%s) disconnected", agent.ID, agent.Addr)
+		notify()
+	}()
+
+	defer ctl.cleanupOnShutdown()()
+
+	// the downstream agent drains its pipes after CTL_CLEANUP, so keep
+	// the session until it's closed by peer
+	for {
+		m, err := ctl.Recv()
+		if err != nil {
+			return
+		}
+
+		switch m.Type {
+		case CTL_AGENTS_CHANGED:
+			notify()
+		case CTL_CLEANUP:
+			// the downstream agent is leaving, the session will be closed
+		default:
+			ctl.Unsupported(m)
+		}
+	}
+}
+
+// relayJob connects the job stream from server to the downstream agent,
+// which has acked the job of the same ID
+func relayJob(tunnel *netio.Tunnel, id uint64, streamCtx netio.Ctx, s jobSession) {
+	stream, err := openStream(s.session, STREAM_JOB, id)
+	if err != nil {
+		logger.Debug("Relay job stream #%d error: %s", id, err.Error())
+		return
+	}
+	defer stream.Close()
+
+	childCtx, err := netio.NewEndpointTCPCtx(stream, s.encrypted)
+	if err != nil {
+		return
+	}
+	netio.NewPipe(tunnel, streamCtx, childCtx).Forward()
+}
+
+// JOB_AGENTS lists the downstream agents recursively
+func handleAgentsJob(ctx context.Context, payload []byte, s *jobStream) (interface{}, error) {
+	nodes := []agentNode{}
+
+	for _, a := range netio.Agents() {
+		node := agentNode{
+			ID:        a.ID,
+			Addr:      a.Addr,
+			Encrypted: a.Encrypted,
+		}
+
+		// the downstream agent may relay nothing, or be an older version
+		if err := runJob(ctx, a.ID, JOB_AGENTS, nil, nil, &node.Agents); err != nil {
+			logger.Debug("List agents of downstream agent %d error: %s", a.ID, err.Error())
+		}
+		nodes = append(nodes, node)
+	}
+
+	return nodes, nil
+}
+
+// JOB_KILL closes the session of downstream agent
+func handleKill(ctx context.Context, payload []byte, s *jobStream) (interface{}, error) {
+	var req relayRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, errJobMsg
+	}
+
+	agent := netio.GetAgent(req.Agent)
+	if agent == nil {
+		return nil, errJobAgent
+	}
+	return nil, agent.Kill()
+}
+
+// relayedAgent is the session of relayed agent in server registry,
+// killing it asks the relaying agent to close the downstream session
+type relayedAgent struct {
+	parent uint64
+	id     uint64
+}
+
+func (a relayedAgent) Close() error {
+	return runJob(context.Background(), a.parent, JOB_KILL, relayRequest{a.id}, nil, &struct{}{})
+}
+
+// syncRelayed registers the agents relayed by root, and removes the gone ones
+func syncRelayed(root *netio.Agent) {
+	relayMu.Lock()
+	defer relayMu.Unlock()
+
+	var nodes []agentNode
+	if err := runJob(context.Background(), root.ID, JOB_AGENTS, nil, nil, &nodes); err != nil {
+		logger.Warn("List agents relayed by agent %d error: %s", root.ID, err.Error())
+		return
+	}
+
+	known := relayed[root.ID]
+	if known == nil {
+		known = make(map[string]*netio.Agent)
+		relayed[root.ID] = known
+	}
+	seen := make(map[string]bool)
+
+	var walk func(parent uint64, hops []uint64, nodes []agentNode)
+	walk = func(parent uint64, hops []uint64, nodes []agentNode) {
+		for _, node := range nodes {
+			route := append(append([]uint64{}, hops...), node.ID)
+			key := fmt.Sprint(route)
+			seen[key] = true
+
+			agent, ok := known[key]
+			if !ok {
+				agent = netio.AddChildAgent(parent, node.Addr, node.Encrypted, relayedAgent{parent, node.ID})
+				known[key] = agent
+
+				jobSessionsMu.Lock()
+				relayRoutes[agent.ID] = relayRoute{root.ID, route}
+				jobSessionsMu.Unlock()
+
+				logger.Info("Agent %d (%s) relayed by agent %d (encrypted: %v)", agent.ID, agent.Addr, parent, agent.Encrypted)
+			}
+
+			walk(agent.ID, route, node.Agents)
+		}
+	}
+	walk(root.ID, nil, nodes)
+
+	for key, agent := range known {
+		if !seen[key] {
+			delete(known, key)
+			removeRelayedAgent(agent)
+		}
+	}
+}
+
+// removeRelayed removes all the agents relayed by root, once root is gone
+func removeRelayed(root *netio.Agent) {
+	relayMu.Lock()
+	defer relayMu.Unlock()
+
+	for _, agent := range relayed[root.ID] {
+		removeRelayedAgent(agent)
+	}
+	delete(relayed, root.ID)
+}
+
+func removeRelayedAgent(agent *netio.Agent) {
+	jobSessionsMu.Lock()
+	delete(relayRoutes, agent.ID)
+	jobSessionsMu.Unlock()
+
+	agent.Remove()
+	closeRoutes(agent.ID)
+	logger.Info("Relayed agent %d (%s) disconnected", agent.ID, agent.Addr)
+}
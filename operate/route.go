@@ -0,0 +1,117 @@
+package operate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iox/crypto"
+	"iox/logger"
+	"iox/netio"
+	"iox/socks5"
+	"net"
+	"sync"
+)
+
+var errRouteNoKey = errors.New("Encrypted route listener needs the key, specify it by `-k` param of server")
+
+type RouteRequest struct {
+	// [HOST:]PORT of server
+	Listen    string `json:"listen"`
+	Encrypted bool   `json:"encrypted"`
+}
+
+// The client of the socks5 connection of JOB_SOCKS, whose request has been
+// read by server. Agents record it as the client rather than the stream
+type socksRequest struct {
+	Client string `json:"client,omitempty"`
+}
+
+var (
+	routesMu sync.Mutex
+	routes   = make(map[uint64][]net.Listener)
+)
+
+// Route serves socks5 on req.Listen, whose requests are made by the agent.
+// Each connection is a JOB_SOCKS stream, so it works for the relayed agents
+// too. The listener is closed once the agent is gone
+func Route(agentID uint64, req RouteRequest) error {
+	local, encrypted := req.Listen, req.Encrypted
+
+	agent := netio.GetAgent(agentID)
+	if agent == nil {
+		return errJobAgent
+	}
+	if encrypted && crypto.SECRET_KEY == nil {
+		return errRouteNoKey
+	}
+
+	listener, err := listen(local)
+	if err != nil {
+		return err
+	}
+
+	routesMu.Lock()
+	routes[agentID] = append(routes[agentID], listener)
+	routesMu.Unlock()
+
+	tunnel := netio.AddTunnel("proxy-route", local, fmt.Sprintf("agent-%d", agentID), encrypted, agent.Encrypted)
+	logger.Info("Route socks5 on %s to agent %d (encrypted: %v)", local, agentID, encrypted)
+
+	go func() {
+		defer tunnel.Remove()
+		defer listener.Close()
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					continue
+				}
+				return
+			}
+
+			go routeConn(tunnel, agentID, conn, encrypted)
+		}
+	}()
+
+	return nil
+}
+
+func routeConn(tunnel *netio.Tunnel, agentID uint64, conn net.Conn, encrypted bool) {
+	defer conn.Close()
+
+	// the job stream has been read and written, so it can't be forwarded without decryption
+	connCtx, err := netio.NewEndpointTCPCtx(conn, encrypted)
+	if err != nil {
+		return
+	}
+
+	j, err := startJob(context.Background(), agentID, JOB_SOCKS, socksRequest{
+		Client: conn.RemoteAddr().String(),
+	})
+	if err != nil {
+		logger.Debug("Route to agent %d error: %s", agentID, err.Error())
+		return
+	}
+	defer j.Close()
+
+	target, ok := socks5.Relay(connCtx, j.conn)
+	if !ok {
+		return
+	}
+
+	pipe := netio.NewPipe(tunnel, connCtx, j.conn)
+	pipe.Target = target
+	pipe.Forward()
+}
+
+func closeRoutes(agentID uint64) {
+	routesMu.Lock()
+	listeners := routes[agentID]
+	delete(routes, agentID)
+	routesMu.Unlock()
+
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
@@ -0,0 +1,158 @@
+package operate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"iox/logger"
+	"iox/option"
+	"iox/socks5"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errScanPorts = errors.New("Scan ports must be like 22,80,8000-8100")
+
+// ScanRequest is the JOB_SCAN payload, targets are IP, CIDR or domain
+type ScanRequest struct {
+	Targets []string `json:"targets"`
+	Ports   string   `json:"ports"`
+
+	// connections at the same time
+	Concurrency int `json:"concurrency"`
+
+	// connect timeout, millisecond
+	Timeout int `json:"timeout"`
+}
+
+// ScanResult is streamed by agent for each open port
+type ScanResult struct {
+	Target string  `json:"target"`
+	Port   int     `json:"port"`
+	RTT    float64 `json:"rtt_ms"`
+}
+
+type ScanSummary struct {
+	Probes int `json:"probes"`
+	Open   int `json:"open"`
+}
+
+// Scan asks the agent to connect-scan the targets, onResult is called for
+// each open port as soon as it's found
+func Scan(ctx context.Context, agentID uint64, req ScanRequest, onResult func(ScanResult) error) (ScanSummary, error) {
+	var summary ScanSummary
+	err := runJob(ctx, agentID, JOB_SCAN, req, func(payload []byte) error {
+		var result ScanResult
+		if err := json.Unmarshal(payload, &result); err != nil {
+			return err
+		}
+		return onResult(result)
+	}, &summary)
+	return summary, err
+}
+
+// Port list like 22,80,8000-8100
+func parsePorts(s string) ([]int, error) {
+	ports := []int{}
+
+	for _, part := range strings.Split(s, ",") {
+		lo, hi := part, part
+		if i := strings.IndexByte(part, '-'); i >= 0 {
+			lo, hi = part[:i], part[i+1:]
+		}
+
+		start, err1 := strconv.Atoi(lo)
+		end, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || start < 1 || end > 0xFFFF || start > end {
+			return nil, errScanPorts
+		}
+
+		for port := start; port <= end; port++ {
+			ports = append(ports, port)
+		}
+	}
+
+	return ports, nil
+}
+
+func handleScan(ctx context.Context, payload []byte, s *jobStream) (interface{}, error) {
+	var req ScanRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, err
+	}
+	if req.Concurrency < 1 || req.Concurrency > option.SCAN_MAX_CONCURRENCY {
+		req.Concurrency = option.SCAN_MAX_CONCURRENCY
+	}
+	if req.Timeout < 1 {
+		req.Timeout = option.TIMEOUT
+	}
+
+	ports, err := parsePorts(req.Ports)
+	if err != nil {
+		return nil, err
+	}
+
+	targets, err := expandTargets(req.Targets, option.SCAN_MAX_PROBES/len(ports))
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := time.Duration(req.Timeout) * time.Millisecond
+	addresses := make(chan [2]string)
+	var open int64
+
+	go func() {
+		defer close(addresses)
+		for _, target := range targets {
+			for _, port := range ports {
+				select {
+				case addresses <- [2]string{target, strconv.Itoa(port)}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < req.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for address := range addresses {
+				start := time.Now()
+				conn, err := socks5.Dial(net.JoinHostPort(address[0], address[1]), timeout)
+				if err != nil {
+					continue
+				}
+				conn.Close()
+
+				atomic.AddInt64(&open, 1)
+				port, _ := strconv.Atoi(address[1])
+				err = s.Send(ScanResult{
+					Target: address[0],
+					Port:   port,
+					RTT:    float64(time.Since(start).Microseconds()) / 1000,
+				})
+				if err != nil {
+					logger.Debug("Send scan result error: %s", err.Error())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return ScanSummary{
+		Probes: len(targets) * len(ports),
+		Open:   int(open),
+	}, nil
+}
@@ -0,0 +1,142 @@
+package operate
+
+import (
+	"context"
+	"iox/logger"
+	"iox/netio"
+	"iox/option"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	shutdownOnce sync.Once
+	shuttingDown = make(chan struct{})
+
+	shutdownMu sync.Mutex
+	listeners  = make(map[net.Listener]struct{})
+	cleanups   = make(map[int]func())
+	cleanupID  int
+)
+
+// Listener which will be closed when shutting down, so the accept loop
+// stops taking new connections while the running pipes are drained
+type trackedListener struct {
+	net.Listener
+}
+
+func (l trackedListener) Close() error {
+	shutdownMu.Lock()
+	delete(listeners, l.Listener)
+	shutdownMu.Unlock()
+
+	return l.Listener.Close()
+}
+
+func listen(address string) (net.Listener, error) {
+	return listenWith(net.ListenConfig{}, address)
+}
+
+func listenWith(config net.ListenConfig, address string) (net.Listener, error) {
+	config.KeepAlive = netio.KeepAlive()
+	listener, err := config.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	shutdownMu.Lock()
+	listeners[listener] = struct{}{}
+	shutdownMu.Unlock()
+
+	return withConnLimit(withACL(trackedListener{listener}, address)), nil
+}
+
+// Register a function to run before draining, e.g. sending CTL_CLEANUP to peer.
+// The returned function unregisters it, for the peers leaving earlier
+func onShutdown(fn func()) func() {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+
+	cleanupID++
+	id := cleanupID
+	cleanups[id] = fn
+
+	return func() {
+		shutdownMu.Lock()
+		delete(cleanups, id)
+		shutdownMu.Unlock()
+	}
+}
+
+func isShuttingDown() bool {
+	select {
+	case <-shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+// HandleSignals makes the first SIGINT/SIGTERM shut down gracefully,
+// and the second one exit immediately
+func HandleSignals() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-sigs
+		go func() {
+			<-sigs
+			logger.Warn("Recv signal again, force exit")
+			os.Exit(1)
+		}()
+
+		logger.Info("Recv signal, shutting down")
+		shutdown(0)
+	}()
+}
+
+// Stop accepting, run cleanups, wait for running pipes then exit.
+// Only the first call takes effect, later calls block until exit
+func shutdown(code int) {
+	shutdownOnce.Do(func() {
+		close(shuttingDown)
+
+		shutdownMu.Lock()
+		for listener := range listeners {
+			listener.Close()
+		}
+		fns := make([]func(), 0, len(cleanups))
+		for _, fn := range cleanups {
+			fns = append(fns, fn)
+		}
+		shutdownMu.Unlock()
+
+		for _, fn := range fns {
+			fn()
+		}
+
+		if n := netio.ActivePipes(); n > 0 {
+			logger.Info("Draining %d pipes (timeout: %dms)", n, option.DRAIN_TIMEOUT)
+			if !netio.WaitPipes(time.Millisecond * time.Duration(option.DRAIN_TIMEOUT)) {
+				logger.Warn("Drain timeout, cut off %d pipes", netio.ActivePipes())
+			}
+		}
+
+		os.Exit(code)
+	})
+
+	select {}
+}
+
+// Wait blocks forever if the working mode returned because of shutting down,
+// the process will be terminated by the draining goroutine
+func Wait() {
+	if isShuttingDown() {
+		select {}
+	}
+}
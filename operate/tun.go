@@ -0,0 +1,136 @@
+package operate
+
+import (
+	"errors"
+	"iox/logger"
+	"iox/netio"
+	"iox/option"
+	"iox/socks5"
+	"iox/tun"
+	"net"
+	"time"
+)
+
+var errStreamTimeout = errors.New("Wait for stream from remote timeout")
+
+// Relay the flows routed to TUN device through the reverse socks5 agent,
+// TCP flows are socks5 CONNECT and UDP flows are the iox UDP relay
+type tunHandler struct {
+	tunnel  *netio.Tunnel
+	connect func(net.Addr, func(netio.Ctx)) error
+}
+
+func serveTUN(tunnel *netio.Tunnel, connect func(net.Addr, func(netio.Ctx)) error) {
+	dev, err := tun.Open(option.TUN_DEVICE)
+	if err != nil {
+		logger.Error("Open TUN device %s error: %s", option.TUN_DEVICE, err.Error())
+		return
+	}
+
+	stack := tun.NewStack(dev, &tunHandler{
+		tunnel:  tunnel,
+		connect: connect,
+	})
+	onShutdown(func() {
+		stack.Close()
+	})
+
+	logger.Info("Relay TCP/UDP flows of TUN device %s to remote", option.TUN_DEVICE)
+
+	if err = stack.Run(); err != nil && !isShuttingDown() {
+		logger.Error("Read TUN device %s error: %s", option.TUN_DEVICE, err.Error())
+	}
+}
+
+// Open a stream to remote for the flow from client and send the socks5
+// request on it
+func (h *tunHandler) request(connect func(netio.Ctx, string) error, client net.Addr, target string) (netio.Ctx, error) {
+	streams := make(chan netio.Ctx)
+	err := h.connect(client, func(streamCtx netio.Ctx) {
+		select {
+		case streams <- streamCtx:
+		default:
+			// given up
+			streamCtx.Close()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var streamCtx netio.Ctx
+	select {
+	case streamCtx = <-streams:
+	case <-time.After(time.Millisecond * time.Duration(option.TIMEOUT)):
+		return nil, errStreamTimeout
+	}
+
+	streamCtx.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(option.TIMEOUT)))
+	if err = connect(streamCtx, target); err != nil {
+		streamCtx.Close()
+		return nil, err
+	}
+	streamCtx.SetDeadline(time.Time{})
+
+	return streamCtx, nil
+}
+
+func (h *tunHandler) HandleTCP(conn *tun.TCPConn) {
+	target := conn.LocalAddr().String()
+
+	streamCtx, err := h.request(socks5.Connect, conn.RemoteAddr(), target)
+	if err != nil {
+		logger.Debug("TUN flow from %s to %s error: %s", conn.RemoteAddr().String(), target, err.Error())
+		conn.Reset()
+		return
+	}
+	defer streamCtx.Close()
+
+	conn.Establish()
+	defer conn.Close()
+
+	connCtx, err := netio.NewTCPCtx(conn, false)
+	if err != nil {
+		return
+	}
+
+	pipe := netio.NewPipe(h.tunnel, connCtx, streamCtx)
+	pipe.Target = target
+	pipe.Forward()
+}
+
+func (h *tunHandler) HandleUDP(conn *tun.UDPConn) {
+	defer conn.Close()
+	target := conn.LocalAddr().String()
+
+	streamCtx, err := h.request(socks5.ConnectUDP, conn.RemoteAddr(), target)
+	if err != nil {
+		logger.Debug("TUN udp flow from %s to %s error: %s", conn.RemoteAddr().String(), target, err.Error())
+		return
+	}
+	defer streamCtx.Close()
+
+	go func() {
+		defer conn.Close()
+		for {
+			b, err := socks5.ReadDatagram(streamCtx)
+			if err != nil {
+				return
+			}
+			if _, err = conn.Write(b); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, option.UDP_PACKET_MAX_SIZE)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if err = socks5.WriteDatagram(streamCtx, buf[:n]); err != nil {
+			return
+		}
+	}
+}
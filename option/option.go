@@ -1,5 +1,7 @@
 package option
 
+import "net"
+
 const (
 	TCP_BUFFER_SIZE = 0x8000
 
@@ -10,20 +12,166 @@ const (
 
 	CONNECTING_RETRY_DURATION = 1500
 
+	LEVEL_DEBUG = 0
+	LEVEL_INFO  = 1
+	LEVEL_WARN  = 2
+	LEVEL_ERROR = 3
+
+	LOG_MAX_BACKUPS = 3
+
+	// entries of the DNS cache at most
+	DNS_CACHE_SIZE = 0x400
+
+	// MTU of the TUN device, decides the MSS
+	TUN_MTU = 1500
+
+	// targets pinged at the same time by agent
+	PING_CONCURRENCY = 0x40
+
+	// targets of one ping job at most, after CIDRs are expanded
+	PING_MAX_TARGETS = 0x10000
+
+	// connections of one scan job at most at the same time
+	SCAN_MAX_CONCURRENCY = 0x1000
+
+	// targets multiplied by ports of one scan job at most
+	SCAN_MAX_PROBES = 0x100000
+)
+
+var (
+	TIMEOUT = 5000
+
+	// smux of the reverse session, version and keepalive(second) are checked
+	// against peer's in handshake, frame size and buffers(byte) are of each side
+	SMUX_VERSION            = 2
 	SMUX_KEEPALIVE_INTERVAL = 20
 	SMUX_KEEPALIVE_TIMEOUT  = 60
 	SMUX_FRAMESIZE          = 0x8000
 	SMUX_RECVBUFFER         = 0x400000
 	SMUX_STREAMBUFFER       = 0x10000
-)
 
-var (
-	TIMEOUT = 5000
+	// bandwidth limits, byte per second. Up is from the client to the
+	// destination side. 0 is unlimited
+	LIMIT_UP          int64 = 0
+	LIMIT_DOWN        int64 = 0
+	LIMIT_TUNNEL_UP   int64 = 0
+	LIMIT_TUNNEL_DOWN int64 = 0
+	LIMIT_CONN_UP     int64 = 0
+	LIMIT_CONN_DOWN   int64 = 0
+
+	// connections served by each listener and of each client IP at the same
+	// time, 0 is unlimited. A full listener queues the new ones in backlog,
+	// or refuses them if MAX_CONN_REFUSE
+	MAX_CONN        = 0
+	MAX_CONN_PER_IP = 0
+	MAX_CONN_REFUSE = false
+
+	// pipes are closed if no bytes either way in PIPE_IDLE_TIMEOUT, or after
+	// PIPE_LIFETIME since open, second. 0 disables
+	PIPE_IDLE_TIMEOUT = 0
+	PIPE_LIFETIME     = 0
+
+	// how long a pipe is kept after one side shut down its writing, second.
+	// A peer never closing the other way would hold it forever. 0 disables
+	HALF_CLOSE_TIMEOUT = 60
+
+	// keepalive period of TCP connections, second. 0 disables
+	TCP_KEEPALIVE = 15
+
+	// how long to wait for running pipes when shutting down, millisecond
+	DRAIN_TIMEOUT = 10000
 
 	PROTOCOL = "TCP"
 
-	// enable log output
-	VERBOSE = false
+	// lines below the level are dropped, `-v` is debug and `-q` is error
+	LOG_LEVEL = LEVEL_INFO
+
+	LOG_JSON = false
+
+	// log to file instead of stdout/stderr if not empty
+	LOG_FILE = ""
+
+	// rotate log file when exceeding, MB
+	LOG_MAX_SIZE = 10
+
+	// access log records each socks5 request and fwd pipe, disabled if empty
+	ACCESS_LOG = ""
+
+	// `json` or `csv`
+	ACCESS_LOG_FORMAT = "json"
+
+	// destination allow/deny rule file for socks5 targets and fwd remotes
+	POLICY_FILE = ""
+
+	// resolve socks5 domain targets with it instead of the system resolver
+	DNS_SERVER = ""
+
+	// skip verifying the DoT certificate
+	DNS_INSECURE = false
+
+	// `ipv4` or `ipv6` address goes first, empty keeps the resolver order
+	DNS_PREFER = ""
+
+	// cache addresses resolved by `--dns`, second, at most the record TTL. 0 disables cache
+	DNS_CACHE_TTL = 60
+
+	// static overrides in hosts file format
+	HOSTS_FILE = ""
+
+	// redir mode takes connections routed by TPROXY rather than REDIRECT
+	REDIR_TPROXY = false
+
+	// TUN device whose flows are relayed to the reverse socks5 agent, disabled if empty
+	TUN_DEVICE = ""
+
+	// client CIDRs allowed by each listen address, the key "" applies to all listeners
+	ACL = make(map[string][]*net.IPNet)
+
+	// admin endpoint address, disabled if empty. Subcommands talk to it
+	ADMIN = ""
+
+	// file of the admin token, written by server and read by subcommands. If
+	// empty, it's PATH.token of unix socket or admin-PORT.token in config dir
+	ADMIN_TOKEN = ""
+
+	// agent ID of subcommands, 0 chooses the only agent
+	AGENT uint64 = 0
+
+	// echo requests sent to each target by `ping` at most
+	PING_COUNT = 1
+
+	// port list of `scan`, like 22,80,8000-8100
+	SCAN_PORTS = ""
+
+	// connections of `scan` at the same time
+	SCAN_CONCURRENCY = 0x100
+
+	// reverse socks5 agent runs the commands from server, authenticated by key
+	ALLOW_EXEC = false
+
+	// reverse socks5 agent serves `get` and `put` of server, authenticated by key
+	ALLOW_FILE = false
+
+	// server side paths of `get` and `put` must be inside it, the working
+	// directory of server if empty
+	FILE_DIR = ""
+
+	// reverse socks5 agent listens for server instead of connecting to it
+	BIND = false
+
+	// reverse socks5 agent relays the downstream agents connecting to it, disabled if empty
+	RELAY = ""
+
+	RELAY_ENC = false
+
+	// command of `exec`, the args after `--`
+	EXEC_COMMAND []string
+
+	// positional args of subcommands
+	ARGS []string
+
+	// prometheus metrics endpoint address, disabled if empty
+	METRICS = ""
 
 	// logic optimization, changed in v0.1.1
 	FORWARD_WITHOUT_DEC = false
@@ -4,17 +4,47 @@ import (
 	"encoding/hex"
 	"errors"
 	"iox/crypto"
+	"net"
 	"strconv"
+	"strings"
 )
 
 var (
-	errUnrecognizedMode    = errors.New("Unrecognized mode. Must choose a working mode in [fwd/proxy]")
-	errHexDecodeError      = errors.New("KEY must be a hexadecimal string")
-	PrintUsage             = errors.New("")
-	errUnrecognizedSubMode = errors.New("Malformed args. Incorrect number of `-l/-r` params")
-	errNoSecretKey         = errors.New("Encryption enabled, must specify a KEY by `-k` param")
-	errNotANumber          = errors.New("Timeout param must be a number")
-	errUDPMode             = errors.New("UDP mode only support fwd mode")
+	errUnrecognizedMode      = errors.New("Unrecognized mode. Must choose a working mode in [fwd/proxy/dns/redir] or subcommand in [ping/scan/exec/get/put/route]")
+	errHexDecodeError        = errors.New("KEY must be a hexadecimal string")
+	PrintUsage               = errors.New("")
+	errUnrecognizedSubMode   = errors.New("Malformed args. Incorrect number of `-l/-r` params")
+	errNoSecretKey           = errors.New("Encryption enabled, must specify a KEY by `-k` param")
+	errNotANumber            = errors.New("Timeout param must be a number")
+	errDrainNotANumber       = errors.New("Drain param must be a number")
+	errLogLevel              = errors.New("Log level must be one of debug/info/warn/error")
+	errLogSizeNotANumber     = errors.New("Log size param must be a number")
+	errAccessLogFormat       = errors.New("Access log format must be json or csv")
+	errACL                   = errors.New("Malformed `--allow` param, expect [LISTEN=]CIDR[,CIDR]")
+	errDNSPrefer             = errors.New("DNS preference must be ipv4 or ipv6")
+	errDNSCacheNotANumber    = errors.New("DNS cache param must be a number")
+	errUDPMode               = errors.New("UDP mode only support fwd mode")
+	errDNSEncrypted          = errors.New("DNS listener and upstream can't be encrypted, only the tunnel to agent can")
+	errRedirEncrypted        = errors.New("Redirected connections can't be encrypted, only the socks5 server can")
+	errTUNMode               = errors.New("TUN device only works with reverse socks5 server, `proxy -l CONTROL -l SOCKS5` or `proxy -r AGENT -l SOCKS5`")
+	errNoAdmin               = errors.New("Subcommand must specify the admin endpoint of server by `-a` param")
+	errAgentNotANumber       = errors.New("Agent param must be a number")
+	errCountNotANumber       = errors.New("Count param must be a number")
+	errNoTarget              = errors.New("Subcommand needs targets, IP, CIDR or domain")
+	errNoScanPorts           = errors.New("Scan must specify ports by `--ports` param")
+	errConcurrencyNotANumber = errors.New("Concurrency param must be a number")
+	errExecArgs              = errors.New("Malformed args. Expect `iox exec -a ADMIN [AGENT] -- CMD [ARGS...]`")
+	errGetArgs               = errors.New("Malformed args. Expect `iox get -a ADMIN REMOTE [LOCAL]`")
+	errPutArgs               = errors.New("Malformed args. Expect `iox put -a ADMIN LOCAL REMOTE`")
+	errRouteArgs             = errors.New("Malformed args. Expect `iox route -a ADMIN [--agent ID] -l [*][HOST:]PORT`")
+	errRelayAddress          = errors.New("Relay needs a listen address, `--relay [*][HOST:]PORT`")
+	errRelayMode             = errors.New("Relay only works with reverse socks5 agent, `proxy -r REMOTE` or `proxy -l LOCAL --bind`")
+	errSmuxNotANumber        = errors.New("Smux params must be numbers")
+	errSmuxConfig            = errors.New("Malformed smux params. Version must be 1 or 2, frame size at most 65535, stream buffer at most the buffer, keepalive interval less than the timeout")
+	errBindMode              = errors.New("Bind only works with reverse socks5 agent, `proxy -l LOCAL --bind`")
+	errMaxConnNotANumber     = errors.New("Max connection params must be numbers")
+	errPipeTimeoutNotANumber = errors.New("Idle timeout, lifetime, half-close timeout and keepalive params must be numbers")
+	errLimit                 = errors.New("Malformed limit param, expect UP[/DOWN] in byte per second with optional K/M/G, like 512K or 1M/256K")
 )
 
 const (
@@ -25,6 +55,14 @@ const (
 	SUBMODE_LP
 	SUBMODE_RP
 	SUBMODE_RPL2L
+	SUBMODE_BP
+	SUBMODE_BPL2R
+
+	SUBMODE_LD
+	SUBMODE_RD
+	SUBMODE_RDL2L
+
+	SUBMODE_REDIR
 )
 
 // Dont need flag-lib
@@ -45,7 +83,7 @@ func ParseCli(args []string) (
 	mode = args[0]
 
 	switch mode {
-	case "fwd", "proxy":
+	case "fwd", "proxy", "dns", "redir", "ping", "scan", "exec", "get", "put", "route":
 	case "-h", "--help":
 		err = PrintUsage
 		return
@@ -72,15 +110,7 @@ func ParseCli(args []string) (
 				lenc = append(lenc, false)
 			}
 
-			if _, err := strconv.Atoi(l); err == nil {
-				local = append(local, "0.0.0.0:"+l)
-			} else {
-				if l[0] == ':' {
-					local = append(local, "0.0.0.0"+l)
-				} else {
-					local = append(local, l)
-				}
-			}
+			local = append(local, normalizeListen(l))
 			ptr++
 
 		case "-r", "--remote":
@@ -115,16 +145,252 @@ func ParseCli(args []string) (
 				return
 			}
 			ptr++
+		case "-d", "--drain":
+			DRAIN_TIMEOUT, err = strconv.Atoi(args[ptr+1])
+			if err != nil {
+				err = errDrainNotANumber
+				return
+			}
+			ptr++
+		case "-a", "--admin":
+			ADMIN = args[ptr+1]
+			ptr++
+		case "--admin-token":
+			ADMIN_TOKEN = args[ptr+1]
+			ptr++
+		case "-m", "--metrics":
+			METRICS = args[ptr+1]
+			ptr++
 		case "-v", "--verbose":
-			VERBOSE = true
+			LOG_LEVEL = LEVEL_DEBUG
+		case "-q", "--quiet":
+			LOG_LEVEL = LEVEL_ERROR
+		case "--log-level":
+			switch args[ptr+1] {
+			case "debug":
+				LOG_LEVEL = LEVEL_DEBUG
+			case "info":
+				LOG_LEVEL = LEVEL_INFO
+			case "warn":
+				LOG_LEVEL = LEVEL_WARN
+			case "error":
+				LOG_LEVEL = LEVEL_ERROR
+			default:
+				err = errLogLevel
+				return
+			}
+			ptr++
+		case "--log-json":
+			LOG_JSON = true
+		case "--log-file":
+			LOG_FILE = args[ptr+1]
+			ptr++
+		case "--allow":
+			err = parseACL(args[ptr+1])
+			if err != nil {
+				return
+			}
+			ptr++
+		case "--dns":
+			DNS_SERVER = args[ptr+1]
+			ptr++
+		case "--dns-insecure":
+			DNS_INSECURE = true
+		case "--dns-prefer":
+			DNS_PREFER = args[ptr+1]
+			if DNS_PREFER != "ipv4" && DNS_PREFER != "ipv6" {
+				err = errDNSPrefer
+				return
+			}
+			ptr++
+		case "--dns-cache":
+			DNS_CACHE_TTL, err = strconv.Atoi(args[ptr+1])
+			if err != nil {
+				err = errDNSCacheNotANumber
+				return
+			}
+			ptr++
+		case "--tun":
+			TUN_DEVICE = args[ptr+1]
+			ptr++
+		case "--tproxy":
+			REDIR_TPROXY = true
+		case "--hosts":
+			HOSTS_FILE = args[ptr+1]
+			ptr++
+		case "-p", "--policy":
+			POLICY_FILE = args[ptr+1]
+			ptr++
+		case "--access-log":
+			ACCESS_LOG = args[ptr+1]
+			ptr++
+		case "--access-log-format":
+			ACCESS_LOG_FORMAT = args[ptr+1]
+			if ACCESS_LOG_FORMAT != "json" && ACCESS_LOG_FORMAT != "csv" {
+				err = errAccessLogFormat
+				return
+			}
+			ptr++
+		case "--log-size":
+			LOG_MAX_SIZE, err = strconv.Atoi(args[ptr+1])
+			if err != nil {
+				err = errLogSizeNotANumber
+				return
+			}
+			ptr++
+		case "--agent":
+			AGENT, err = strconv.ParseUint(args[ptr+1], 10, 64)
+			if err != nil {
+				err = errAgentNotANumber
+				return
+			}
+			ptr++
+		case "-c", "--count":
+			PING_COUNT, err = strconv.Atoi(args[ptr+1])
+			if err != nil {
+				err = errCountNotANumber
+				return
+			}
+			ptr++
+		case "--ports":
+			SCAN_PORTS = args[ptr+1]
+			ptr++
+		case "--concurrency":
+			SCAN_CONCURRENCY, err = strconv.Atoi(args[ptr+1])
+			if err != nil {
+				err = errConcurrencyNotANumber
+				return
+			}
+			ptr++
+		case "--smux-version", "--smux-frame", "--smux-buffer", "--smux-stream-buffer", "--smux-keepalive", "--smux-keepalive-timeout":
+			err = parseSmux(args[ptr], args[ptr+1])
+			if err != nil {
+				return
+			}
+			ptr++
+		case "--limit", "--limit-tunnel", "--limit-conn":
+			err = parseLimit(args[ptr], args[ptr+1])
+			if err != nil {
+				return
+			}
+			ptr++
+		case "--idle-timeout", "--lifetime", "--half-close-timeout", "--keepalive":
+			err = parsePipeTimeout(args[ptr], args[ptr+1])
+			if err != nil {
+				return
+			}
+			ptr++
+		case "--max-conn":
+			MAX_CONN, err = strconv.Atoi(args[ptr+1])
+			if err != nil {
+				err = errMaxConnNotANumber
+				return
+			}
+			ptr++
+		case "--max-conn-ip":
+			MAX_CONN_PER_IP, err = strconv.Atoi(args[ptr+1])
+			if err != nil {
+				err = errMaxConnNotANumber
+				return
+			}
+			ptr++
+		case "--max-conn-refuse":
+			MAX_CONN_REFUSE = true
+		case "--bind":
+			BIND = true
+		case "--relay":
+			r := args[ptr+1]
+			if len(r) > 0 && r[0] == '*' {
+				RELAY_ENC = true
+				r = r[1:]
+			}
+			if r == "" {
+				err = errRelayAddress
+				return
+			}
+
+			RELAY = normalizeListen(r)
+			ptr++
+		case "--allow-exec":
+			ALLOW_EXEC = true
+		case "--allow-file":
+			ALLOW_FILE = true
+		case "--file-dir":
+			FILE_DIR = args[ptr+1]
+			ptr++
+		case "--":
+			// the rest is the command of `exec`
+			EXEC_COMMAND = args[ptr+1:]
+			ptr = len(args) - 1
 		case "-h", "--help":
 			err = PrintUsage
 			return
+		default:
+			ARGS = append(ARGS, args[ptr])
 		}
 
 		ptr++
 	}
 
+	if !(SMUX_VERSION == 1 || SMUX_VERSION == 2) ||
+		SMUX_FRAMESIZE <= 0 || SMUX_FRAMESIZE > 0xFFFF ||
+		SMUX_STREAMBUFFER <= 0 || SMUX_STREAMBUFFER > SMUX_RECVBUFFER ||
+		SMUX_KEEPALIVE_INTERVAL <= 0 || SMUX_KEEPALIVE_INTERVAL >= SMUX_KEEPALIVE_TIMEOUT ||
+		SMUX_KEEPALIVE_TIMEOUT > 0xFFFF {
+		err = errSmuxConfig
+		return
+	}
+
+	// subcommands talk to the admin endpoint of a running server
+	if mode == "exec" {
+		switch {
+		case ADMIN == "":
+			err = errNoAdmin
+		case len(ARGS) > 1 || len(EXEC_COMMAND) == 0:
+			err = errExecArgs
+		case len(ARGS) == 1:
+			AGENT, err = strconv.ParseUint(ARGS[0], 10, 64)
+			if err != nil {
+				err = errAgentNotANumber
+			}
+		}
+		return
+	}
+
+	if mode == "get" || mode == "put" {
+		switch {
+		case ADMIN == "":
+			err = errNoAdmin
+		case mode == "get" && (len(ARGS) == 0 || len(ARGS) > 2):
+			err = errGetArgs
+		case mode == "put" && len(ARGS) != 2:
+			err = errPutArgs
+		}
+		return
+	}
+
+	if mode == "route" {
+		switch {
+		case ADMIN == "":
+			err = errNoAdmin
+		case len(local) != 1 || len(remote) != 0 || len(ARGS) != 0:
+			err = errRouteArgs
+		}
+		return
+	}
+
+	if mode == "ping" || mode == "scan" {
+		switch {
+		case ADMIN == "":
+			err = errNoAdmin
+		case len(ARGS) == 0:
+			err = errNoTarget
+		case mode == "scan" && SCAN_PORTS == "":
+			err = errNoScanPorts
+		}
+		return
+	}
+
 	if mode == "fwd" {
 		switch {
 		case len(local) == 0 && len(remote) == 2:
@@ -137,14 +403,36 @@ func ParseCli(args []string) (
 			err = errUnrecognizedSubMode
 			return
 		}
+	} else if mode == "redir" {
+		if len(local) != 1 || len(remote) != 1 {
+			err = errUnrecognizedSubMode
+			return
+		}
+		submode = SUBMODE_REDIR
+	} else if mode == "dns" {
+		switch {
+		case len(local) == 1 && len(remote) == 1:
+			submode = SUBMODE_LD
+		case len(local) == 0 && len(remote) == 1:
+			submode = SUBMODE_RD
+		case len(local) == 2 && len(remote) == 0:
+			submode = SUBMODE_RDL2L
+		default:
+			err = errUnrecognizedSubMode
+			return
+		}
 	} else {
 		switch {
 		case len(local) == 0 && len(remote) == 1:
 			submode = SUBMODE_RP
+		case len(local) == 1 && len(remote) == 0 && BIND:
+			submode = SUBMODE_BP
 		case len(local) == 1 && len(remote) == 0:
 			submode = SUBMODE_LP
 		case len(local) == 2 && len(remote) == 0:
 			submode = SUBMODE_RPL2L
+		case len(local) == 1 && len(remote) == 1:
+			submode = SUBMODE_BPL2R
 		default:
 			err = errUnrecognizedSubMode
 			return
@@ -157,6 +445,11 @@ func ParseCli(args []string) (
 	}
 
 	if crypto.SECRET_KEY == nil {
+		if RELAY_ENC {
+			err = errNoSecretKey
+			return
+		}
+
 		for i, _ := range lenc {
 			if lenc[i] {
 				err = errNoSecretKey
@@ -172,16 +465,184 @@ func ParseCli(args []string) (
 		}
 	}
 
-	if PROTOCOL == "UDP" && mode == "proxy" {
+	if PROTOCOL == "UDP" && mode != "fwd" {
 		err = errUDPMode
 		return
 	}
 
+	if BIND && !(mode == "proxy" && submode == SUBMODE_BP) {
+		err = errBindMode
+		return
+	}
+
+	if TUN_DEVICE != "" && !(mode == "proxy" && (submode == SUBMODE_RPL2L || submode == SUBMODE_BPL2R)) {
+		err = errTUNMode
+		return
+	}
+
+	if RELAY != "" && !(mode == "proxy" && (submode == SUBMODE_RP || submode == SUBMODE_BP)) {
+		err = errRelayMode
+		return
+	}
+
+	if mode == "redir" && lenc[0] {
+		err = errRedirEncrypted
+		return
+	}
+
+	// the DNS listener serves ordinary DNS clients
+	if (submode == SUBMODE_LD && (lenc[0] || renc[0])) || (submode == SUBMODE_RDL2L && lenc[1]) {
+		err = errDNSEncrypted
+		return
+	}
+
 	shouldFwdWithoutDec(lenc, renc)
 
 	return
 }
 
+func parseSmux(flag string, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return errSmuxNotANumber
+	}
+
+	switch flag {
+	case "--smux-version":
+		SMUX_VERSION = n
+	case "--smux-frame":
+		SMUX_FRAMESIZE = n
+	case "--smux-buffer":
+		SMUX_RECVBUFFER = n
+	case "--smux-stream-buffer":
+		SMUX_STREAMBUFFER = n
+	case "--smux-keepalive":
+		SMUX_KEEPALIVE_INTERVAL = n
+	case "--smux-keepalive-timeout":
+		SMUX_KEEPALIVE_TIMEOUT = n
+	}
+	return nil
+}
+
+func parsePipeTimeout(flag string, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return errPipeTimeoutNotANumber
+	}
+
+	switch flag {
+	case "--idle-timeout":
+		PIPE_IDLE_TIMEOUT = n
+	case "--lifetime":
+		PIPE_LIFETIME = n
+	case "--half-close-timeout":
+		HALF_CLOSE_TIMEOUT = n
+	case "--keepalive":
+		TCP_KEEPALIVE = n
+	}
+	return nil
+}
+
+// UP[/DOWN], the same for both directions if DOWN is omitted
+func parseLimit(flag string, value string) error {
+	upValue, downValue := value, value
+	if i := strings.IndexByte(value, '/'); i >= 0 {
+		upValue, downValue = value[:i], value[i+1:]
+	}
+
+	up, err := ParseRate(upValue)
+	if err != nil {
+		return err
+	}
+	down, err := ParseRate(downValue)
+	if err != nil {
+		return err
+	}
+
+	switch flag {
+	case "--limit":
+		LIMIT_UP, LIMIT_DOWN = up, down
+	case "--limit-tunnel":
+		LIMIT_TUNNEL_UP, LIMIT_TUNNEL_DOWN = up, down
+	case "--limit-conn":
+		LIMIT_CONN_UP, LIMIT_CONN_DOWN = up, down
+	}
+	return nil
+}
+
+// ParseRate parses byte per second like 1024, 512K, 1M or 1G
+func ParseRate(s string) (int64, error) {
+	unit := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			unit = 1 << 10
+		case 'm', 'M':
+			unit = 1 << 20
+		case 'g', 'G':
+			unit = 1 << 30
+		}
+		if unit != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errLimit
+	}
+	return n * unit, nil
+}
+
+// `PORT` and `:PORT` means 0.0.0.0:PORT
+func normalizeListen(l string) string {
+	if _, err := strconv.Atoi(l); err == nil {
+		return "0.0.0.0:" + l
+	}
+	if l[0] == ':' {
+		return "0.0.0.0" + l
+	}
+	return l
+}
+
+// [LISTEN=]CIDR[,CIDR], IP without mask is a single host.
+// LISTEN is `PORT`, `:PORT` or `HOST:PORT`, the former two match any host
+func parseACL(spec string) error {
+	listen := ""
+	if i := strings.IndexByte(spec, '='); i >= 0 {
+		if i == 0 {
+			return errACL
+		}
+		listen = spec[:i]
+		if _, err := strconv.Atoi(listen); err == nil {
+			listen = ":" + listen
+		}
+		spec = spec[i+1:]
+	}
+
+	for _, s := range strings.Split(spec, ",") {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return errACL
+			}
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return errACL
+		}
+		ACL[listen] = append(ACL[listen], network)
+	}
+
+	return nil
+}
+
 func shouldFwdWithoutDec(lenc []bool, renc []bool) {
 	if len(lenc)+len(renc) != 2 {
 		return
@@ -0,0 +1,221 @@
+// Destination allow/deny rules for socks5 targets and fwd remotes.
+//
+// Rule file, one rule per line, the first matched rule decides:
+//
+//	# ACTION  TARGET             [PORTS]
+//	deny      127.0.0.0/8
+//	allow     10.0.0.0/8         22,80,443,8000-9000
+//	deny      *.prod.corp.local
+//	allow     *.corp.local
+//	deny      *
+//
+// TARGET is an IP, a CIDR, a domain glob or `*`. CIDR rules also match
+// domain targets by their resolved IPs. Target matched no rule is allowed
+package policy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type portRange struct {
+	from int
+	to   int
+}
+
+type Rule struct {
+	Allow bool
+
+	// one of below, or both empty means any
+	network *net.IPNet
+	domain  string
+
+	ports []portRange
+	text  string
+}
+
+func (r *Rule) String() string {
+	return r.text
+}
+
+var rules []*Rule
+
+func parsePorts(s string) ([]portRange, error) {
+	var ports []portRange
+	for _, field := range strings.Split(s, ",") {
+		bounds := strings.SplitN(field, "-", 2)
+		from, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		to := from
+		if len(bounds) == 2 {
+			to, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		if from < 0 || to > 0xFFFF || from > to {
+			return nil, fmt.Errorf("invalid port range %s", field)
+		}
+		ports = append(ports, portRange{from, to})
+	}
+	return ports, nil
+}
+
+func parseRule(line string) (*Rule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, errors.New("expect `ACTION TARGET [PORTS]`")
+	}
+
+	r := &Rule{text: strings.Join(fields, " ")}
+
+	switch strings.ToLower(fields[0]) {
+	case "allow":
+		r.Allow = true
+	case "deny":
+		r.Allow = false
+	default:
+		return nil, errors.New("ACTION must be allow or deny")
+	}
+
+	target := fields[1]
+	switch {
+	case target == "*":
+	case strings.Contains(target, "/"):
+		_, network, err := net.ParseCIDR(target)
+		if err != nil {
+			return nil, err
+		}
+		r.network = network
+	case net.ParseIP(target) != nil:
+		ip := net.ParseIP(target)
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		r.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	default:
+		if _, err := path.Match(target, ""); err != nil {
+			return nil, err
+		}
+		r.domain = strings.ToLower(target)
+	}
+
+	if len(fields) == 3 {
+		ports, err := parsePorts(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		r.ports = ports
+	}
+
+	return r, nil
+}
+
+// Load the rule file, replaces the rules loaded before
+func Load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var loaded []*Rule
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		r, err := parseRule(line)
+		if err != nil {
+			return fmt.Errorf("Policy %s line %d: %s", file, n, err.Error())
+		}
+		loaded = append(loaded, r)
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	rules = loaded
+	return nil
+}
+
+func Enabled() bool {
+	return len(rules) > 0
+}
+
+func (r *Rule) matchPort(port int) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, p := range r.ports {
+		if port >= p.from && port <= p.to {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) match(host string, ips []net.IP, port int) bool {
+	if !r.matchPort(port) {
+		return false
+	}
+
+	switch {
+	case r.network != nil:
+		for _, ip := range ips {
+			if r.network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	case r.domain != "":
+		ok, _ := path.Match(r.domain, strings.ToLower(strings.TrimSuffix(host, ".")))
+		return ok
+	default:
+		return true
+	}
+}
+
+// Check the destination, host is as requested and ips are what it resolved to.
+// Any of ips matching a rule matches it, see Filter for choosing addresses.
+// The matched rule is nil if no rule matched
+func Check(host string, ips []net.IP, port int) (bool, *Rule) {
+	for _, r := range rules {
+		if r.match(host, ips, port) {
+			return r.Allow, r
+		}
+	}
+	return true, nil
+}
+
+// Filter checks each of ips on its own and returns the allowed ones, so a
+// domain resolving to both allowed and denied addresses is only connected by
+// the former. The rule is the one denied the first filtered address
+func Filter(host string, ips []net.IP, port int) ([]net.IP, *Rule) {
+	var allowed []net.IP
+	var denied *Rule
+	for _, ip := range ips {
+		ok, r := Check(host, []net.IP{ip}, port)
+		if ok {
+			allowed = append(allowed, ip)
+		} else if denied == nil {
+			denied = r
+		}
+	}
+	return allowed, denied
+}
@@ -0,0 +1,71 @@
+package policy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func loadRules(t *testing.T, text string) {
+	f, err := ioutil.TempFile("", "iox-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(text)
+	f.Close()
+
+	if err = Load(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilterMixedAddresses(t *testing.T) {
+	loadRules(t, "allow 203.0.113.0/24\ndeny 10.0.0.0/8\n")
+	defer func() { rules = nil }()
+
+	ips := []net.IP{
+		net.ParseIP("10.0.0.1"),
+		net.ParseIP("203.0.113.7"),
+		net.ParseIP("10.1.2.3"),
+	}
+
+	// matched as a whole, the allowed address decides for all of them
+	if ok, _ := Check("mixed.test", ips, 80); !ok {
+		t.Fatal("Check should allow by the first matched rule")
+	}
+
+	allowed, rule := Filter("mixed.test", ips, 80)
+	if len(allowed) != 1 || !allowed[0].Equal(net.ParseIP("203.0.113.7")) {
+		t.Fatalf("Filter allowed %v, want [203.0.113.7]", allowed)
+	}
+	if rule == nil || rule.String() != "deny 10.0.0.0/8" {
+		t.Fatalf("Filter denied by %v, want `deny 10.0.0.0/8`", rule)
+	}
+
+	allowed, rule = Filter("mixed.test", ips[:1], 80)
+	if len(allowed) != 0 || rule == nil {
+		t.Fatalf("Filter allowed %v by %v, want none", allowed, rule)
+	}
+
+	allowed, rule = Filter("mixed.test", ips[1:2], 80)
+	if len(allowed) != 1 || rule != nil {
+		t.Fatalf("Filter allowed %v by %v, want all", allowed, rule)
+	}
+}
+
+func TestFilterDomainRule(t *testing.T) {
+	loadRules(t, "deny *.corp.test 22\n")
+	defer func() { rules = nil }()
+
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}
+
+	if allowed, _ := Filter("db.corp.test", ips, 22); len(allowed) != 0 {
+		t.Fatalf("Filter allowed %v of denied domain", allowed)
+	}
+	if allowed, _ := Filter("db.corp.test", ips, 443); len(allowed) != 2 {
+		t.Fatalf("Filter allowed %v of other port, want all", allowed)
+	}
+}
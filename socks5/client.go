@@ -0,0 +1,138 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"iox/netio"
+	"net"
+	"strconv"
+)
+
+// address types of request and reply
+const (
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+var (
+	errServerMethod = errors.New("socks server requires authentication")
+	errServerReply  = errors.New("socks server replied malformed message")
+	errTarget       = errors.New("socks target must be HOST:PORT")
+)
+
+// Connect asks the socks5 server on conn to connect the target HOST:PORT,
+// then conn can be piped as the connection to target
+func Connect(conn netio.Ctx, target string) error {
+	return request(conn, socksCmdConnect, target)
+}
+
+// ConnectUDP asks the iox socks5 server on conn to relay UDP datagrams to the
+// target HOST:PORT, then datagrams are exchanged by ReadDatagram and WriteDatagram
+func ConnectUDP(conn netio.Ctx, target string) error {
+	return request(conn, socksCmdUDPStream, target)
+}
+
+func request(conn netio.Ctx, cmd byte, target string) error {
+	rep, _, err := exchange(conn, cmd, target)
+	if err != nil {
+		return err
+	}
+	if rep != repSucceeded {
+		if result, ok := repResults[rep]; ok {
+			return fmt.Errorf("socks server replied %s", result)
+		}
+		return errServerReply
+	}
+	return nil
+}
+
+// exchange sends the request and reads the reply code, with the bound address
+// if it's an IP. The error is of sending or a malformed reply
+func exchange(conn netio.Ctx, cmd byte, target string) (byte, *net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return 0, nil, errTarget
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil || portNum < 0 || portNum > 0xFFFF {
+		return 0, nil, errTarget
+	}
+
+	// version 5, one method, no authentication
+	if _, err = conn.EncryptWrite([]byte{socksVer5, 1, 0}); err != nil {
+		return 0, nil, err
+	}
+
+	buf := make([]byte, 2)
+	if _, err = readAtLeast(conn, buf, len(buf)); err != nil {
+		return 0, nil, err
+	}
+	if buf[0] != socksVer5 {
+		return 0, nil, errVer
+	}
+	if buf[1] != 0 {
+		return 0, nil, errServerMethod
+	}
+
+	req := []byte{socksVer5, cmd, 0}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		if len(host) > 0xFF {
+			return 0, nil, errTarget
+		}
+		req = append(req, atypDomain, byte(len(host)))
+		req = append(req, host...)
+	case ip.To4() != nil:
+		req = append(req, atypIPv4)
+		req = append(req, ip.To4()...)
+	default:
+		req = append(req, atypIPv6)
+		req = append(req, ip...)
+	}
+	req = append(req, byte(portNum>>8), byte(portNum))
+
+	if _, err = conn.EncryptWrite(req); err != nil {
+		return 0, nil, err
+	}
+
+	// read exactly the reply, the data after it belongs to target
+	buf = make([]byte, 4)
+	if _, err = readAtLeast(conn, buf, len(buf)); err != nil {
+		return 0, nil, err
+	}
+	if buf[0] != socksVer5 {
+		return 0, nil, errVer
+	}
+	rep, atyp := buf[1], buf[3]
+
+	var addrLen int
+	switch atyp {
+	case atypIPv4:
+		addrLen = net.IPv4len
+	case atypIPv6:
+		addrLen = net.IPv6len
+	case atypDomain:
+		if _, err = readAtLeast(conn, buf[:1], 1); err != nil {
+			return 0, nil, err
+		}
+		addrLen = int(buf[0])
+	default:
+		return 0, nil, errServerReply
+	}
+
+	buf = make([]byte, addrLen+2)
+	if _, err = readAtLeast(conn, buf, len(buf)); err != nil {
+		return 0, nil, err
+	}
+
+	var bound *net.TCPAddr
+	if atyp != atypDomain {
+		bound = &net.TCPAddr{
+			IP:   net.IP(buf[:addrLen]),
+			Port: int(bigEndianUint16(buf[addrLen:])),
+		}
+	}
+	return rep, bound, nil
+}
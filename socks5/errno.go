@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package socks5
+
+import "syscall"
+
+var (
+	errConnRefused = syscall.ECONNREFUSED
+	errHostUnreach = syscall.EHOSTUNREACH
+	errNetUnreach  = syscall.ENETUNREACH
+)
@@ -0,0 +1,9 @@
+package socks5
+
+import "golang.org/x/sys/windows"
+
+var (
+	errConnRefused = windows.WSAECONNREFUSED
+	errHostUnreach = windows.WSAEHOSTUNREACH
+	errNetUnreach  = windows.WSAENETUNREACH
+)
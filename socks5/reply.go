@@ -0,0 +1,84 @@
+package socks5
+
+import (
+	"errors"
+	"iox/netio"
+	"net"
+)
+
+// RFC 1928 reply codes
+const (
+	repSucceeded            = 0x00
+	repGeneralFailure       = 0x01
+	repNotAllowed           = 0x02
+	repNetworkUnreachable   = 0x03
+	repHostUnreachable      = 0x04
+	repConnectionRefused    = 0x05
+	repTTLExpired           = 0x06
+	repCommandNotSupported  = 0x07
+	repAddrTypeNotSupported = 0x08
+)
+
+// Request results by reply code, for metrics and access log
+var repResults = map[byte]string{
+	repSucceeded:            "ok",
+	repGeneralFailure:       "general_failure",
+	repNotAllowed:           "denied",
+	repNetworkUnreachable:   "network_unreachable",
+	repHostUnreachable:      "host_unreachable",
+	repConnectionRefused:    "connection_refused",
+	repTTLExpired:           "ttl_expired",
+	repCommandNotSupported:  "command_not_supported",
+	repAddrTypeNotSupported: "address_type_not_supported",
+}
+
+// Map the dialing error to reply code, so that clients like nmap
+// can tell a closed port from an unreachable host
+func replyCode(err error) byte {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return repHostUnreachable
+	}
+
+	switch {
+	case errors.Is(err, errConnRefused):
+		return repConnectionRefused
+	case errors.Is(err, errHostUnreach):
+		return repHostUnreachable
+	case errors.Is(err, errNetUnreach):
+		return repNetworkUnreachable
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return repTTLExpired
+	}
+
+	return repGeneralFailure
+}
+
+// Write reply with the bound address, IPv4 0.0.0.0:0 if addr is nil
+func reply(conn netio.Ctx, rep byte, addr *net.TCPAddr) error {
+	buf := make([]byte, 0, 4+net.IPv6len+2)
+	buf = append(buf, socksVer5, rep, 0x00)
+
+	ip := net.IPv4zero.To4()
+	port := 0
+	if addr != nil {
+		ip = addr.IP
+		port = addr.Port
+	}
+
+	// v4-mapped IPv6 address is an IPv4 address as well
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, 0x01)
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, 0x04)
+		buf = append(buf, ip.To16()...)
+	}
+	buf = append(buf, byte(port>>8), byte(port))
+
+	_, err := conn.EncryptWrite(buf)
+	return err
+}
@@ -5,8 +5,9 @@ import (
 	"errors"
 	"io"
 	"iox/logger"
+	"iox/metrics"
 	"iox/netio"
-	"iox/option"
+	"iox/policy"
 	"net"
 	"strconv"
 	"time"
@@ -23,11 +24,21 @@ var (
 	errAuthExtraData = errors.New("socks authentication get extra data")
 	errReqExtraData  = errors.New("socks request get extra data")
 	errCmd           = errors.New("socks only support connect command")
+	errNotAllowed    = errors.New("socks target denied by policy")
+
+	requests = metrics.NewCounter("iox_socks_requests_total", "Socks5 requests by result", "result")
 )
 
 const (
 	socksVer5       = 0x05
 	socksCmdConnect = 0x01
+
+	// iox extension, relay UDP datagrams to the target over this connection
+	socksCmdUDPStream = 0x83
+
+	// results of requests without reply, see repResults for the others
+	resultHandshakeError = "handshake_error"
+	resultRequestError   = "request_error"
 )
 
 func readAtLeast(r netio.Ctx, buf []byte, min int) (n int, err error) {
@@ -92,7 +103,7 @@ func handShake(conn netio.Ctx) (err error) {
 	return
 }
 
-func parseTarget(conn netio.Ctx) (host string, err error) {
+func parseTarget(conn netio.Ctx) (cmd byte, host string, err error) {
 	const (
 		idVer   = 0
 		idCmd   = 1
@@ -131,10 +142,12 @@ func parseTarget(conn netio.Ctx) (host string, err error) {
 	*/
 
 	if buf[idCmd] > 0x03 || buf[idCmd] == 0x00 {
-		logger.Info("Unknown Command: %d", buf[idCmd])
+		logger.Debug("Unknown Command: %d", buf[idCmd])
 	}
 
-	if buf[idCmd] != socksCmdConnect { //  only support CONNECT mode
+	//  only support CONNECT mode, and UDP relay between iox
+	cmd = buf[idCmd]
+	if cmd != socksCmdConnect && cmd != socksCmdUDPStream {
 		err = errCmd
 		return
 	}
@@ -183,73 +196,190 @@ func bigEndianUint16(b []byte) uint16 {
 	return uint16(b[1]) | uint16(b[0])<<8
 }
 
-func pipeWhenClose(conn netio.Ctx, target string) {
-	remoteConn, err := net.DialTimeout(
-		"tcp", target,
-		time.Millisecond*time.Duration(option.TIMEOUT),
-	)
+// Record the request which didn't make a pipe
+func requestFailed(conn netio.Ctx, target string, resolved string, result string, start time.Time) {
+	requests.Inc(result)
+	logger.Access(logger.AccessRecord{
+		Start:    start,
+		Kind:     "socks",
+		Client:   conn.RemoteAddr().String(),
+		Target:   target,
+		Resolved: resolved,
+		Result:   result,
+		Duration: time.Since(start),
+	})
+}
+
+// Reply the error to client, then record it
+func replyFailed(conn netio.Ctx, target string, resolved string, rep byte, start time.Time) {
+	reply(conn, rep, nil)
+	requestFailed(conn, target, resolved, repResults[rep], start)
+}
+
+// Resolve the target and check it against policy, the failure is replied
+func checkTarget(conn netio.Ctx, target string, start time.Time) ([]net.IP, string, bool) {
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+
+	// resolve here rather than in dialing, so the policy checks what is connected
+	ips, err := netio.Resolve(host)
 	if err != nil {
-		logger.Info("Connect remote :" + err.Error())
-		return
+		replyFailed(conn, target, "", replyCode(err), start)
+		logger.Debug("Resolve remote :" + err.Error())
+		return nil, "", false
 	}
-	defer remoteConn.Close()
 
-	tcpAddr := remoteConn.LocalAddr().(*net.TCPAddr)
-	if tcpAddr.Zone == "" {
-		if tcpAddr.IP.Equal(tcpAddr.IP.To4()) {
-			tcpAddr.Zone = "ip4"
-		} else {
-			tcpAddr.Zone = "ip6"
+	allowed, rule := policy.Filter(host, ips, portNum)
+	if len(allowed) == 0 {
+		replyFailed(conn, target, net.JoinHostPort(ips[0].String(), port), repNotAllowed, start)
+		logger.Warn("Socks5 request from %s to %s denied by policy `%s`",
+			conn.RemoteAddr().String(), target, rule)
+		return nil, "", false
+	}
+	if rule != nil {
+		logger.Debug("Socks5 request from %s to %s skips %d addresses denied by policy `%s`",
+			conn.RemoteAddr().String(), target, len(ips)-len(allowed), rule)
+	}
+
+	return allowed, port, true
+}
+
+// Connect the first reachable address, resolved is the last one tried
+func dialIPs(ips []net.IP, port string, dial func(string) (net.Conn, error)) (conn net.Conn, resolved string, err error) {
+	for _, ip := range ips {
+		resolved = net.JoinHostPort(ip.String(), port)
+		conn, err = dial(resolved)
+		if err == nil {
+			return
 		}
 	}
+	return
+}
 
-	rep := make([]byte, 256)
-	rep[0] = 0x05
-	rep[1] = 0x00 // success
-	rep[2] = 0x00 //RSV
+// Dial connects the target HOST:PORT the way of socks5 CONNECT, it's
+// resolved, checked against policy, then each allowed address is tried in timeout
+func Dial(target string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	portNum, _ := strconv.Atoi(port)
 
-	//IP
-	if tcpAddr.Zone == "ip6" {
-		rep[3] = 0x04 //IPv6
-	} else {
-		rep[3] = 0x01 //IPv4
+	ips, err := netio.Resolve(host)
+	if err != nil {
+		return nil, err
 	}
 
-	var ip net.IP
-	if "ip6" == tcpAddr.Zone {
-		ip = tcpAddr.IP.To16()
-	} else {
-		ip = tcpAddr.IP.To4()
+	ips, _ = policy.Filter(host, ips, portNum)
+	if len(ips) == 0 {
+		return nil, errNotAllowed
 	}
-	pindex := 4
-	for _, b := range ip {
-		rep[pindex] = b
-		pindex += 1
+
+	conn, _, err := dialIPs(ips, port, func(address string) (net.Conn, error) {
+		return net.DialTimeout("tcp", address, timeout)
+	})
+	return conn, err
+}
+
+func pipeWhenClose(tunnel *netio.Tunnel, conn netio.Ctx, target string, start time.Time) {
+	ips, port, ok := checkTarget(conn, target, start)
+	if !ok {
+		return
 	}
-	rep[pindex] = byte((tcpAddr.Port >> 8) & 0xff)
-	rep[pindex+1] = byte(tcpAddr.Port & 0xff)
 
-	conn.EncryptWrite(rep[0 : pindex+2])
-	// Transfer data
+	remoteConn, resolved, err := dialIPs(ips, port, netio.DialTCP)
+	if err != nil {
+		replyFailed(conn, target, resolved, replyCode(err), start)
+		logger.Debug("Connect remote :" + err.Error())
+		return
+	}
+	defer remoteConn.Close()
+
+	requests.Inc(repResults[repSucceeded])
+	err = reply(conn, repSucceeded, remoteConn.LocalAddr().(*net.TCPAddr))
+	if err != nil {
+		return
+	}
 
+	// Transfer data
 	remoteConnCtx, err := netio.NewTCPCtx(remoteConn, false)
 	if err != nil {
-		logger.Info("Socks5 remote connect error: %s", err.Error())
+		logger.Debug("Socks5 remote connect error: %s", err.Error())
 		return
 	}
 
-	netio.PipeForward(conn, remoteConnCtx)
+	pipe := netio.NewPipe(tunnel, conn, remoteConnCtx)
+	pipe.Target = target
+	pipe.Forward()
 }
 
-func HandleConnection(conn netio.Ctx) {
+// Negotiate with client and read its request, the failure is replied
+func readRequest(conn netio.Ctx, start time.Time) (byte, string, bool) {
 	if err := handShake(conn); err != nil {
-		logger.Info("Socks5 handshake error: %s", err.Error())
-		return
+		requestFailed(conn, "", "", resultHandshakeError, start)
+		logger.Debug("Socks5 handshake error: %s", err.Error())
+		return 0, "", false
 	}
-	addr, err := parseTarget(conn)
+	cmd, addr, err := parseTarget(conn)
 	if err != nil {
-		logger.Info("socks consult transfer mode or parse target: %s", err.Error())
+		switch err {
+		case errCmd:
+			replyFailed(conn, "", "", repCommandNotSupported, start)
+		case errAddrType:
+			replyFailed(conn, "", "", repAddrTypeNotSupported, start)
+		default:
+			requestFailed(conn, "", "", resultRequestError, start)
+		}
+		logger.Debug("socks consult transfer mode or parse target: %s", err.Error())
+		return 0, "", false
+	}
+	return cmd, addr, true
+}
+
+// Relay serves the client on conn by the socks5 server on upstream, like the
+// reverse agent. The request is read here and passed on, so it's recorded
+// with the target on this side too. Both can be piped then, unless it failed
+func Relay(conn netio.Ctx, upstream netio.Ctx) (target string, ok bool) {
+	start := time.Now()
+
+	cmd, target, ok := readRequest(conn, start)
+	if !ok {
+		return "", false
+	}
+
+	rep, bound, err := exchange(upstream, cmd, target)
+	if err != nil {
+		replyFailed(conn, target, "", repGeneralFailure, start)
+		logger.Debug("Relay socks5 request to %s error: %s", target, err.Error())
+		return "", false
+	}
+	if rep != repSucceeded {
+		if _, known := repResults[rep]; !known {
+			rep = repGeneralFailure
+		}
+		replyFailed(conn, target, "", rep, start)
+		return "", false
+	}
+
+	requests.Inc(repResults[repSucceeded])
+	if err = reply(conn, repSucceeded, bound); err != nil {
+		return "", false
+	}
+	return target, true
+}
+
+// The tunnel is the working mode which the connection belongs to, it could be nil
+func HandleConnection(tunnel *netio.Tunnel, conn netio.Ctx) {
+	start := time.Now()
+
+	cmd, addr, ok := readRequest(conn, start)
+	if !ok {
+		return
+	}
+
+	if cmd == socksCmdUDPStream {
+		relayUDP(conn, addr, start)
 		return
 	}
-	pipeWhenClose(conn, addr)
+	pipeWhenClose(tunnel, conn, addr, start)
 }
@@ -0,0 +1,438 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"iox/netio"
+	"iox/option"
+	"iox/policy"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func writeTemp(t *testing.T, text string) string {
+	f, err := ioutil.TempFile("", "iox-socks5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(text)
+	f.Close()
+	return f.Name()
+}
+
+// mixed.test resolves to an allowed address and a denied one. Only the
+// allowed one may be dialed, even though the policy allows the domain as a
+// whole by its first matched rule
+func TestDialMixedPolicy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+
+	accepted := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+			accepted <- struct{}{}
+		}
+	}()
+
+	hosts := writeTemp(t, "127.0.0.3 mixed.test\n127.0.0.1 mixed.test\n127.0.0.1 denied.test\n")
+	defer os.Remove(hosts)
+	rules := writeTemp(t, "allow 127.0.0.3/32\ndeny 127.0.0.1/32\n")
+	defer os.Remove(rules)
+
+	option.HOSTS_FILE = hosts
+	defer func() { option.HOSTS_FILE = "" }()
+	if err = netio.InitResolver(); err != nil {
+		t.Fatal(err)
+	}
+	if err = policy.Load(rules); err != nil {
+		t.Fatal(err)
+	}
+	defer policy.Load(os.DevNull)
+
+	// 127.0.0.3 refuses, the denied 127.0.0.1 must not be tried next
+	conn, err := Dial(net.JoinHostPort("mixed.test", port), time.Second)
+	if err == nil {
+		conn.Close()
+		t.Fatal("Dial connected the address denied by policy")
+	}
+	if err == errNotAllowed {
+		t.Fatal("Dial denied the domain with an allowed address")
+	}
+
+	_, err = Dial(net.JoinHostPort("denied.test", port), time.Second)
+	if err != errNotAllowed {
+		t.Fatalf("Dial of denied domain got %v, want %v", err, errNotAllowed)
+	}
+
+	select {
+	case <-accepted:
+		t.Fatal("Listener on the denied address got a connection")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestReplyCode(t *testing.T) {
+	opErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+
+	cases := []struct {
+		err  error
+		want byte
+	}{
+		{opErr(errConnRefused), repConnectionRefused},
+		{opErr(errHostUnreach), repHostUnreachable},
+		{opErr(errNetUnreach), repNetworkUnreachable},
+		{&net.DNSError{Err: "no such host", Name: "nx.test", IsNotFound: true}, repHostUnreachable},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}, repTTLExpired},
+		{errNotAllowed, repGeneralFailure},
+	}
+
+	for _, c := range cases {
+		if got := replyCode(c.err); got != c.want {
+			t.Errorf("replyCode(%v) = %d, want %d", c.err, got, c.want)
+		}
+	}
+}
+
+// Write of the reply, read from the other end of a pipe
+func readReply(t *testing.T, rep byte, addr *net.TCPAddr) []byte {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ctx, err := netio.NewTCPCtx(a, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go reply(ctx, rep, addr)
+
+	buf := make([]byte, 4+net.IPv6len+2)
+	n, err := io.ReadAtLeast(b, buf, 4+net.IPv4len+2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestReplyAddrType(t *testing.T) {
+	cases := []struct {
+		addr *net.TCPAddr
+		want []byte
+	}{
+		{nil, []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 1080},
+			[]byte{5, 0, 0, 1, 192, 0, 2, 1, 4, 56}},
+		// v4-mapped form of net.ParseIP
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1080},
+			[]byte{5, 0, 0, 1, 192, 0, 2, 1, 4, 56}},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1080},
+			[]byte{5, 0, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 4, 56}},
+	}
+
+	for _, c := range cases {
+		if got := readReply(t, repSucceeded, c.addr); !bytes.Equal(got, c.want) {
+			t.Errorf("Reply of %v is %v, want %v", c.addr, got, c.want)
+		}
+	}
+}
+
+// Socks5 server on a local port, each connection handled as by proxy mode
+func serveSocks5(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				ctx, err := netio.NewTCPCtx(conn, false)
+				if err != nil {
+					return
+				}
+				HandleConnection(nil, ctx)
+			}()
+		}
+	}()
+
+	return listener
+}
+
+// Echo server, nil if the network isn't available
+func serveEcho(network string, address string) net.Listener {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener
+}
+
+// Send CONNECT of the address (ATYP, ADDR), returns the connection and reply
+func connect(t *testing.T, server string, atyp byte, addr []byte, port int) (net.Conn, []byte) {
+	conn, err := net.Dial("tcp", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte{5, 1, 0})
+	method := make([]byte, 2)
+	if _, err = io.ReadFull(conn, method); err != nil || method[1] != 0 {
+		t.Fatalf("Method reply %v, %v", method, err)
+	}
+
+	req := []byte{5, socksCmdConnect, 0, atyp}
+	req = append(req, addr...)
+	req = append(req, byte(port>>8), byte(port))
+	conn.Write(req)
+
+	head := make([]byte, 4)
+	if _, err = io.ReadFull(conn, head); err != nil {
+		t.Fatalf("Read reply: %v", err)
+	}
+	size := net.IPv4len
+	if head[3] == 0x04 {
+		size = net.IPv6len
+	}
+	bound := make([]byte, size+2)
+	if _, err = io.ReadFull(conn, bound); err != nil {
+		t.Fatalf("Read reply: %v", err)
+	}
+
+	return conn, append(head, bound...)
+}
+
+func hostPort(listener net.Listener) (net.IP, int) {
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP, addr.Port
+}
+
+func TestConnectRoundTrip(t *testing.T) {
+	hosts := writeTemp(t, "127.0.0.1 echo.test\n")
+	defer os.Remove(hosts)
+	option.HOSTS_FILE = hosts
+	defer func() { option.HOSTS_FILE = "" }()
+	if err := netio.InitResolver(); err != nil {
+		t.Fatal(err)
+	}
+
+	socks := serveSocks5(t)
+	defer socks.Close()
+	server := socks.Addr().String()
+
+	echo4 := serveEcho("tcp4", "127.0.0.1:0")
+	if echo4 == nil {
+		t.Fatal("Listen on IPv4 loopback failed")
+	}
+	defer echo4.Close()
+	echo6 := serveEcho("tcp6", "[::1]:0")
+
+	ip4, port4 := hostPort(echo4)
+	domain := []byte("echo.test")
+
+	cases := []struct {
+		name     string
+		atyp     byte
+		addr     []byte
+		port     int
+		wantAtyp byte
+	}{
+		{"IPv4", 0x01, ip4.To4(), port4, 0x01},
+		{"domain", 0x03, append([]byte{byte(len(domain))}, domain...), port4, 0x01},
+	}
+	if echo6 != nil {
+		defer echo6.Close()
+		ip6, port6 := hostPort(echo6)
+		cases = append(cases, struct {
+			name     string
+			atyp     byte
+			addr     []byte
+			port     int
+			wantAtyp byte
+		}{"IPv6", 0x04, ip6.To16(), port6, 0x04})
+	} else {
+		t.Log("IPv6 loopback isn't available, skip IPv6 target")
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn, rep := connect(t, server, c.atyp, c.addr, c.port)
+			defer conn.Close()
+
+			if rep[1] != repSucceeded {
+				t.Fatalf("Reply code %d, want succeeded", rep[1])
+			}
+			if rep[3] != c.wantAtyp {
+				t.Fatalf("Reply ATYP %d, want %d", rep[3], c.wantAtyp)
+			}
+
+			msg := []byte("hello " + c.name)
+			conn.Write(msg)
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, msg) {
+				t.Fatalf("Echo got %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestConnectErrorReplies(t *testing.T) {
+	socks := serveSocks5(t)
+	defer socks.Close()
+	server := socks.Addr().String()
+
+	echo := serveEcho("tcp4", "127.0.0.1:0")
+	if echo == nil {
+		t.Fatal("Listen on IPv4 loopback failed")
+	}
+	defer echo.Close()
+	ip, port := hostPort(echo)
+
+	// a port just closed refuses
+	closed := serveEcho("tcp4", "127.0.0.1:0")
+	_, closedPort := hostPort(closed)
+	closed.Close()
+
+	conn, rep := connect(t, server, 0x01, ip.To4(), closedPort)
+	conn.Close()
+	if rep[1] != repConnectionRefused {
+		t.Fatalf("Reply code %d of closed port, want %d", rep[1], repConnectionRefused)
+	}
+
+	rules := writeTemp(t, "deny 127.0.0.1 "+strconv.Itoa(port)+"\n")
+	defer os.Remove(rules)
+	if err := policy.Load(rules); err != nil {
+		t.Fatal(err)
+	}
+	defer policy.Load(os.DevNull)
+
+	conn, rep = connect(t, server, 0x01, ip.To4(), port)
+	conn.Close()
+	if rep[1] != repNotAllowed {
+		t.Fatalf("Reply code %d of denied target, want %d", rep[1], repNotAllowed)
+	}
+}
+
+// Requests to the front are relayed to the upstream socks5 server, the targets
+// are sent on targets
+func serveRelay(t *testing.T, upstream string, targets chan<- string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				up, err := net.Dial("tcp", upstream)
+				if err != nil {
+					return
+				}
+				defer up.Close()
+
+				connCtx, _ := netio.NewTCPCtx(conn, false)
+				upCtx, _ := netio.NewTCPCtx(up, false)
+				target, ok := Relay(connCtx, upCtx)
+				targets <- target
+				if !ok {
+					return
+				}
+				go io.Copy(up, conn)
+				io.Copy(conn, up)
+			}()
+		}
+	}()
+
+	return listener
+}
+
+func TestRelay(t *testing.T) {
+	socks := serveSocks5(t)
+	defer socks.Close()
+
+	targets := make(chan string, 1)
+	front := serveRelay(t, socks.Addr().String(), targets)
+	defer front.Close()
+	server := front.Addr().String()
+
+	echo := serveEcho("tcp4", "127.0.0.1:0")
+	if echo == nil {
+		t.Fatal("Listen on IPv4 loopback failed")
+	}
+	defer echo.Close()
+	ip, port := hostPort(echo)
+
+	conn, rep := connect(t, server, 0x01, ip.To4(), port)
+	defer conn.Close()
+	if rep[1] != repSucceeded {
+		t.Fatalf("Reply code %d, want succeeded", rep[1])
+	}
+	if target := <-targets; target != echo.Addr().String() {
+		t.Fatalf("Relay returned target %q, want %q", target, echo.Addr().String())
+	}
+
+	msg := []byte("hello relay")
+	conn.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("Echo got %q, %v", got, err)
+	}
+
+	// the reply of upstream is passed back
+	closed := serveEcho("tcp4", "127.0.0.1:0")
+	_, closedPort := hostPort(closed)
+	closed.Close()
+
+	conn, rep = connect(t, server, 0x01, ip.To4(), closedPort)
+	conn.Close()
+	if rep[1] != repConnectionRefused {
+		t.Fatalf("Reply code %d of closed port, want %d", rep[1], repConnectionRefused)
+	}
+	if target := <-targets; target != "" {
+		t.Fatalf("Relay returned target %q of failed request", target)
+	}
+}
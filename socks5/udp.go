@@ -0,0 +1,114 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"iox/logger"
+	"iox/netio"
+	"iox/option"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// UDP relay is an iox extension of socks5 for the TUN mode, after the
+// request succeeded each datagram on the connection is prefixed with
+// 2 bytes length. Other socks5 servers reply command not supported
+
+// ReadDatagram reads one datagram sent by WriteDatagram
+func ReadDatagram(conn netio.Ctx) ([]byte, error) {
+	size := make([]byte, 2)
+	if _, err := readAtLeast(conn, size, len(size)); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, binary.BigEndian.Uint16(size))
+	if _, err := readAtLeast(conn, b, len(b)); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func WriteDatagram(conn netio.Ctx, b []byte) error {
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+
+	_, err := conn.EncryptWrite(buf)
+	return err
+}
+
+func relayUDP(conn netio.Ctx, target string, start time.Time) {
+	ips, port, ok := checkTarget(conn, target, start)
+	if !ok {
+		return
+	}
+	resolved := net.JoinHostPort(ips[0].String(), port)
+
+	remoteConn, err := net.Dial("udp", resolved)
+	if err != nil {
+		replyFailed(conn, target, resolved, replyCode(err), start)
+		logger.Debug("Connect remote :" + err.Error())
+		return
+	}
+	defer remoteConn.Close()
+
+	requests.Inc(repResults[repSucceeded])
+	localAddr := remoteConn.LocalAddr().(*net.UDPAddr)
+	err = reply(conn, repSucceeded, &net.TCPAddr{IP: localAddr.IP, Port: localAddr.Port})
+	if err != nil {
+		return
+	}
+
+	logger.Debug("Open udp relay: %s <== FWD ==> %s (%s)", conn.RemoteAddr().String(), resolved, target)
+
+	var up, down int64
+	var closed int32
+
+	// the remote socket is closed when the stream ends, which stops reading below
+	go func() {
+		defer remoteConn.Close()
+		defer atomic.StoreInt32(&closed, 1)
+		for {
+			b, err := ReadDatagram(conn)
+			if err != nil {
+				return
+			}
+			if _, err = remoteConn.Write(b); err == nil {
+				atomic.AddInt64(&up, int64(len(b)))
+			}
+		}
+	}()
+
+	buf := make([]byte, option.UDP_PACKET_MAX_SIZE)
+	for {
+		n, err := remoteConn.Read(buf)
+		if err != nil {
+			// e.g. ICMP port unreachable of previous datagram
+			if atomic.LoadInt32(&closed) == 0 {
+				continue
+			}
+			break
+		}
+		if err = WriteDatagram(conn, buf[:n]); err != nil {
+			break
+		}
+		atomic.AddInt64(&down, int64(n))
+	}
+
+	duration := time.Since(start)
+	logger.Debug("Close udp relay: %s <== FWD ==> %s, up %d bytes, down %d bytes, duration %s",
+		conn.RemoteAddr().String(), resolved, atomic.LoadInt64(&up), atomic.LoadInt64(&down),
+		duration.Round(time.Millisecond))
+
+	logger.Access(logger.AccessRecord{
+		Start:     start,
+		Kind:      "socks-udp",
+		Client:    conn.RemoteAddr().String(),
+		Target:    target,
+		Resolved:  resolved,
+		Result:    "ok",
+		Duration:  duration,
+		BytesUp:   atomic.LoadInt64(&up),
+		BytesDown: atomic.LoadInt64(&down),
+	})
+}
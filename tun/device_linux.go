@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+package tun
+
+import (
+	"io"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+type ifreq struct {
+	name  [unix.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+// Open the TUN device, it's created if not exists. Addresses and routes
+// are left to `ip` command
+func Open(name string) (io.ReadWriteCloser, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var ifr ifreq
+	copy(ifr.name[:unix.IFNAMSIZ-1], name)
+	ifr.flags = unix.IFF_TUN | unix.IFF_NO_PI
+
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TUNSETIFF, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		unix.Close(fd)
+		return nil, errno
+	}
+
+	// non-blocking fd goes to the runtime poller, so Close interrupts Read
+	if err = unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
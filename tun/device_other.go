@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package tun
+
+import (
+	"errors"
+	"io"
+)
+
+func Open(name string) (io.ReadWriteCloser, error) {
+	return nil, errors.New("TUN device is only supported on Linux")
+}
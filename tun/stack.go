@@ -0,0 +1,202 @@
+// Minimal userspace network stack on a TUN device, it terminates the TCP and
+// UDP flows routed to the device so they can be relayed like socks5 requests.
+//
+// Only IPv4 is handled, and the TCP is just enough for the loss-free link
+// between kernel and TUN: no options except MSS, no window scaling, out of
+// order segments are dropped and left to the kernel to retransmit
+package tun
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+
+	ipv4HeaderSize = 20
+	tcpHeaderSize  = 20
+	udpHeaderSize  = 8
+
+	// TCP and UDP flows at the same time, new flows beyond are refused
+	maxFlows = 0x1000
+)
+
+// Handler relays the flows, it's called in a new goroutine for each flow
+type Handler interface {
+	// Call conn.Establish once the target is connected, or conn.Reset
+	HandleTCP(conn *TCPConn)
+	HandleUDP(conn *UDPConn)
+}
+
+type flowKey struct {
+	srcIP   [4]byte
+	dstIP   [4]byte
+	srcPort uint16
+	dstPort uint16
+}
+
+type Stack struct {
+	dev     io.ReadWriteCloser
+	handler Handler
+
+	writeMu sync.Mutex
+	ipID    uint16
+
+	mu   sync.Mutex
+	tcps map[flowKey]*TCPConn
+	udps map[flowKey]*UDPConn
+}
+
+func NewStack(dev io.ReadWriteCloser, handler Handler) *Stack {
+	return &Stack{
+		dev:     dev,
+		handler: handler,
+		tcps:    make(map[flowKey]*TCPConn),
+		udps:    make(map[flowKey]*UDPConn),
+	}
+}
+
+// Run reads packets until the device is closed
+func (s *Stack) Run() error {
+	go s.tick()
+
+	buf := make([]byte, 0xFFFF)
+	for {
+		n, err := s.dev.Read(buf)
+		if err != nil {
+			return err
+		}
+		s.input(buf[:n])
+	}
+}
+
+func (s *Stack) Close() error {
+	return s.dev.Close()
+}
+
+func (s *Stack) tick() {
+	for now := range time.Tick(100 * time.Millisecond) {
+		s.mu.Lock()
+		tcps := make([]*TCPConn, 0, len(s.tcps))
+		for _, c := range s.tcps {
+			tcps = append(tcps, c)
+		}
+		udps := make([]*UDPConn, 0, len(s.udps))
+		for _, c := range s.udps {
+			udps = append(udps, c)
+		}
+		s.mu.Unlock()
+
+		for _, c := range tcps {
+			c.tick(now)
+		}
+		for _, c := range udps {
+			c.tick(now)
+		}
+	}
+}
+
+func (s *Stack) flows() int {
+	return len(s.tcps) + len(s.udps)
+}
+
+func (s *Stack) input(pkt []byte) {
+	if len(pkt) < ipv4HeaderSize || pkt[0]>>4 != 4 {
+		return
+	}
+
+	ihl := int(pkt[0]&0x0F) * 4
+	total := int(binary.BigEndian.Uint16(pkt[2:]))
+	if ihl < ipv4HeaderSize || total < ihl || total > len(pkt) {
+		return
+	}
+
+	// fragments are not reassembled
+	if binary.BigEndian.Uint16(pkt[6:])&0x3FFF != 0 {
+		return
+	}
+
+	var key flowKey
+	copy(key.srcIP[:], pkt[12:16])
+	copy(key.dstIP[:], pkt[16:20])
+	payload := pkt[ihl:total]
+
+	switch pkt[9] {
+	case protoTCP:
+		if len(payload) < tcpHeaderSize {
+			return
+		}
+		key.srcPort = binary.BigEndian.Uint16(payload)
+		key.dstPort = binary.BigEndian.Uint16(payload[2:])
+		s.inputTCP(key, payload)
+	case protoUDP:
+		if len(payload) < udpHeaderSize {
+			return
+		}
+		key.srcPort = binary.BigEndian.Uint16(payload)
+		key.dstPort = binary.BigEndian.Uint16(payload[2:])
+		s.inputUDP(key, payload[udpHeaderSize:])
+	}
+}
+
+// Write an IPv4 packet from the flow's destination to its source,
+// l4 has the checksum filled already
+func (s *Stack) output(key flowKey, proto byte, l4 []byte) error {
+	pkt := make([]byte, ipv4HeaderSize+len(l4))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[6] = 0x40 // don't fragment
+	pkt[8] = 64
+	pkt[9] = proto
+	copy(pkt[12:16], key.dstIP[:])
+	copy(pkt[16:20], key.srcIP[:])
+	copy(pkt[ipv4HeaderSize:], l4)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.ipID++
+	binary.BigEndian.PutUint16(pkt[4:], s.ipID)
+	binary.BigEndian.PutUint16(pkt[10:], fold(sum(0, pkt[:ipv4HeaderSize])))
+
+	_, err := s.dev.Write(pkt)
+	return err
+}
+
+func sum(s uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+func fold(s uint32) uint16 {
+	for s>>16 != 0 {
+		s = s&0xFFFF + s>>16
+	}
+	return ^uint16(s)
+}
+
+// Checksum of TCP/UDP going from the flow's destination to its source
+func l4Checksum(key flowKey, proto byte, l4 []byte) uint16 {
+	s := sum(0, key.dstIP[:])
+	s = sum(s, key.srcIP[:])
+	s += uint32(proto) + uint32(len(l4))
+	return fold(sum(s, l4))
+}
+
+func srcAddr(key flowKey) (net.IP, int) {
+	return net.IPv4(key.srcIP[0], key.srcIP[1], key.srcIP[2], key.srcIP[3]), int(key.srcPort)
+}
+
+func dstAddr(key flowKey) (net.IP, int) {
+	return net.IPv4(key.dstIP[0], key.dstIP[1], key.dstIP[2], key.dstIP[3]), int(key.dstPort)
+}
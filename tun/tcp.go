@@ -0,0 +1,657 @@
+package tun
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"iox/option"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+
+	// no window scaling, the receive window can't be larger
+	tcpRecvBuffer = 0xFFFF
+	tcpSendBuffer = 0x40000
+
+	tcpDefaultMSS = 536
+	tcpMinRTO     = 200 * time.Millisecond
+	tcpMaxRTO     = 5 * time.Second
+	tcpMaxRetries = 8
+
+	// how long a closed connection waits for the FIN of peer
+	tcpLingerTimeout = 60 * time.Second
+)
+
+var (
+	errReset  = errors.New("connection reset by peer")
+	errClosed = errors.New("use of closed connection")
+)
+
+// timeoutError is returned by Read and Write after the deadline, it's a
+// net.Error like the one of net.Conn
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type segment struct {
+	seq     uint32
+	ack     uint32
+	flags   byte
+	window  uint16
+	mss     int
+	payload []byte
+}
+
+func parseSegment(b []byte) (seg segment, ok bool) {
+	off := int(b[12]>>4) * 4
+	if off < tcpHeaderSize || off > len(b) {
+		return
+	}
+
+	seg = segment{
+		seq:     binary.BigEndian.Uint32(b[4:]),
+		ack:     binary.BigEndian.Uint32(b[8:]),
+		flags:   b[13] & 0x3F,
+		window:  binary.BigEndian.Uint16(b[14:]),
+		payload: b[off:],
+	}
+
+	opts := b[tcpHeaderSize:off]
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case 0: // end of options
+			return seg, true
+		case 1: // nop
+			i++
+		default:
+			if i+1 >= len(opts) || opts[i+1] < 2 {
+				return seg, true
+			}
+			if opts[i] == 2 && opts[i+1] == 4 && i+4 <= len(opts) {
+				seg.mss = int(binary.BigEndian.Uint16(opts[i+2:]))
+			}
+			i += int(opts[i+1])
+		}
+	}
+
+	return seg, true
+}
+
+var _ net.Conn = &TCPConn{}
+
+// a is before b in sequence space
+func seqBefore(a uint32, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// TCPConn is the userspace end of a TCP flow routed to TUN. LocalAddr is the
+// destination of the flow, RemoteAddr is the client
+type TCPConn struct {
+	stack *Stack
+	key   flowKey
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	established bool
+	closed      bool
+	closedAt    time.Time
+	reset       bool
+	// removed from stack
+	done bool
+
+	irs    uint32
+	rcvNxt uint32
+	rcvBuf []byte
+	rcvFin bool
+	rcvWnd uint16
+
+	iss    uint32
+	sndUna uint32
+	sndNxt uint32
+	sndMax uint32
+	sndWnd uint32
+	mss    int
+	// data from sndUna, acked bytes are dropped
+	sndBuf     []byte
+	synAcked   bool
+	finPending bool
+	finSent    bool
+	finSeq     uint32
+	finAcked   bool
+
+	rto     time.Duration
+	rtoAt   time.Time
+	retries int
+
+	// the timers wake up Read and Write waiting at the deadlines
+	readDeadline  time.Time
+	readTimer     *time.Timer
+	writeDeadline time.Time
+	writeTimer    *time.Timer
+}
+
+// The initial sequence number is random, so it can't be guessed from outside
+func newISS() uint32 {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return uint32(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func newTCPConn(s *Stack, key flowKey, syn segment) *TCPConn {
+	mss := syn.mss
+	if mss == 0 {
+		mss = tcpDefaultMSS
+	}
+	if mss > option.TUN_MTU-ipv4HeaderSize-tcpHeaderSize {
+		mss = option.TUN_MTU - ipv4HeaderSize - tcpHeaderSize
+	}
+
+	iss := newISS()
+	c := &TCPConn{
+		stack:  s,
+		key:    key,
+		irs:    syn.seq,
+		rcvNxt: syn.seq + 1,
+		iss:    iss,
+		sndUna: iss,
+		sndNxt: iss,
+		sndMax: iss,
+		sndWnd: uint32(syn.window),
+		mss:    mss,
+		rto:    tcpMinRTO,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (s *Stack) inputTCP(key flowKey, b []byte) {
+	seg, ok := parseSegment(b)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	c, ok := s.tcps[key]
+	if !ok && seg.flags&(tcpSYN|tcpACK|tcpRST) == tcpSYN && s.flows() < maxFlows {
+		c = newTCPConn(s, key, seg)
+		s.tcps[key] = c
+		s.mu.Unlock()
+
+		go s.handler.HandleTCP(c)
+		return
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		if seg.flags&tcpRST == 0 {
+			s.resetFlow(key, seg)
+		}
+		return
+	}
+
+	c.input(seg)
+}
+
+// Reply RST to the segment of unknown flow
+func (s *Stack) resetFlow(key flowKey, seg segment) {
+	if seg.flags&tcpACK != 0 {
+		s.sendTCP(key, seg.ack, 0, tcpRST, 0, nil, nil)
+		return
+	}
+
+	ack := seg.seq + uint32(len(seg.payload))
+	if seg.flags&tcpSYN != 0 {
+		ack++
+	}
+	if seg.flags&tcpFIN != 0 {
+		ack++
+	}
+	s.sendTCP(key, 0, ack, tcpRST|tcpACK, 0, nil, nil)
+}
+
+func (s *Stack) sendTCP(key flowKey, seq uint32, ack uint32, flags byte, window uint16,
+	payload []byte, opts []byte) {
+	hdr := tcpHeaderSize + len(opts)
+	l4 := make([]byte, hdr+len(payload))
+
+	binary.BigEndian.PutUint16(l4[0:], key.dstPort)
+	binary.BigEndian.PutUint16(l4[2:], key.srcPort)
+	binary.BigEndian.PutUint32(l4[4:], seq)
+	binary.BigEndian.PutUint32(l4[8:], ack)
+	l4[12] = byte(hdr/4) << 4
+	l4[13] = flags
+	binary.BigEndian.PutUint16(l4[14:], window)
+	copy(l4[tcpHeaderSize:], opts)
+	copy(l4[hdr:], payload)
+	binary.BigEndian.PutUint16(l4[16:], l4Checksum(key, protoTCP, l4))
+
+	s.output(key, protoTCP, l4)
+}
+
+// Below are called with c.mu held
+
+func (c *TCPConn) window() uint16 {
+	return uint16(tcpRecvBuffer - len(c.rcvBuf))
+}
+
+func (c *TCPConn) send(flags byte, seq uint32, payload []byte, opts []byte) {
+	c.rcvWnd = c.window()
+	c.stack.sendTCP(c.key, seq, c.rcvNxt, flags, c.rcvWnd, payload, opts)
+}
+
+func (c *TCPConn) sendAck() {
+	c.send(tcpACK, c.sndNxt, nil, nil)
+}
+
+func (c *TCPConn) sendSynAck() {
+	mss := option.TUN_MTU - ipv4HeaderSize - tcpHeaderSize
+	c.send(tcpSYN|tcpACK, c.iss, nil, []byte{2, 4, byte(mss >> 8), byte(mss)})
+}
+
+func (c *TCPConn) armRTO() {
+	c.rtoAt = time.Now().Add(c.rto)
+}
+
+// Remove from stack, wake up readers and writers
+func (c *TCPConn) finish() {
+	if c.done {
+		return
+	}
+	c.done = true
+	c.cond.Broadcast()
+
+	c.stack.mu.Lock()
+	delete(c.stack.tcps, c.key)
+	c.stack.mu.Unlock()
+}
+
+func (c *TCPConn) abort() {
+	c.send(tcpRST|tcpACK, c.sndNxt, nil, nil)
+	c.reset = true
+	c.finish()
+}
+
+func (c *TCPConn) input(seg segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.done {
+		return
+	}
+
+	if seg.flags&tcpRST != 0 {
+		c.reset = true
+		c.finish()
+		return
+	}
+
+	if seg.flags&tcpSYN != 0 {
+		// retransmitted SYN, the SYN-ACK was lost or not sent yet
+		if c.established && !c.synAcked && seg.seq == c.irs {
+			c.sendSynAck()
+		}
+		return
+	}
+
+	if !c.established || seg.flags&tcpACK == 0 {
+		return
+	}
+
+	c.processAck(seg)
+	c.processData(seg)
+	c.output()
+
+	if c.finAcked && c.rcvFin {
+		c.finish()
+	}
+}
+
+func (c *TCPConn) processAck(seg segment) {
+	if seqBefore(seg.ack, c.sndUna) || seqBefore(c.sndMax, seg.ack) {
+		return
+	}
+	c.sndWnd = uint32(seg.window)
+
+	acked := int(seg.ack - c.sndUna)
+	if acked == 0 {
+		return
+	}
+
+	if !c.synAcked {
+		c.synAcked = true
+		acked--
+	}
+	if c.finSent && seg.ack == c.finSeq+1 {
+		c.finAcked = true
+		acked--
+	}
+	if acked > len(c.sndBuf) {
+		acked = len(c.sndBuf)
+	}
+	c.sndBuf = c.sndBuf[acked:]
+	if len(c.sndBuf) == 0 {
+		c.sndBuf = nil
+	}
+
+	c.sndUna = seg.ack
+	if seqBefore(c.sndNxt, c.sndUna) {
+		// acked what was sent before retransmission
+		c.sndNxt = c.sndUna
+	}
+
+	c.retries = 0
+	c.rto = tcpMinRTO
+	if c.sndUna == c.sndNxt {
+		c.rtoAt = time.Time{}
+	} else {
+		c.armRTO()
+	}
+
+	c.cond.Broadcast()
+}
+
+func (c *TCPConn) processData(seg segment) {
+	payload := seg.payload
+	fin := seg.flags&tcpFIN != 0
+	if len(payload) == 0 && !fin {
+		return
+	}
+
+	// out of order or retransmitted, ack what is expected
+	off := int32(c.rcvNxt - seg.seq)
+	if c.rcvFin || off < 0 || int(off) > len(payload) {
+		c.sendAck()
+		return
+	}
+
+	payload = payload[off:]
+	if space := tcpRecvBuffer - len(c.rcvBuf); len(payload) > space {
+		payload = payload[:space]
+		fin = false
+	}
+
+	// nobody reads after Close, just ack it
+	if !c.closed {
+		c.rcvBuf = append(c.rcvBuf, payload...)
+	}
+	c.rcvNxt += uint32(len(payload))
+	if fin {
+		c.rcvFin = true
+		c.rcvNxt++
+	}
+
+	c.sendAck()
+	c.cond.Broadcast()
+}
+
+// Send the data within peer's window, then FIN if closed
+func (c *TCPConn) output() {
+	if !c.established || !c.synAcked || c.done || c.finAcked {
+		return
+	}
+
+	end := c.sndUna + uint32(len(c.sndBuf))
+
+	// zero window is probed with 1 byte
+	wnd := c.sndWnd
+	if wnd == 0 {
+		wnd = 1
+	}
+	limit := c.sndUna + wnd
+
+	for seqBefore(c.sndNxt, end) && seqBefore(c.sndNxt, limit) {
+		n := uint32(c.mss)
+		if end-c.sndNxt < n {
+			n = end - c.sndNxt
+		}
+		if limit-c.sndNxt < n {
+			n = limit - c.sndNxt
+		}
+
+		off := c.sndNxt - c.sndUna
+		c.send(tcpACK|tcpPSH, c.sndNxt, c.sndBuf[off:off+n], nil)
+		c.sndNxt += n
+	}
+
+	if c.finPending && c.sndNxt == end {
+		c.finSent = true
+		c.finSeq = end
+		c.send(tcpFIN|tcpACK, end, nil, nil)
+		c.sndNxt = end + 1
+	}
+
+	if seqBefore(c.sndMax, c.sndNxt) {
+		c.sndMax = c.sndNxt
+	}
+	if c.sndNxt != c.sndUna && c.rtoAt.IsZero() {
+		c.armRTO()
+	}
+}
+
+func (c *TCPConn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.done {
+		return
+	}
+
+	if c.closed && now.Sub(c.closedAt) > tcpLingerTimeout {
+		c.abort()
+		return
+	}
+
+	if c.rtoAt.IsZero() || now.Before(c.rtoAt) {
+		return
+	}
+
+	c.retries++
+	if c.retries > tcpMaxRetries {
+		c.abort()
+		return
+	}
+
+	c.rto *= 2
+	if c.rto > tcpMaxRTO {
+		c.rto = tcpMaxRTO
+	}
+	c.armRTO()
+
+	if !c.synAcked {
+		c.sendSynAck()
+		return
+	}
+
+	// go back N, the link to kernel hardly drops anything
+	c.sndNxt = c.sndUna
+	c.output()
+}
+
+// Establish answers the SYN, the flow is connected from the client's view
+func (c *TCPConn) Establish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.done {
+		return
+	}
+
+	c.established = true
+	c.sndNxt = c.iss + 1
+	c.sndMax = c.sndNxt
+	c.sendSynAck()
+	c.armRTO()
+}
+
+// Reset refuses the flow, or aborts it if established
+func (c *TCPConn) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.done {
+		c.abort()
+	}
+}
+
+func (c *TCPConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.rcvBuf) == 0 {
+		switch {
+		case c.reset:
+			return 0, errReset
+		case c.closed:
+			return 0, errClosed
+		case c.rcvFin:
+			return 0, io.EOF
+		case c.done:
+			return 0, errClosed
+		case expired(c.readDeadline):
+			return 0, timeoutError{}
+		}
+		c.cond.Wait()
+	}
+
+	n := copy(b, c.rcvBuf)
+	c.rcvBuf = c.rcvBuf[n:]
+	if len(c.rcvBuf) == 0 {
+		c.rcvBuf = nil
+	}
+
+	// window update once there is room for a full segment again
+	if int(c.rcvWnd) < c.mss && int(c.window()) >= c.mss && !c.done {
+		c.sendAck()
+	}
+
+	return n, nil
+}
+
+func (c *TCPConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		for len(c.sndBuf) >= tcpSendBuffer && !c.reset && !c.closed && !c.done && !expired(c.writeDeadline) {
+			c.cond.Wait()
+		}
+		if c.reset {
+			return written, errReset
+		}
+		if c.closed || c.done {
+			return written, errClosed
+		}
+		if len(c.sndBuf) >= tcpSendBuffer {
+			return written, timeoutError{}
+		}
+
+		n := tcpSendBuffer - len(c.sndBuf)
+		if n > len(b) {
+			n = len(b)
+		}
+		c.sndBuf = append(c.sndBuf, b[:n]...)
+		b = b[n:]
+		written += n
+
+		c.output()
+	}
+
+	return written, nil
+}
+
+// Close sends FIN after the pending data, the flow is removed once peer
+// closed as well, or reset after tcpLingerTimeout
+func (c *TCPConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.closedAt = time.Now()
+	c.rcvBuf = nil
+	c.cond.Broadcast()
+
+	if c.done {
+		return nil
+	}
+	if !c.established {
+		c.abort()
+		return nil
+	}
+
+	c.finPending = true
+	c.output()
+	return nil
+}
+
+func (c *TCPConn) LocalAddr() net.Addr {
+	ip, port := dstAddr(c.key)
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+func (c *TCPConn) RemoteAddr() net.Addr {
+	ip, port := srcAddr(c.key)
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+func (c *TCPConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *TCPConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	c.readTimer = c.wakeAt(c.readTimer, t)
+	return nil
+}
+
+func (c *TCPConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+	c.writeTimer = c.wakeAt(c.writeTimer, t)
+	return nil
+}
+
+// wakeAt replaces the timer by the one waking up the waiting calls at t.
+// They are woken up now too, to check the new deadline
+func (c *TCPConn) wakeAt(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+		timer = nil
+	}
+	if !t.IsZero() && time.Now().Before(t) {
+		timer = time.AfterFunc(time.Until(t), func() {
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		})
+	}
+	c.cond.Broadcast()
+	return timer
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
@@ -0,0 +1,440 @@
+package tun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// packetPipe is the TUN device in memory, the test plays the kernel
+type packetPipe struct {
+	in     chan []byte
+	out    chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPacketPipe() *packetPipe {
+	return &packetPipe{
+		in:     make(chan []byte, 64),
+		out:    make(chan []byte, 1024),
+		closed: make(chan struct{}),
+	}
+}
+
+func (p *packetPipe) Read(b []byte) (int, error) {
+	select {
+	case pkt := <-p.in:
+		return copy(b, pkt), nil
+	case <-p.closed:
+		return 0, io.EOF
+	}
+}
+
+func (p *packetPipe) Write(b []byte) (int, error) {
+	pkt := make([]byte, len(b))
+	copy(pkt, b)
+	select {
+	case p.out <- pkt:
+		return len(b), nil
+	case <-p.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (p *packetPipe) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
+
+type testHandler struct {
+	tcps chan *TCPConn
+}
+
+func (h *testHandler) HandleTCP(conn *TCPConn) {
+	h.tcps <- conn
+}
+
+func (h *testHandler) HandleUDP(conn *UDPConn) {
+	conn.Close()
+}
+
+var (
+	clientIP   = [4]byte{10, 0, 0, 1}
+	serverIP   = [4]byte{10, 0, 0, 2}
+	clientPort = uint16(40000)
+	serverPort = uint16(80)
+)
+
+// testFlow is the client side of a flow, seq and ack are its next ones
+type testFlow struct {
+	t       *testing.T
+	dev     *packetPipe
+	stack   *Stack
+	handler *testHandler
+	seq     uint32
+	ack     uint32
+	window  uint16
+}
+
+func newTestFlow(t *testing.T) *testFlow {
+	f := &testFlow{
+		t:       t,
+		dev:     newPacketPipe(),
+		handler: &testHandler{tcps: make(chan *TCPConn, 1)},
+		seq:     1000,
+		window:  0xFFFF,
+	}
+	f.stack = NewStack(f.dev, f.handler)
+	go f.stack.Run()
+	return f
+}
+
+func (f *testFlow) close() {
+	f.dev.Close()
+}
+
+// send a segment from client, checksums are left empty as the stack
+// doesn't verify them
+func (f *testFlow) send(flags byte, payload []byte, opts []byte) {
+	hdr := tcpHeaderSize + len(opts)
+	pkt := make([]byte, ipv4HeaderSize+hdr+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = protoTCP
+	copy(pkt[12:], clientIP[:])
+	copy(pkt[16:], serverIP[:])
+
+	l4 := pkt[ipv4HeaderSize:]
+	binary.BigEndian.PutUint16(l4[0:], clientPort)
+	binary.BigEndian.PutUint16(l4[2:], serverPort)
+	binary.BigEndian.PutUint32(l4[4:], f.seq)
+	binary.BigEndian.PutUint32(l4[8:], f.ack)
+	l4[12] = byte(hdr/4) << 4
+	l4[13] = flags
+	binary.BigEndian.PutUint16(l4[14:], f.window)
+	copy(l4[tcpHeaderSize:], opts)
+	copy(l4[hdr:], payload)
+
+	f.dev.in <- pkt
+}
+
+// next segment from the stack, with the addresses and checksums checked
+func (f *testFlow) next() segment {
+	f.t.Helper()
+	select {
+	case pkt := <-f.dev.out:
+		if !bytes.Equal(pkt[12:16], serverIP[:]) || !bytes.Equal(pkt[16:20], clientIP[:]) {
+			f.t.Fatalf("Packet from %v to %v", net.IP(pkt[12:16]), net.IP(pkt[16:20]))
+		}
+		if fold(sum(0, pkt[:ipv4HeaderSize])) != 0 {
+			f.t.Fatal("Bad IPv4 header checksum")
+		}
+
+		l4 := pkt[ipv4HeaderSize:]
+		s := sum(0, serverIP[:])
+		s = sum(s, clientIP[:])
+		s += protoTCP + uint32(len(l4))
+		if fold(sum(s, l4)) != 0 {
+			f.t.Fatal("Bad TCP checksum")
+		}
+
+		seg, ok := parseSegment(l4)
+		if !ok {
+			f.t.Fatal("Malformed TCP segment")
+		}
+		return seg
+	case <-time.After(3 * time.Second):
+		f.t.Fatal("No segment from stack")
+	}
+	return segment{}
+}
+
+// Nothing is sent in d
+func (f *testFlow) quiet(d time.Duration) {
+	f.t.Helper()
+	select {
+	case pkt := <-f.dev.out:
+		seg, _ := parseSegment(pkt[ipv4HeaderSize:])
+		f.t.Fatalf("Unexpected segment flags 0x%x seq %d", seg.flags, seg.seq)
+	case <-time.After(d):
+	}
+}
+
+// connect runs the handshake, the conn is established
+func (f *testFlow) connect() (*TCPConn, segment) {
+	f.t.Helper()
+	f.send(tcpSYN, nil, []byte{2, 4, 0x05, 0xB4})
+	f.seq++
+
+	var conn *TCPConn
+	select {
+	case conn = <-f.handler.tcps:
+	case <-time.After(3 * time.Second):
+		f.t.Fatal("SYN isn't passed to handler")
+	}
+	conn.Establish()
+
+	synAck := f.next()
+	if synAck.flags != tcpSYN|tcpACK || synAck.ack != f.seq {
+		f.t.Fatalf("Got flags 0x%x ack %d, want SYN-ACK of %d", synAck.flags, synAck.ack, f.seq)
+	}
+	f.ack = synAck.seq + 1
+	f.send(tcpACK, nil, nil)
+	return conn, synAck
+}
+
+func TestTCPHandshake(t *testing.T) {
+	f := newTestFlow(t)
+	defer f.close()
+
+	conn, synAck := f.connect()
+	defer conn.Close()
+
+	if synAck.mss != 1500-ipv4HeaderSize-tcpHeaderSize {
+		t.Fatalf("SYN-ACK MSS %d", synAck.mss)
+	}
+	if conn.RemoteAddr().String() != "10.0.0.1:40000" || conn.LocalAddr().String() != "10.0.0.2:80" {
+		t.Fatalf("Flow %s -> %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
+	}
+
+	// client to stack
+	f.send(tcpACK|tcpPSH, []byte("hello"), nil)
+	f.seq += 5
+	if ack := f.next(); ack.flags != tcpACK || ack.ack != f.seq {
+		t.Fatalf("Got flags 0x%x ack %d, want ACK of %d", ack.flags, ack.ack, f.seq)
+	}
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read %q, %v", buf[:n], err)
+	}
+
+	// stack to client
+	conn.Write([]byte("world"))
+	data := f.next()
+	if data.seq != f.ack || string(data.payload) != "world" {
+		t.Fatalf("Got seq %d %q, want %d world", data.seq, data.payload, f.ack)
+	}
+}
+
+func TestTCPRefuse(t *testing.T) {
+	f := newTestFlow(t)
+	defer f.close()
+
+	f.send(tcpSYN, nil, nil)
+	conn := <-f.handler.tcps
+	conn.Reset()
+
+	rst := f.next()
+	if rst.flags&tcpRST == 0 || rst.ack != f.seq+1 {
+		t.Fatalf("Got flags 0x%x ack %d, want RST of %d", rst.flags, rst.ack, f.seq+1)
+	}
+
+	// segments of the flow gone are reset too
+	f.seq++
+	f.send(tcpACK, []byte("x"), nil)
+	if rst = f.next(); rst.flags&tcpRST == 0 {
+		t.Fatalf("Got flags 0x%x, want RST", rst.flags)
+	}
+}
+
+func TestTCPISS(t *testing.T) {
+	seen := make(map[uint32]bool)
+	for i := 0; i < 8; i++ {
+		seen[newISS()] = true
+	}
+	if len(seen) < 8 {
+		t.Fatal("ISS repeats")
+	}
+}
+
+func TestTCPRetransmit(t *testing.T) {
+	f := newTestFlow(t)
+	defer f.close()
+
+	// the SYN-ACK lost, SYN retransmitted by client
+	f.send(tcpSYN, nil, nil)
+	conn := <-f.handler.tcps
+	defer conn.Close()
+	conn.Establish()
+	first := f.next()
+	f.send(tcpSYN, nil, nil)
+	if again := f.next(); again.flags != tcpSYN|tcpACK || again.seq != first.seq {
+		t.Fatalf("Got flags 0x%x seq %d, want the SYN-ACK again", again.flags, again.seq)
+	}
+	f.seq++
+	f.ack = first.seq + 1
+	f.send(tcpACK, nil, nil)
+
+	// the data not acked is sent again after RTO
+	conn.Write([]byte("lost"))
+	data := f.next()
+	start := time.Now()
+	again := f.next()
+	if again.seq != data.seq || string(again.payload) != "lost" {
+		t.Fatalf("Got seq %d %q, want the data again", again.seq, again.payload)
+	}
+	if elapsed := time.Since(start); elapsed < tcpMinRTO/2 {
+		t.Fatalf("Retransmitted after %v, before RTO", elapsed)
+	}
+
+	f.ack += 4
+	f.send(tcpACK, nil, nil)
+	f.quiet(600 * time.Millisecond)
+}
+
+func TestTCPFin(t *testing.T) {
+	f := newTestFlow(t)
+	defer f.close()
+	conn, _ := f.connect()
+
+	// client closes first, stack still writes
+	f.send(tcpFIN|tcpACK, nil, nil)
+	f.seq++
+	if ack := f.next(); ack.ack != f.seq {
+		t.Fatalf("FIN acked %d, want %d", ack.ack, f.seq)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read %v after FIN, want EOF", err)
+	}
+
+	conn.Write([]byte("bye"))
+	if data := f.next(); string(data.payload) != "bye" {
+		t.Fatalf("Got %q after FIN of client", data.payload)
+	}
+	f.ack += 3
+	f.send(tcpACK, nil, nil)
+
+	conn.Close()
+	fin := f.next()
+	if fin.flags&tcpFIN == 0 || fin.seq != f.ack {
+		t.Fatalf("Got flags 0x%x seq %d, want FIN of %d", fin.flags, fin.seq, f.ack)
+	}
+	f.ack++
+	f.send(tcpACK, nil, nil)
+
+	// removed once both FINs are acked
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		f.stack.mu.Lock()
+		n := len(f.stack.tcps)
+		f.stack.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Closed flow isn't removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTCPRst(t *testing.T) {
+	f := newTestFlow(t)
+	defer f.close()
+	conn, _ := f.connect()
+	defer conn.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	f.send(tcpRST, nil, nil)
+	select {
+	case err := <-done:
+		if err != errReset {
+			t.Fatalf("Read %v after RST, want %v", err, errReset)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Read blocks after RST")
+	}
+	if _, err := conn.Write([]byte("x")); err != errReset {
+		t.Fatalf("Write %v after RST, want %v", err, errReset)
+	}
+}
+
+func TestTCPWindow(t *testing.T) {
+	f := newTestFlow(t)
+	defer f.close()
+
+	f.window = 100
+	conn, _ := f.connect()
+	defer conn.Close()
+
+	// sent within the window of client
+	conn.Write(make([]byte, 300))
+	if data := f.next(); len(data.payload) != 100 {
+		t.Fatalf("Sent %d bytes in window of 100", len(data.payload))
+	}
+	f.quiet(100 * time.Millisecond)
+
+	f.ack += 100
+	f.window = 0xFFFF
+	f.send(tcpACK, nil, nil)
+	if data := f.next(); len(data.payload) != 200 {
+		t.Fatalf("Sent %d bytes after the window opened, want 200", len(data.payload))
+	}
+	f.ack += 200
+	f.send(tcpACK, nil, nil)
+
+	// the window of stack shrinks by what isn't read
+	f.send(tcpACK|tcpPSH, make([]byte, 1000), nil)
+	f.seq += 1000
+	if ack := f.next(); ack.window != tcpRecvBuffer-1000 {
+		t.Fatalf("Window %d with 1000 bytes unread, want %d", ack.window, tcpRecvBuffer-1000)
+	}
+}
+
+func TestTCPDeadline(t *testing.T) {
+	f := newTestFlow(t)
+	defer f.close()
+	conn, _ := f.connect()
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Read %v after deadline, want timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Read returned after %v", elapsed)
+	}
+
+	// cleared, the data is read
+	conn.SetReadDeadline(time.Time{})
+	f.send(tcpACK|tcpPSH, []byte("late"), nil)
+	buf := make([]byte, 8)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "late" {
+		t.Fatalf("Read %q, %v after the deadline cleared", buf[:n], err)
+	}
+	f.seq += 4
+	f.next()
+
+	// a deadline set while blocked wakes the writer up
+	f.window = 0
+	f.send(tcpACK, nil, nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(make([]byte, tcpSendBuffer+1))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	select {
+	case err = <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("Write %v after deadline, want timeout", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Write blocks after deadline")
+	}
+}
@@ -0,0 +1,127 @@
+package tun
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	udpIdleTimeout = 60 * time.Second
+
+	// datagrams queued for the handler, more are dropped
+	udpQueueSize = 0x40
+)
+
+// UDPConn is the userspace end of a UDP flow routed to TUN, each Read and
+// Write is one datagram. It's closed after idle for udpIdleTimeout
+type UDPConn struct {
+	// unix nano, accessed atomically
+	lastActive int64
+
+	stack *Stack
+	key   flowKey
+
+	packets   chan []byte
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (s *Stack) inputUDP(key flowKey, payload []byte) {
+	s.mu.Lock()
+	c, ok := s.udps[key]
+	if !ok {
+		if s.flows() >= maxFlows {
+			s.mu.Unlock()
+			return
+		}
+
+		c = &UDPConn{
+			stack:   s,
+			key:     key,
+			packets: make(chan []byte, udpQueueSize),
+			closed:  make(chan struct{}),
+		}
+		s.udps[key] = c
+		go s.handler.HandleUDP(c)
+	}
+	s.mu.Unlock()
+
+	c.touch()
+
+	b := make([]byte, len(payload))
+	copy(b, payload)
+	select {
+	case c.packets <- b:
+	default:
+	}
+}
+
+func (c *UDPConn) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+func (c *UDPConn) tick(now time.Time) {
+	if now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastActive))) > udpIdleTimeout {
+		c.Close()
+	}
+}
+
+func (c *UDPConn) Read(b []byte) (int, error) {
+	select {
+	case p := <-c.packets:
+		return copy(b, p), nil
+	case <-c.closed:
+		return 0, io.EOF
+	}
+}
+
+func (c *UDPConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errClosed
+	default:
+	}
+
+	l4 := make([]byte, udpHeaderSize+len(b))
+	binary.BigEndian.PutUint16(l4[0:], c.key.dstPort)
+	binary.BigEndian.PutUint16(l4[2:], c.key.srcPort)
+	binary.BigEndian.PutUint16(l4[4:], uint16(len(l4)))
+	copy(l4[udpHeaderSize:], b)
+
+	checksum := l4Checksum(c.key, protoUDP, l4)
+	if checksum == 0 {
+		checksum = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(l4[6:], checksum)
+
+	if err := c.stack.output(c.key, protoUDP, l4); err != nil {
+		return 0, err
+	}
+	c.touch()
+	return len(b), nil
+}
+
+func (c *UDPConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+
+		c.stack.mu.Lock()
+		delete(c.stack.udps, c.key)
+		c.stack.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *UDPConn) LocalAddr() net.Addr {
+	ip, port := dstAddr(c.key)
+	return &net.UDPAddr{IP: ip, Port: port}
+}
+
+func (c *UDPConn) RemoteAddr() net.Addr {
+	ip, port := srcAddr(c.key)
+	return &net.UDPAddr{IP: ip, Port: port}
+}